@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// NoBallot marks an acceptor instance that has not accepted any value yet.
+const NoBallot = -1
+
+type AcceptorPrepareArgs struct {
+	TxId     string
+	Instance int
+	Ballot   int
+}
+
+type AcceptorAcceptArgs struct {
+	TxId     string
+	Instance int
+	Ballot   int
+	Value    TxState
+}
+
+type AcceptorLearnArgs struct {
+	TxId     string
+	Instance int
+}
+
+type AcceptorPromise struct {
+	Ok             bool
+	AcceptedBallot int
+	AcceptedValue  TxState
+}
+
+type AcceptorAcceptResult struct {
+	Accepted bool
+}
+
+type acceptorInstance struct {
+	promised       int
+	acceptedBallot int
+	acceptedValue  TxState
+}
+
+// Acceptor holds the Paxos Commit acceptor state for every (transaction, participant) instance.
+// Each replica hosts one, so the acceptor group is the replica set itself.
+type Acceptor struct {
+	num       int
+	instances map[string]*acceptorInstance
+	log       *logger
+	mu        sync.Mutex
+}
+
+func NewAcceptor(num int, logPath string, logFormat string, durability logDurability) *Acceptor {
+	l := newLogger(logPath, logFormat, durability)
+	return &Acceptor{num, make(map[string]*acceptorInstance), l, sync.Mutex{}}
+}
+
+func (a *Acceptor) getInstance(txId string, instance int) *acceptorInstance {
+	id := fmt.Sprint(txId, "/", instance)
+	inst, ok := a.instances[id]
+	if !ok {
+		inst = &acceptorInstance{NoBallot, NoBallot, NoState}
+		a.instances[id] = inst
+	}
+	return inst
+}
+
+// writeInstance durably records an instance before the acceptor answers for it
+func (a *Acceptor) writeInstance(txId string, instance int, inst *acceptorInstance) {
+	a.log.writeRecord(txId, strconv.Itoa(instance), strconv.Itoa(inst.promised), strconv.Itoa(inst.acceptedBallot), inst.acceptedValue.String())
+}
+
+func (a *Acceptor) Prepare(args *AcceptorPrepareArgs, reply *AcceptorPromise) (err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	inst := a.getInstance(args.TxId, args.Instance)
+	reply.Ok = false
+	if args.Ballot > inst.promised {
+		inst.promised = args.Ballot
+		a.writeInstance(args.TxId, args.Instance, inst)
+		reply.Ok = true
+	}
+	reply.AcceptedBallot = inst.acceptedBallot
+	reply.AcceptedValue = inst.acceptedValue
+	return nil
+}
+
+func (a *Acceptor) Accept(args *AcceptorAcceptArgs, reply *AcceptorAcceptResult) (err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	inst := a.getInstance(args.TxId, args.Instance)
+	reply.Accepted = false
+	if args.Ballot >= inst.promised {
+		inst.promised = args.Ballot
+		inst.acceptedBallot = args.Ballot
+		inst.acceptedValue = args.Value
+		a.writeInstance(args.TxId, args.Instance, inst)
+		reply.Accepted = true
+	}
+	return nil
+}
+
+func (a *Acceptor) Learn(args *AcceptorLearnArgs, reply *AcceptorPromise) (err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	inst := a.getInstance(args.TxId, args.Instance)
+	reply.Ok = inst.acceptedBallot != NoBallot
+	reply.AcceptedBallot = inst.acceptedBallot
+	reply.AcceptedValue = inst.acceptedValue
+	return nil
+}
+
+func (a *Acceptor) recover() (err error) {
+	records, err := a.log.readRecords()
+	if err != nil {
+		return
+	}
+
+	for _, record := range records {
+		if len(record) != 5 {
+			logWarn("Skipping malformed acceptor record", "record", record)
+			continue
+		}
+		instance, err := strconv.Atoi(record[1])
+		if err != nil {
+			return err
+		}
+		promised, err := strconv.Atoi(record[2])
+		if err != nil {
+			return err
+		}
+		acceptedBallot, err := strconv.Atoi(record[3])
+		if err != nil {
+			return err
+		}
+		// Later records for an instance supersede earlier ones
+		inst := a.getInstance(record[0], instance)
+		inst.promised = promised
+		inst.acceptedBallot = acceptedBallot
+		inst.acceptedValue = ParseTxState(record[4])
+	}
+	return nil
+}
+
+// localAcceptor lets a replica talk to its own acceptor without going through RPC,
+// which matters during recovery before the replica is listening.
+type localAcceptor struct {
+	a *Acceptor
+}
+
+func (l *localAcceptor) Prepare(txId string, instance int, ballot int) (Result *AcceptorPromise, err error) {
+	var reply AcceptorPromise
+	err = l.a.Prepare(&AcceptorPrepareArgs{txId, instance, ballot}, &reply)
+	return &reply, err
+}
+
+func (l *localAcceptor) Accept(txId string, instance int, ballot int, value TxState) (Accepted *bool, err error) {
+	var reply AcceptorAcceptResult
+	err = l.a.Accept(&AcceptorAcceptArgs{txId, instance, ballot, value}, &reply)
+	return &reply.Accepted, err
+}
+
+func (l *localAcceptor) Learn(txId string, instance int) (Result *AcceptorPromise, err error) {
+	var reply AcceptorPromise
+	err = l.a.Learn(&AcceptorLearnArgs{txId, instance}, &reply)
+	return &reply, err
+}
@@ -0,0 +1,93 @@
+
+package main
+
+import (
+	"io"
+	"net"
+	"net/rpc"
+)
+
+type AcceptorClient struct {
+	host      string
+	rpcClient *rpc.Client
+}
+
+func NewAcceptorClient(host string) *AcceptorClient {
+	client := &AcceptorClient{host, nil}
+	client.tryConnect()
+	return client
+}
+
+func (c *AcceptorClient) tryConnect() (err error) {
+	if c.rpcClient != nil {
+		return
+	}
+
+	rpcClient, err := rpc.DialHTTP("tcp", c.host)
+	if err != nil {
+		return
+	}
+	c.rpcClient = rpcClient
+	return
+}
+
+func (c *AcceptorClient) call(serviceMethod string, args interface{}, reply interface{}) (err error) {
+	err = c.rpcClient.Call(serviceMethod, args, reply)
+	// A server that died mid-call leaves an EOF rather than ErrShutdown, and the connection is dead too
+	_, isNetOpError := err.(*net.OpError)
+	if err == rpc.ErrShutdown || err == io.EOF || err == io.ErrUnexpectedEOF || isNetOpError {
+		c.rpcClient = nil
+	}
+	return
+}
+
+func (c *AcceptorClient) Prepare(txid string, instance int, ballot int) (Result *AcceptorPromise, err error) {
+	if err = c.tryConnect(); err != nil {
+		return
+	}
+
+	var reply AcceptorPromise
+	err = c.call("Acceptor.Prepare", &AcceptorPrepareArgs{ txid, instance, ballot }, &reply)
+	if err != nil {
+		logDebug("RPC failed", "call", "Acceptor.Prepare", "host", c.host, "error", err)
+		return
+	}
+	
+	Result = &reply
+	
+	return
+}
+
+func (c *AcceptorClient) Accept(txid string, instance int, ballot int, value TxState) (Accepted *bool, err error) {
+	if err = c.tryConnect(); err != nil {
+		return
+	}
+
+	var reply AcceptorAcceptResult
+	err = c.call("Acceptor.Accept", &AcceptorAcceptArgs{ txid, instance, ballot, value }, &reply)
+	if err != nil {
+		logDebug("RPC failed", "call", "Acceptor.Accept", "host", c.host, "error", err)
+		return
+	}
+	
+	Accepted = &reply.Accepted
+	
+	return
+}
+
+func (c *AcceptorClient) Learn(txid string, instance int) (Result *AcceptorPromise, err error) {
+	if err = c.tryConnect(); err != nil {
+		return
+	}
+
+	var reply AcceptorPromise
+	err = c.call("Acceptor.Learn", &AcceptorLearnArgs{ txid, instance }, &reply)
+	if err != nil {
+		logDebug("RPC failed", "call", "Acceptor.Learn", "host", c.host, "error", err)
+		return
+	}
+	
+	Result = &reply
+	
+	return
+}
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dchest/uniuri"
+	flag "github.com/ogier/pflag"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A backup is a gzipped tar file holding manifest.json, followed by one file per shard with every
+// committed key and its stored value, each as a uvarint length and the bytes. The value is kept
+// exactly as the storage engine holds it, content type included, so any engine can restore it.
+//
+// It is consistent across shards because the master pauses its commits, waits until none is being
+// applied, and only then has one replica of each shard start a snapshot. From there on a replica
+// keeps the old value of every key a commit overwrites or deletes until the snapshot is read, so
+// commits resume as soon as every shard's snapshot has started.
+const backupVersion = 1
+
+const backupManifestName = "manifest.json"
+
+// backupPauseTimeout is how long a backup waits for the commits being applied to finish
+const backupPauseTimeout = 10 * time.Second
+
+// snapshotIdleTimeout is how long a replica keeps a snapshot nobody reads
+const snapshotIdleTimeout = time.Minute
+
+const snapshotPageSize = 1000
+
+// backupManifest describes a backup. AsOf is only set on one made by point-in-time recovery, and
+// says which point it recovered to.
+type backupManifest struct {
+	Version   int
+	CreatedAt time.Time
+	Master    string
+	Shards    []backupShard
+	AsOf      string `json:",omitempty"`
+}
+
+// backupShard is one shard's file in the backup, read from the snapshot of Replica
+type backupShard struct {
+	Id      string
+	Replica string
+	File    string
+	Keys    int
+	Crc32   uint32
+}
+
+// commitGate lets a backup pause the master's commits once the ones being applied have finished
+type commitGate struct {
+	mu         sync.Mutex
+	cond       *sync.Cond
+	committing int
+	paused     bool
+}
+
+func newCommitGate() *commitGate {
+	g := &commitGate{}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+// enter waits out a pause, then counts a commit as being applied until leave
+func (g *commitGate) enter() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for g.paused {
+		g.cond.Wait()
+	}
+	g.committing++
+}
+
+func (g *commitGate) leave() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.committing--
+	g.cond.Broadcast()
+}
+
+// pause stops new commits and waits for the ones being applied. If they don't finish in time, say
+// because a participant is down, commits carry on and an error is returned.
+func (g *commitGate) pause(timeout time.Duration) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.paused {
+		return errors.New("Another backup is already pausing commits.")
+	}
+	g.paused = true
+	deadline := time.Now().Add(timeout)
+	timer := time.AfterFunc(timeout, func() {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		g.cond.Broadcast()
+	})
+	defer timer.Stop()
+	for g.committing > 0 && time.Now().Before(deadline) {
+		g.cond.Wait()
+	}
+	if g.committing > 0 {
+		g.paused = false
+		g.cond.Broadcast()
+		return errors.New(fmt.Sprint("Gave up waiting for ", g.committing, " commits to finish."))
+	}
+	return nil
+}
+
+func (g *commitGate) resume() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.paused = false
+	g.cond.Broadcast()
+}
+
+// storeSnapshot is a replica's committed store as it was when the snapshot started
+type storeSnapshot struct {
+	keys       []string
+	inSnapshot map[string]bool
+	// saved holds the old value of each key in the snapshot that a commit has since changed
+	saved map[string][]byte
+	err   error
+	timer *time.Timer
+}
+
+func newStoreSnapshot(keys []string, timer *time.Timer) *storeSnapshot {
+	sort.Strings(keys)
+	inSnapshot := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		inSnapshot[key] = true
+	}
+	return &storeSnapshot{keys, inSnapshot, make(map[string][]byte), nil, timer}
+}
+
+// preserve saves the value of key before a commit changes it, if the snapshot still needs it
+func (s *storeSnapshot) preserve(store storageEngine, key string) {
+	if _, ok := s.saved[key]; ok || !s.inSnapshot[key] || s.err != nil {
+		return
+	}
+	value, err := store.get(key)
+	if err != nil {
+		s.err = errors.New(fmt.Sprint("Unable to save the old value of key ", key, " for a snapshot: ", err))
+		return
+	}
+	s.saved[key] = value
+}
+
+// read returns up to limit entries starting with the offset'th key, and whether they are the last
+func (s *storeSnapshot) read(store storageEngine, offset int, limit int) (entries []SnapshotEntry, done bool, err error) {
+	if s.err != nil {
+		return nil, false, s.err
+	}
+	i := offset
+	for ; i < len(s.keys) && len(entries) < limit; i++ {
+		key := s.keys[i]
+		value, ok := s.saved[key]
+		if !ok {
+			value, err = store.get(key)
+			if err != nil {
+				return
+			}
+		}
+		entries = append(entries, SnapshotEntry{key, value})
+	}
+	return entries, i >= len(s.keys), nil
+}
+
+func (r *Replica) preserveForSnapshots(writes []storeOp) {
+	for _, s := range r.snapshots {
+		for _, w := range writes {
+			s.preserve(r.committedStore, w.key)
+		}
+	}
+}
+
+func (r *Replica) endSnapshot(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s, ok := r.snapshots[id]; ok {
+		s.timer.Stop()
+		delete(r.snapshots, id)
+	}
+}
+
+// backup snapshots every shard and writes them to backupPath, on this master's machine
+func (m *Master) backup(backupPath string) (manifest backupManifest, err error) {
+	if len(m.cluster.Masters) > 0 {
+		return manifest, errors.New("A backup can only pause the commits of its own master, and this cluster has several.")
+	}
+
+	snapshotId := m.node.Id + "-backup-" + uniuri.New()
+	manifest = backupManifest{backupVersion, time.Now().UTC(), m.node.Id, nil, ""}
+	var readers []int
+	err = m.commits.pause(backupPauseTimeout)
+	if err != nil {
+		return
+	}
+	for _, shard := range m.cluster.Shards {
+		var i int
+		i, err = m.beginSnapshot(snapshotId, shard)
+		if err != nil {
+			break
+		}
+		readers = append(readers, i)
+	}
+	m.commits.resume()
+	defer func() {
+		for _, i := range readers {
+			m.replicas[i].EndSnapshot(snapshotId)
+		}
+	}()
+	if err != nil {
+		return
+	}
+
+	data := make([][]byte, len(readers))
+	for n, i := range readers {
+		var keys int
+		data[n], keys, err = readSnapshot(m.replicas[i], snapshotId)
+		if err != nil {
+			return
+		}
+		file := fmt.Sprint("shards/", n, ".data")
+		manifest.Shards = append(manifest.Shards, backupShard{m.cluster.Shards[n].Id, m.cluster.Replicas[i].Id, file, keys, crc32.ChecksumIEEE(data[n])})
+	}
+
+	err = writeBackup(backupPath, manifest, data)
+	if err == nil {
+		logInfo("Wrote backup", "path", backupPath, "replicas", readers)
+	}
+	return
+}
+
+// beginSnapshot starts the snapshot on the first replica of the shard that can take it
+func (m *Master) beginSnapshot(snapshotId string, shard ShardConfig) (int, error) {
+	for _, i := range shard.replicaIndexes {
+		success, err := m.replicas[i].BeginSnapshot(snapshotId)
+		if err == nil && *success {
+			return i, nil
+		}
+	}
+	return -1, errors.New(fmt.Sprint("No replica of shard ", shard.Id, " could start a snapshot."))
+}
+
+func readSnapshot(replica *ReplicaClient, snapshotId string) (data []byte, keys int, err error) {
+	for offset := 0; ; {
+		result, err := replica.ReadSnapshot(snapshotId, offset, snapshotPageSize)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, e := range result.Entries {
+			data = appendBackupEntry(data, e.Key, e.Value)
+		}
+		offset += len(result.Entries)
+		if result.Done {
+			return data, offset, nil
+		}
+	}
+}
+
+func appendBackupEntry(data []byte, key string, value []byte) []byte {
+	var n [binary.MaxVarintLen64]byte
+	data = append(data, n[:binary.PutUvarint(n[:], uint64(len(key)))]...)
+	data = append(data, key...)
+	data = append(data, n[:binary.PutUvarint(n[:], uint64(len(value)))]...)
+	return append(data, value...)
+}
+
+func decodeBackupEntries(data []byte) (entries []SnapshotEntry, err error) {
+	field := func() ([]byte, bool) {
+		size, n := binary.Uvarint(data)
+		if n <= 0 || uint64(len(data)-n) < size {
+			return nil, false
+		}
+		f := data[n : n+int(size)]
+		data = data[n+int(size):]
+		return f, true
+	}
+	for len(data) > 0 {
+		key, ok := field()
+		if !ok {
+			return nil, errors.New("Backup shard file is cut short.")
+		}
+		value, ok := field()
+		if !ok {
+			return nil, errors.New("Backup shard file is cut short.")
+		}
+		entries = append(entries, SnapshotEntry{string(key), value})
+	}
+	return
+}
+
+// writeBackup writes the backup beside backupPath and renames it into place once it's synced
+func writeBackup(backupPath string, manifest backupManifest, data [][]byte) (err error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	add := func(name string, contents []byte) error {
+		err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(contents)), ModTime: manifest.CreatedAt})
+		if err != nil {
+			return err
+		}
+		_, err = tw.Write(contents)
+		return err
+	}
+
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return
+	}
+	err = add(backupManifestName, manifestData)
+	for i, shard := range manifest.Shards {
+		if err != nil {
+			return
+		}
+		err = add(shard.File, data[i])
+	}
+	if err != nil {
+		return
+	}
+	err = tw.Close()
+	if err != nil {
+		return
+	}
+	err = gz.Close()
+	if err != nil {
+		return
+	}
+
+	temp := backupPath + ".tmp"
+	err = writeFileSync(temp, buf.Bytes())
+	if err != nil {
+		return
+	}
+	err = os.Rename(temp, backupPath)
+	if err != nil {
+		return
+	}
+	return syncDir(path.Dir(backupPath))
+}
+
+// readBackup reads a backup's manifest and checks that every shard file it lists is intact
+func readBackup(backupPath string) (manifest backupManifest, shards [][]SnapshotEntry, err error) {
+	f, err := os.Open(backupPath)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return
+	}
+	tr := tar.NewReader(gz)
+	files := make(map[string][]byte)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return manifest, nil, err
+		}
+		files[header.Name], err = ioutil.ReadAll(tr)
+		if err != nil {
+			return manifest, nil, err
+		}
+	}
+
+	manifestData, ok := files[backupManifestName]
+	if !ok {
+		return manifest, nil, errors.New(fmt.Sprint("Backup ", backupPath, " has no manifest"))
+	}
+	err = json.Unmarshal(manifestData, &manifest)
+	if err != nil {
+		return
+	}
+	if manifest.Version > backupVersion {
+		return manifest, nil, errors.New(fmt.Sprint("Backup ", backupPath, " has version ", manifest.Version, ", newer than this build reads"))
+	}
+	for _, shard := range manifest.Shards {
+		data, ok := files[shard.File]
+		if !ok || crc32.ChecksumIEEE(data) != shard.Crc32 {
+			return manifest, nil, errors.New(fmt.Sprint("Backup ", backupPath, " has a missing or corrupt file for shard ", shard.Id))
+		}
+		entries, err := decodeBackupEntries(data)
+		if err != nil {
+			return manifest, nil, err
+		}
+		if len(entries) != shard.Keys {
+			return manifest, nil, errors.New(fmt.Sprint("Backup ", backupPath, " has ", len(entries), " keys for shard ", shard.Id, " instead of ", shard.Keys))
+		}
+		shards = append(shards, entries)
+	}
+	return
+}
+
+// restoreBackup seeds a fresh cluster from a backup. Keys go to the shards that own them in this
+// cluster, which needn't be laid out like the one backed up. Every node gets an empty log, so there
+// is nothing to recover and a second restore is refused.
+func restoreBackup(cluster *ClusterConfig, backupPath string) (keys int, err error) {
+	manifest, shards, err := readBackup(backupPath)
+	if err != nil {
+		return
+	}
+
+	nodes := append(cluster.coordinators(), cluster.Replicas...)
+	for _, n := range nodes {
+		seqs, err := listSegments(path.Dir(n.LogPath), n.LogPath)
+		if err != nil {
+			return 0, err
+		}
+		if _, statErr := os.Stat(n.LogPath); len(seqs) > 0 || statErr == nil {
+			return 0, errors.New(fmt.Sprint("Node ", n.Id, " already has a log, only a fresh cluster can be restored"))
+		}
+	}
+	for _, n := range cluster.Replicas {
+		if n.StorageEngine == MemoryStorage {
+			return 0, errors.New(fmt.Sprint("Replica ", n.Id, " keeps its data in memory, so it can't be restored"))
+		}
+		if _, statErr := os.Stat(path.Join(n.DataDir, "committed")); statErr == nil {
+			return 0, errors.New(fmt.Sprint("Replica ", n.Id, " already has data, only a fresh cluster can be restored"))
+		}
+	}
+
+	writes := make([][]storeOp, len(cluster.Replicas))
+	for _, entries := range shards {
+		for _, e := range entries {
+			// Checked before anything is written, as a half-restored cluster can't be restored again
+			shard := cluster.shardFor(e.Key)
+			if len(shard.replicaIndexes) == 0 {
+				return 0, errors.New(fmt.Sprint("Shard ", shard.Id, " has no replicas to restore ", e.Key, " to"))
+			}
+			for _, i := range shard.replicaIndexes {
+				writes[i] = append(writes[i], storeOp{PutOp, e.Key, e.Value})
+			}
+			keys++
+		}
+	}
+	for i, n := range cluster.Replicas {
+		closeStore(newStorageEngine(n.StorageEngine, path.Join(n.DataDir, "temp")))
+		store := newStorageEngine(n.StorageEngine, path.Join(n.DataDir, "committed"))
+		if len(writes[i]) > 0 {
+			err = store.batch(writes[i])
+		}
+		closeStore(store)
+		if err != nil {
+			return
+		}
+	}
+	for _, n := range nodes {
+		newLogger(n.LogPath, n.LogFormat, n.logDurability())
+	}
+	log.Println("Restored", keys, "keys backed up by", manifest.Master, "at", manifest.CreatedAt.Format(time.RFC3339))
+	return
+}
+
+// backupCommand implements "backup", asking the cluster's master to write a backup to the path
+// given, on the master's machine
+func backupCommand(args []string) {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	configPath := flags.StringP("config", "c", "", "cluster config file (JSON) whose master to ask")
+	replicaCount := flags.IntP("replicaCount", "n", 0, "replica count, required without a cluster config")
+	flags.Parse(args)
+	if len(flags.Args()) != 1 {
+		log.Fatalln("Usage: backup [-c cluster.json] <backup file>")
+	}
+
+	cluster := loadCommandCluster(*configPath, *replicaCount)
+	result, err := NewMasterClient(cluster.Master.Address).Backup(flags.Args()[0])
+	if err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Println("Backed up", result.Keys, "keys from", result.Shards, "shards to", flags.Args()[0])
+}
+
+// restoreCommand implements "restore", which seeds the stopped, fresh cluster from a backup file
+func restoreCommand(args []string) {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	configPath := flags.StringP("config", "c", "", "cluster config file (JSON) to restore into")
+	replicaCount := flags.IntP("replicaCount", "n", 0, "replica count, required without a cluster config")
+	flags.Parse(args)
+	if len(flags.Args()) != 1 {
+		log.Fatalln("Usage: restore [-c cluster.json] <backup file>")
+	}
+
+	cluster := loadCommandCluster(*configPath, *replicaCount)
+	_, err := restoreBackup(cluster, flags.Args()[0])
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
@@ -0,0 +1,159 @@
+// +build !goci
+package main
+
+import (
+	"hash/crc32"
+	. "launchpad.net/gocheck"
+	"os"
+	"time"
+)
+
+type BackupSuite struct{}
+
+var _ = Suite(&BackupSuite{})
+
+func (s *BackupSuite) TearDownTest(c *C) {
+	os.Remove(testClusterPath)
+	os.RemoveAll("./test.backup")
+}
+
+func (s *BackupSuite) TestPauseWaitsForCommitsBeingApplied(c *C) {
+	g := newCommitGate()
+	g.enter()
+	paused := make(chan error)
+	go func() {
+		paused <- g.pause(time.Second)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	g.leave()
+	c.Assert(<-paused, IsNil)
+
+	entered := make(chan bool)
+	go func() {
+		g.enter()
+		entered <- true
+	}()
+	select {
+	case <-entered:
+		c.Fatal("Commit went ahead during a pause")
+	case <-time.After(10 * time.Millisecond):
+	}
+	g.resume()
+	<-entered
+	g.leave()
+}
+
+func (s *BackupSuite) TestPauseGivesUpOnStuckCommits(c *C) {
+	g := newCommitGate()
+	g.enter()
+	c.Assert(g.pause(10*time.Millisecond), ErrorMatches, "Gave up waiting for 1 commits to finish.")
+	g.enter()
+	g.leave()
+	g.leave()
+}
+
+func commitOps(c *C, r *Replica, txId string, ops ...TxOp) {
+	var reply ReplicaActionResult
+	c.Assert(r.TryTx(&TxArgs{txId, ops, []int{r.num}, "m", "localhost:1", ReplicaDontDie}, &reply), IsNil)
+	c.Assert(reply.Success, Equals, true)
+	c.Assert(r.Commit(&CommitArgs{txId, ReplicaDontDie}, &reply), IsNil)
+}
+
+func readWholeSnapshot(c *C, r *Replica, id string) map[string]string {
+	values := make(map[string]string)
+	for offset := 0; ; {
+		var result ReadSnapshotResult
+		c.Assert(r.ReadSnapshot(&ReadSnapshotArgs{id, offset, 2}, &result), IsNil)
+		for _, e := range result.Entries {
+			values[e.Key] = string(e.Value)
+		}
+		offset += len(result.Entries)
+		if result.Done {
+			return values
+		}
+	}
+}
+
+func (s *BackupSuite) TestSnapshotKeepsReadingAsOfItsStart(c *C) {
+	r := NewReplica(twoReplicaTestCluster(c, "test.backup", true), 0)
+	commitOps(c, r, "tx1", TxOp{PutOp, "a", []byte("1"), "", ""}, TxOp{PutOp, "b", []byte("2"), "", ""}, TxOp{PutOp, "c", []byte("3"), "", ""})
+
+	var reply ReplicaActionResult
+	c.Assert(r.BeginSnapshot(&ReplicaSnapshotArgs{"snap"}, &reply), IsNil)
+	commitOps(c, r, "tx2", TxOp{PutOp, "a", []byte("changed"), "", ""}, TxOp{DelOp, "b", nil, "", ""}, TxOp{PutOp, "d", []byte("new"), "", ""})
+
+	expected := map[string]string{"a": "1", "b": "2", "c": "3"}
+	for key, value := range readWholeSnapshot(c, r, "snap") {
+		stored, _ := decodeValue([]byte(value))
+		c.Assert(string(stored), Equals, expected[key])
+		delete(expected, key)
+	}
+	c.Assert(expected, HasLen, 0)
+
+	c.Assert(r.EndSnapshot(&ReplicaSnapshotArgs{"snap"}, &reply), IsNil)
+	var result ReadSnapshotResult
+	c.Assert(r.ReadSnapshot(&ReadSnapshotArgs{"snap", 0, 2}, &result), ErrorMatches, "Unknown snapshot: snap")
+}
+
+func (s *BackupSuite) TestRestoreIntoAClusterWithOtherShards(c *C) {
+	var shard []byte
+	shard = appendBackupEntry(shard, "apple", encodeValue([]byte("red"), "text/plain"))
+	shard = appendBackupEntry(shard, "zebra", encodeValue([]byte("striped"), ""))
+	manifest := backupManifest{backupVersion, time.Now().UTC(), "m", []backupShard{{"all", "a", "shards/0.data", 2, crc32.ChecksumIEEE(shard)}}, ""}
+	c.Assert(os.MkdirAll("./test.backup", 0777), IsNil)
+	c.Assert(writeBackup("./test.backup/backup.tar.gz", manifest, [][]byte{shard}), IsNil)
+
+	cluster := twoReplicaTestCluster(c, "test.backup", true)
+	keys, err := restoreBackup(cluster, "./test.backup/backup.tar.gz")
+	c.Assert(err, IsNil)
+	c.Assert(keys, Equals, 2)
+
+	low := newStorageEngine(FileStorage, "test.backup/data/a/committed")
+	value, contentType := decodeValue(mustGet(c, low, "apple"))
+	c.Assert(string(value), Equals, "red")
+	c.Assert(contentType, Equals, "text/plain")
+	_, err = low.get("zebra")
+	c.Assert(err, NotNil)
+	high := newStorageEngine(FileStorage, "test.backup/data/b/committed")
+	value, _ = decodeValue(mustGet(c, high, "zebra"))
+	c.Assert(string(value), Equals, "striped")
+
+	_, err = restoreBackup(cluster, "./test.backup/backup.tar.gz")
+	c.Assert(err, ErrorMatches, "Node m already has a log, only a fresh cluster can be restored")
+}
+
+func (s *BackupSuite) TestCorruptBackupIsRejected(c *C) {
+	shard := appendBackupEntry(nil, "apple", []byte("red"))
+	manifest := backupManifest{backupVersion, time.Now().UTC(), "m", []backupShard{{"all", "a", "shards/0.data", 1, crc32.ChecksumIEEE(shard) + 1}}, ""}
+	c.Assert(os.MkdirAll("./test.backup", 0777), IsNil)
+	c.Assert(writeBackup("./test.backup/backup.tar.gz", manifest, [][]byte{shard}), IsNil)
+
+	_, err := restoreBackup(twoReplicaTestCluster(c, "test.backup", true), "./test.backup/backup.tar.gz")
+	c.Assert(err, ErrorMatches, "Backup ./test.backup/backup.tar.gz has a missing or corrupt file for shard all")
+	_, err = os.Stat("test.backup/data/a/committed")
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (s *BackupSuite) TestRestoreIsRefusedWhenAShardHasNoReplicas(c *C) {
+	shard := appendBackupEntry(nil, "zebra", []byte("striped"))
+	manifest := backupManifest{backupVersion, time.Now().UTC(), "m", []backupShard{{"all", "a", "shards/0.data", 1, crc32.ChecksumIEEE(shard)}}, ""}
+	c.Assert(os.MkdirAll("./test.backup", 0777), IsNil)
+	c.Assert(writeBackup("./test.backup/backup.tar.gz", manifest, [][]byte{shard}), IsNil)
+
+	cluster := twoReplicaTestCluster(c, "test.backup", true)
+	cluster.Shards[1].replicaIndexes = nil
+	_, err := restoreBackup(cluster, "./test.backup/backup.tar.gz")
+	c.Assert(err, ErrorMatches, "Shard high has no replicas to restore zebra to")
+	// Nothing was written, so the cluster can still be restored
+	_, err = os.Stat(cluster.Master.LogPath)
+	c.Assert(os.IsNotExist(err), Equals, true)
+	keys, err := restoreBackup(twoReplicaTestCluster(c, "test.backup", true), "./test.backup/backup.tar.gz")
+	c.Assert(err, IsNil)
+	c.Assert(keys, Equals, 1)
+}
+
+func mustGet(c *C, store storageEngine, key string) []byte {
+	value, err := store.get(key)
+	c.Assert(err, IsNil)
+	return value
+}
@@ -0,0 +1,718 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bitcaskStore is a log-structured engine in the style of Bitcask. Every write is appended to the
+// active data file and the in-memory index maps each key to its latest record, so a get is one read.
+// Once the active file is big enough a new one is started, and merging rewrites the older files into
+// one that only holds live records, along with a hint file that lets startup load the index without
+// reading the values.
+//
+// A data record is a CRC32 of the rest of the record, a flags byte, the key and value lengths, the
+// key and the value. The records of a batch all have bitcaskBatchContinues set except the last, so a
+// batch torn by a crash is dropped as a whole.
+const (
+	bitcaskDataSuffix        = ".data"
+	bitcaskHintSuffix        = ".hint"
+	bitcaskMergeSuffix       = ".merge"
+	bitcaskHeaderSize        = 13
+	bitcaskHintHeaderSize    = 21
+	bitcaskMaxRecordSize     = 1 << 30
+	bitcaskMaxFileSize       = 64 << 20
+	bitcaskMergeInterval     = time.Minute
+	bitcaskMergeMinDeadBytes = 16 << 20
+)
+
+const (
+	bitcaskTombstone      = 1
+	bitcaskBatchContinues = 2
+)
+
+var errBitcaskChecksum = errors.New("Bitcask record checksum mismatch")
+
+type bitcaskEntry struct {
+	fileId int
+	offset int64
+	size   int64
+}
+
+type bitcaskRecord struct {
+	flags byte
+	key   string
+	value []byte
+	size  int64
+}
+
+type bitcaskStore struct {
+	basePath    string
+	index       map[string]bitcaskEntry
+	files       map[int]*os.File
+	activeId    int
+	activeSize  int64
+	maxFileSize int64
+	totalBytes  int64
+	deadBytes   int64
+	mu          sync.RWMutex
+	mergeMu     sync.Mutex
+	closed      chan bool
+	// A store opened read-only leaves its files as they are, and lists in damage what opening it
+	// would otherwise have tidied up after a crash
+	readOnly bool
+	damage   []string
+}
+
+func newBitcaskStore(dbPath string) *bitcaskStore {
+	err := os.MkdirAll(dbPath, 0777)
+	if err != nil {
+		logFatal("Unable to open bitcask store", "path", dbPath, "error", err)
+	}
+	s := &bitcaskStore{
+		dbPath,
+		make(map[string]bitcaskEntry),
+		make(map[int]*os.File),
+		0,
+		0,
+		bitcaskMaxFileSize,
+		0,
+		0,
+		sync.RWMutex{},
+		sync.Mutex{},
+		make(chan bool),
+		false,
+		nil}
+	err = s.open()
+	if err != nil {
+		logFatal("Unable to open bitcask store", "path", dbPath, "error", err)
+	}
+	go s.mergeLoop()
+	return s
+}
+
+// openBitcaskStoreReadOnly loads a store's index for reading without changing any of its files, and
+// returns what a crash left behind that newBitcaskStore would tidy up
+func openBitcaskStoreReadOnly(dbPath string) (s *bitcaskStore, damage []string, err error) {
+	s = &bitcaskStore{dbPath, make(map[string]bitcaskEntry), make(map[int]*os.File), 0, 0, bitcaskMaxFileSize, 0, 0,
+		sync.RWMutex{}, sync.Mutex{}, make(chan bool), true, nil}
+	err = s.open()
+	if err != nil {
+		s.close()
+		return nil, nil, err
+	}
+	return s, s.damage, nil
+}
+
+func (s *bitcaskStore) dataPath(id int) string {
+	return path.Join(s.basePath, fmt.Sprintf("%09d%v", id, bitcaskDataSuffix))
+}
+
+func (s *bitcaskStore) hintPath(id int) string {
+	return path.Join(s.basePath, fmt.Sprintf("%09d%v", id, bitcaskHintSuffix))
+}
+
+func encodeBitcaskRecord(flags byte, key string, value []byte) []byte {
+	record := make([]byte, bitcaskHeaderSize+len(key)+len(value))
+	record[4] = flags
+	binary.BigEndian.PutUint32(record[5:9], uint32(len(key)))
+	binary.BigEndian.PutUint32(record[9:13], uint32(len(value)))
+	copy(record[bitcaskHeaderSize:], key)
+	copy(record[bitcaskHeaderSize+len(key):], value)
+	binary.BigEndian.PutUint32(record[0:4], crc32.ChecksumIEEE(record[4:]))
+	return record
+}
+
+// readBitcaskRecord returns io.EOF only at a clean end of the file, and io.ErrUnexpectedEOF for a
+// record that was cut short
+func readBitcaskRecord(r io.Reader) (rec bitcaskRecord, err error) {
+	header := make([]byte, bitcaskHeaderSize)
+	n, err := io.ReadFull(r, header)
+	if n == 0 && err == io.EOF {
+		return rec, io.EOF
+	}
+	if err != nil {
+		return rec, io.ErrUnexpectedEOF
+	}
+	keyLen := int64(binary.BigEndian.Uint32(header[5:9]))
+	valueLen := int64(binary.BigEndian.Uint32(header[9:13]))
+	if keyLen+valueLen > bitcaskMaxRecordSize {
+		return rec, errBitcaskChecksum
+	}
+	body := make([]byte, keyLen+valueLen)
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return rec, io.ErrUnexpectedEOF
+	}
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(body)
+	if crc.Sum32() != binary.BigEndian.Uint32(header[0:4]) {
+		return rec, errBitcaskChecksum
+	}
+	return bitcaskRecord{header[4], string(body[:keyLen]), body[keyLen:], bitcaskHeaderSize + keyLen + valueLen}, nil
+}
+
+func (s *bitcaskStore) dataFileIds() (ids []int, err error) {
+	files, err := ioutil.ReadDir(s.basePath)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		name := file.Name()
+		if strings.HasSuffix(name, bitcaskMergeSuffix) {
+			// Left over from a merge that never finished, the files it was merging are all still here
+			if s.readOnly {
+				s.damage = append(s.damage, fmt.Sprint("unfinished merge ", path.Join(s.basePath, name)))
+				continue
+			}
+			err = os.Remove(path.Join(s.basePath, name))
+			if err != nil {
+				return
+			}
+			continue
+		}
+		if !strings.HasSuffix(name, bitcaskDataSuffix) {
+			continue
+		}
+		id, err := strconv.Atoi(strings.TrimSuffix(name, bitcaskDataSuffix))
+		if err != nil {
+			return nil, errors.New(fmt.Sprint("Unexpected data file in bitcask store: ", name))
+		}
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return
+}
+
+// open loads the index from the data files, oldest first so that later records win. The newest
+// file becomes the active one again, after cutting off any write that a crash left unfinished.
+func (s *bitcaskStore) open() (err error) {
+	ids, err := s.dataFileIds()
+	if err != nil {
+		return
+	}
+	if len(ids) == 0 {
+		if s.readOnly {
+			return nil
+		}
+		return s.startActiveFile(1)
+	}
+
+	flags := os.O_RDWR
+	if s.readOnly {
+		flags = os.O_RDONLY
+	}
+	for i, id := range ids {
+		f, err := os.OpenFile(s.dataPath(id), flags, 0)
+		if err != nil {
+			return err
+		}
+		s.files[id] = f
+		last := i == len(ids)-1
+		if !last && s.loadHint(id) == nil {
+			continue
+		}
+		err = s.loadDataFile(id, f, last)
+		if err != nil {
+			return err
+		}
+	}
+
+	s.activeId = ids[len(ids)-1]
+	s.activeSize, err = s.files[s.activeId].Seek(0, io.SeekEnd)
+	if err != nil {
+		return
+	}
+	return s.updateSizes()
+}
+
+func (s *bitcaskStore) applyToIndex(key string, flags byte, entry bitcaskEntry) {
+	if flags&bitcaskTombstone != 0 {
+		delete(s.index, key)
+	} else {
+		s.index[key] = entry
+	}
+}
+
+func (s *bitcaskStore) loadDataFile(id int, f *os.File, last bool) (err error) {
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return
+	}
+	r := bufio.NewReader(f)
+
+	type pendingRecord struct {
+		rec   bitcaskRecord
+		entry bitcaskEntry
+	}
+	var pending []pendingRecord
+	offset := int64(0)
+	batchStart := int64(0)
+	for {
+		rec, err := readBitcaskRecord(r)
+		if err == io.EOF && len(pending) == 0 {
+			return nil
+		}
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			if !last {
+				return errors.New(fmt.Sprint("Corrupt record in ", s.dataPath(id), " at offset ", offset, ": ", err))
+			}
+			if s.readOnly {
+				s.damage = append(s.damage, fmt.Sprint("unfinished write in ", s.dataPath(id), " at offset ", batchStart, ": ", err))
+				return nil
+			}
+			logWarn("Truncating unfinished write", "path", s.dataPath(id), "offset", batchStart, "error", err)
+			return f.Truncate(batchStart)
+		}
+
+		pending = append(pending, pendingRecord{rec, bitcaskEntry{id, offset, rec.size}})
+		offset += rec.size
+		if rec.flags&bitcaskBatchContinues == 0 {
+			for _, p := range pending {
+				s.applyToIndex(p.rec.key, p.rec.flags, p.entry)
+			}
+			pending = nil
+			batchStart = offset
+		}
+	}
+}
+
+// A hint file lists the flags, key length, offset, size and key of every record in a merged data
+// file, followed by a CRC32 of everything before it
+func (s *bitcaskStore) loadHint(id int) (err error) {
+	hint, err := ioutil.ReadFile(s.hintPath(id))
+	if err != nil {
+		return
+	}
+	if len(hint) < 4 || crc32.ChecksumIEEE(hint[:len(hint)-4]) != binary.BigEndian.Uint32(hint[len(hint)-4:]) {
+		logWarn("Ignoring damaged hint file", "path", s.hintPath(id))
+		return errBitcaskChecksum
+	}
+
+	entries := make(map[string]bitcaskEntry)
+	flags := make(map[string]byte)
+	hint = hint[:len(hint)-4]
+	for len(hint) > 0 {
+		if len(hint) < bitcaskHintHeaderSize {
+			return errBitcaskChecksum
+		}
+		keyLen := int(binary.BigEndian.Uint32(hint[1:5]))
+		if len(hint) < bitcaskHintHeaderSize+keyLen {
+			return errBitcaskChecksum
+		}
+		key := string(hint[bitcaskHintHeaderSize : bitcaskHintHeaderSize+keyLen])
+		offset := int64(binary.BigEndian.Uint64(hint[5:13]))
+		size := int64(binary.BigEndian.Uint64(hint[13:21]))
+		entries[key] = bitcaskEntry{id, offset, size}
+		flags[key] = hint[0]
+		hint = hint[bitcaskHintHeaderSize+keyLen:]
+	}
+
+	// Only touch the index once the whole hint file has been read
+	for key, entry := range entries {
+		s.applyToIndex(key, flags[key], entry)
+	}
+	return nil
+}
+
+func appendHintEntry(hint []byte, flags byte, key string, entry bitcaskEntry) []byte {
+	header := make([]byte, bitcaskHintHeaderSize)
+	header[0] = flags
+	binary.BigEndian.PutUint32(header[1:5], uint32(len(key)))
+	binary.BigEndian.PutUint64(header[5:13], uint64(entry.offset))
+	binary.BigEndian.PutUint64(header[13:21], uint64(entry.size))
+	hint = append(hint, header...)
+	return append(hint, key...)
+}
+
+// updateSizes recounts how many bytes the data files hold, and how many of them are garbage
+func (s *bitcaskStore) updateSizes() (err error) {
+	s.totalBytes = 0
+	for id, f := range s.files {
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		if id == s.activeId {
+			s.totalBytes += s.activeSize
+		} else {
+			s.totalBytes += info.Size()
+		}
+	}
+	live := int64(0)
+	for _, entry := range s.index {
+		live += entry.size
+	}
+	s.deadBytes = s.totalBytes - live
+	return nil
+}
+
+func (s *bitcaskStore) startActiveFile(id int) (err error) {
+	f, err := os.OpenFile(s.dataPath(id), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0777)
+	if err != nil {
+		return
+	}
+	err = syncDir(s.basePath)
+	if err != nil {
+		f.Close()
+		return
+	}
+	s.files[id] = f
+	s.activeId = id
+	s.activeSize = 0
+	return nil
+}
+
+func (s *bitcaskStore) get(key string) (value []byte, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	entry, ok := s.index[key]
+	if !ok {
+		return nil, errors.New(fmt.Sprint("Key not found: ", key))
+	}
+	record := make([]byte, entry.size)
+	_, err = s.files[entry.fileId].ReadAt(record, entry.offset)
+	if err != nil {
+		return
+	}
+	rec, err := readBitcaskRecord(bytes.NewReader(record))
+	if err != nil {
+		return nil, errors.New(fmt.Sprint("Bad record for key ", key, " in ", s.dataPath(entry.fileId), " at offset ", entry.offset, ": ", err))
+	}
+	return rec.value, nil
+}
+
+func (s *bitcaskStore) put(key string, value []byte) error {
+	return s.batch([]storeOp{{PutOp, key, value}})
+}
+
+func (s *bitcaskStore) del(key string) error {
+	s.mu.RLock()
+	_, ok := s.index[key]
+	s.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+	return s.batch([]storeOp{{DelOp, key, nil}})
+}
+
+func (s *bitcaskStore) list() (keys []string, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys = make([]string, 0, len(s.index))
+	for key := range s.index {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (s *bitcaskStore) iterate(f func(key string, value []byte) error) (err error) {
+	keys, err := s.list()
+	if err != nil {
+		return
+	}
+	for _, key := range keys {
+		s.mu.RLock()
+		_, ok := s.index[key]
+		s.mu.RUnlock()
+		if !ok {
+			// Deleted since we listed it
+			continue
+		}
+		value, err := s.get(key)
+		if err != nil {
+			return err
+		}
+		err = f(key, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// batch appends all the ops with one write and one fsync. If a crash cuts the write short, open
+// drops the whole batch.
+func (s *bitcaskStore) batch(ops []storeOp) (err error) {
+	if len(ops) == 0 {
+		return nil
+	}
+	for _, op := range ops {
+		if op.op != PutOp && op.op != DelOp {
+			return errors.New(fmt.Sprint("Unsupported op in batch: ", op.op.String()))
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.activeSize >= s.maxFileSize {
+		err = s.startActiveFile(s.activeId + 1)
+		if err != nil {
+			return
+		}
+	}
+
+	var buf bytes.Buffer
+	entries := make([]bitcaskEntry, len(ops))
+	flags := make([]byte, len(ops))
+	for i, op := range ops {
+		if op.op == DelOp {
+			flags[i] |= bitcaskTombstone
+		}
+		if i < len(ops)-1 {
+			flags[i] |= bitcaskBatchContinues
+		}
+		record := encodeBitcaskRecord(flags[i], op.key, op.value)
+		entries[i] = bitcaskEntry{s.activeId, s.activeSize + int64(buf.Len()), int64(len(record))}
+		buf.Write(record)
+	}
+
+	active := s.files[s.activeId]
+	_, err = active.WriteAt(buf.Bytes(), s.activeSize)
+	if err == nil {
+		err = active.Sync()
+	}
+	if err != nil {
+		// Don't leave a partial batch in front of the next write
+		active.Truncate(s.activeSize)
+		return
+	}
+
+	s.activeSize += int64(buf.Len())
+	s.totalBytes += int64(buf.Len())
+	for i, op := range ops {
+		if old, ok := s.index[op.key]; ok {
+			s.deadBytes += old.size
+		}
+		if op.op == DelOp {
+			s.deadBytes += entries[i].size
+		}
+		s.applyToIndex(op.key, flags[i], entries[i])
+	}
+	return nil
+}
+
+// merge rewrites every data file but the active one into a single file holding only the latest
+// record for each key, and writes its hint file. Tombstones are only kept while they still hide an
+// older record in one of the merged files; that way a crash before all of the merged files are
+// removed can't bring a deleted key back. The merged file takes the id of the newest file it
+// replaces, so it still sorts before the active file.
+func (s *bitcaskStore) merge() (err error) {
+	s.mergeMu.Lock()
+	defer s.mergeMu.Unlock()
+
+	s.mu.Lock()
+	if s.activeSize > 0 {
+		err = s.startActiveFile(s.activeId + 1)
+		if err != nil {
+			s.mu.Unlock()
+			return
+		}
+	}
+	var inputs []int
+	inputFiles := make(map[int]*os.File)
+	for id, f := range s.files {
+		if id != s.activeId {
+			inputs = append(inputs, id)
+			inputFiles[id] = f
+		}
+	}
+	s.mu.Unlock()
+	if len(inputs) == 0 {
+		return nil
+	}
+	sort.Ints(inputs)
+
+	// Only merge touches files other than the active one, so they can be read without the lock
+	type latestRecord struct {
+		flags   byte
+		entry   bitcaskEntry
+		shadows bool
+	}
+	latest := make(map[string]*latestRecord)
+	for _, id := range inputs {
+		info, err := inputFiles[id].Stat()
+		if err != nil {
+			return err
+		}
+		r := bufio.NewReader(io.NewSectionReader(inputFiles[id], 0, info.Size()))
+		offset := int64(0)
+		for {
+			rec, err := readBitcaskRecord(r)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return errors.New(fmt.Sprint("Corrupt record in ", s.dataPath(id), " at offset ", offset, ": ", err))
+			}
+			l, ok := latest[rec.key]
+			shadows := ok && (l.shadows || l.flags&bitcaskTombstone == 0)
+			latest[rec.key] = &latestRecord{rec.flags &^ bitcaskBatchContinues, bitcaskEntry{id, offset, rec.size}, shadows}
+			offset += rec.size
+		}
+	}
+
+	keys := make([]string, 0, len(latest))
+	for key := range latest {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	mergedId := inputs[len(inputs)-1]
+	mergedPath := s.dataPath(mergedId) + bitcaskMergeSuffix
+	merged, err := os.OpenFile(mergedPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0777)
+	if err != nil {
+		return
+	}
+	w := bufio.NewWriter(merged)
+	var hint []byte
+	oldEntries := make(map[string]bitcaskEntry)
+	newEntries := make(map[string]bitcaskEntry)
+	offset := int64(0)
+	for _, key := range keys {
+		l := latest[key]
+		var value []byte
+		if l.flags&bitcaskTombstone != 0 {
+			if !l.shadows {
+				continue
+			}
+		} else {
+			record := make([]byte, l.entry.size)
+			_, err = inputFiles[l.entry.fileId].ReadAt(record, l.entry.offset)
+			if err != nil {
+				merged.Close()
+				return
+			}
+			rec, err := readBitcaskRecord(bytes.NewReader(record))
+			if err != nil {
+				merged.Close()
+				return err
+			}
+			value = rec.value
+		}
+		record := encodeBitcaskRecord(l.flags, key, value)
+		entry := bitcaskEntry{mergedId, offset, int64(len(record))}
+		_, err = w.Write(record)
+		if err != nil {
+			merged.Close()
+			return
+		}
+		hint = appendHintEntry(hint, l.flags, key, entry)
+		if l.flags&bitcaskTombstone == 0 {
+			oldEntries[key] = l.entry
+			newEntries[key] = entry
+		}
+		offset += entry.size
+	}
+	err = w.Flush()
+	if err == nil {
+		err = merged.Sync()
+	}
+	if err != nil {
+		merged.Close()
+		return
+	}
+	var crc [4]byte
+	binary.BigEndian.PutUint32(crc[:], crc32.ChecksumIEEE(hint))
+	err = writeFileSync(s.hintPath(mergedId)+bitcaskMergeSuffix, append(hint, crc[:]...))
+	if err != nil {
+		merged.Close()
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The old hint goes first, so a crash never pairs a hint with the wrong data file
+	err = os.Remove(s.hintPath(mergedId))
+	if err != nil && !os.IsNotExist(err) {
+		merged.Close()
+		return
+	}
+	err = os.Rename(mergedPath, s.dataPath(mergedId))
+	if err != nil {
+		merged.Close()
+		return
+	}
+	err = os.Rename(s.hintPath(mergedId)+bitcaskMergeSuffix, s.hintPath(mergedId))
+	if err != nil {
+		merged.Close()
+		return
+	}
+	s.files[mergedId].Close()
+	s.files[mergedId] = merged
+	for key, entry := range newEntries {
+		if current, ok := s.index[key]; ok && current == oldEntries[key] {
+			s.index[key] = entry
+		}
+	}
+
+	// Oldest first, so a tombstone is never removed before the record it hides
+	for _, id := range inputs[:len(inputs)-1] {
+		s.files[id].Close()
+		delete(s.files, id)
+		err = os.Remove(s.dataPath(id))
+		if err != nil {
+			return
+		}
+		os.Remove(s.hintPath(id))
+	}
+	err = syncDir(s.basePath)
+	if err != nil {
+		return
+	}
+	return s.updateSizes()
+}
+
+// mergeLoop merges in the background once at least half of the data on disk is garbage
+func (s *bitcaskStore) mergeLoop() {
+	ticker := time.NewTicker(bitcaskMergeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-ticker.C:
+		}
+		s.mu.RLock()
+		shouldMerge := s.deadBytes >= bitcaskMergeMinDeadBytes && s.deadBytes*2 >= s.totalBytes
+		s.mu.RUnlock()
+		if shouldMerge {
+			err := s.merge()
+			if err != nil {
+				logError("Bitcask merge failed", "path", s.basePath, "error", err)
+			}
+		}
+	}
+}
+
+// close stops background merging and closes the data files
+func (s *bitcaskStore) close() {
+	close(s.closed)
+	s.mergeMu.Lock()
+	defer s.mergeMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, f := range s.files {
+		f.Close()
+		delete(s.files, id)
+	}
+}
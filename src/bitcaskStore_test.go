@@ -0,0 +1,142 @@
+// +build !goci
+package main
+
+import (
+	"fmt"
+	. "launchpad.net/gocheck"
+	"os"
+)
+
+var testBitcaskPath = "./test.bitcask"
+
+type BitcaskSuite struct{}
+
+var _ = Suite(&BitcaskSuite{})
+
+func (s *BitcaskSuite) TearDownTest(c *C) {
+	os.RemoveAll(testBitcaskPath)
+}
+
+func (s *BitcaskSuite) TestReopen(c *C) {
+	store := newBitcaskStore(testBitcaskPath)
+	c.Assert(store.put("kept", []byte("1")), IsNil)
+	c.Assert(store.put("changed", []byte("old")), IsNil)
+	c.Assert(store.put("changed", []byte("new")), IsNil)
+	c.Assert(store.put("deleted", []byte("3")), IsNil)
+	c.Assert(store.del("deleted"), IsNil)
+	store.close()
+
+	store = newBitcaskStore(testBitcaskPath)
+	defer store.close()
+	val, err := store.get("kept")
+	c.Assert(err, IsNil)
+	c.Assert(string(val), Equals, "1")
+	val, err = store.get("changed")
+	c.Assert(err, IsNil)
+	c.Assert(string(val), Equals, "new")
+	_, err = store.get("deleted")
+	c.Assert(err, NotNil)
+}
+
+// appendToActiveFile simulates a crash partway through a write
+func appendToActiveFile(c *C, store *bitcaskStore, data []byte) {
+	f, err := os.OpenFile(store.dataPath(store.activeId), os.O_WRONLY|os.O_APPEND, 0)
+	c.Assert(err, IsNil)
+	_, err = f.Write(data)
+	c.Assert(err, IsNil)
+	f.Close()
+}
+
+func (s *BitcaskSuite) TestTornWriteIsTruncated(c *C) {
+	store := newBitcaskStore(testBitcaskPath)
+	c.Assert(store.put("foo", []byte("bar")), IsNil)
+	size := store.activeSize
+	record := encodeBitcaskRecord(0, "torn", []byte("value"))
+	appendToActiveFile(c, store, record[:len(record)-2])
+	store.close()
+
+	store = newBitcaskStore(testBitcaskPath)
+	defer store.close()
+	c.Assert(store.activeSize, Equals, size)
+	_, err := store.get("torn")
+	c.Assert(err, NotNil)
+	val, err := store.get("foo")
+	c.Assert(err, IsNil)
+	c.Assert(string(val), Equals, "bar")
+
+	c.Assert(store.put("after", []byte("ok")), IsNil)
+	val, err = store.get("after")
+	c.Assert(err, IsNil)
+	c.Assert(string(val), Equals, "ok")
+}
+
+func (s *BitcaskSuite) TestTornBatchIsDropped(c *C) {
+	store := newBitcaskStore(testBitcaskPath)
+	c.Assert(store.put("a", []byte("old")), IsNil)
+	// A complete first record whose batch never got its last one
+	appendToActiveFile(c, store, encodeBitcaskRecord(bitcaskBatchContinues, "a", []byte("new")))
+	store.close()
+
+	store = newBitcaskStore(testBitcaskPath)
+	defer store.close()
+	val, err := store.get("a")
+	c.Assert(err, IsNil)
+	c.Assert(string(val), Equals, "old")
+}
+
+func (s *BitcaskSuite) TestMergeReclaimsSpace(c *C) {
+	store := newBitcaskStore(testBitcaskPath)
+	store.maxFileSize = 256
+	for round := 0; round < 10; round++ {
+		for i := 0; i < 10; i++ {
+			c.Assert(store.put(fmt.Sprint("key", i), []byte(fmt.Sprint("round", round))), IsNil)
+		}
+	}
+	c.Assert(store.del("key0"), IsNil)
+	c.Assert(len(store.files) > 2, Equals, true)
+	before := store.totalBytes
+
+	c.Assert(store.merge(), IsNil)
+	c.Assert(store.files, HasLen, 2)
+	c.Assert(store.totalBytes < before, Equals, true)
+	// The tombstone for key0 outlives the first merge, in case it crashed before removing every file
+	c.Assert(store.deadBytes, Equals, int64(len(encodeBitcaskRecord(bitcaskTombstone, "key0", nil))))
+	c.Assert(store.merge(), IsNil)
+	c.Assert(store.deadBytes, Equals, int64(0))
+
+	check := func(store *bitcaskStore) {
+		_, err := store.get("key0")
+		c.Assert(err, NotNil)
+		for i := 1; i < 10; i++ {
+			val, err := store.get(fmt.Sprint("key", i))
+			c.Assert(err, IsNil)
+			c.Assert(string(val), Equals, "round9")
+		}
+	}
+	check(store)
+	store.close()
+
+	// Reopening loads the merged file from its hint file
+	store = newBitcaskStore(testBitcaskPath)
+	defer store.close()
+	_, err := os.Stat(store.hintPath(store.activeId - 1))
+	c.Assert(err, IsNil)
+	check(store)
+}
+
+func (s *BitcaskSuite) TestWritesDuringMergeAreKept(c *C) {
+	store := newBitcaskStore(testBitcaskPath)
+	defer store.close()
+	c.Assert(store.put("a", []byte("1")), IsNil)
+	c.Assert(store.put("b", []byte("1")), IsNil)
+	c.Assert(store.merge(), IsNil)
+	c.Assert(store.put("a", []byte("2")), IsNil)
+	c.Assert(store.del("b"), IsNil)
+	c.Assert(store.merge(), IsNil)
+
+	val, err := store.get("a")
+	c.Assert(err, IsNil)
+	c.Assert(string(val), Equals, "2")
+	_, err = store.get("b")
+	c.Assert(err, NotNil)
+}
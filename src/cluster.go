@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"log"
+	"path"
+	"sort"
+	"time"
+)
+
+const (
+	HashSharding  = "hash"
+	RangeSharding = "range"
+)
+
+// NodeConfig describes one master or replica process. Only Id and Address are required in a cluster
+// file; the paths default to ones derived from the id, StorageEngine to FileStorage, LogFormat to
+// WalLogFormat and Durability to SyncDurability. SyncIntervalMs is how often GroupDurability fsyncs
+// the node's logs. Log segments that recovery no longer needs are moved to ArchiveDir, by default an
+// archive dir next to the log, and gzipped with CompressArchive.
+type NodeConfig struct {
+	Id              string
+	Address         string
+	DataDir         string
+	LogPath         string
+	AcceptorLogPath string
+	StorageEngine   string
+	LogFormat       string
+	Durability      string
+	SyncIntervalMs  int
+	ArchiveDir      string
+	CompressArchive bool
+}
+
+// ShardConfig is a replica group that owns part of the key space. With range sharding a shard owns
+// the keys from its StartKey up to the next shard's StartKey.
+type ShardConfig struct {
+	Id       string
+	Replicas []string
+	StartKey string
+
+	replicaIndexes []int
+}
+
+// ClusterConfig lists every node. Without Shards, all replicas form one group that holds every key.
+// Masters are additional coordinators that run transactions against the same replicas as Master.
+// Subordinates are the masters of other clusters that this master may coordinate, by Id and Address.
+type ClusterConfig struct {
+	Master       NodeConfig
+	Masters      []NodeConfig
+	Replicas     []NodeConfig
+	Sharding     string
+	Shards       []ShardConfig
+	Subordinates []NodeConfig
+}
+
+// DefaultClusterConfig is the single-box cluster used when no config file is given: the master on
+// MasterPort and replicas on consecutive ports after it.
+func DefaultClusterConfig(replicaCount int) *ClusterConfig {
+	c := &ClusterConfig{Master: NodeConfig{Id: "master", Address: MasterPort}}
+	for i := 0; i < replicaCount; i++ {
+		c.Replicas = append(c.Replicas, NodeConfig{Id: fmt.Sprint("replica", i), Address: GetReplicaHost(i)})
+	}
+	c.fillDefaults()
+	c.resolveShards()
+	return c
+}
+
+func LoadClusterConfig(configPath string) (c *ClusterConfig, err error) {
+	bytes, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return
+	}
+	c = &ClusterConfig{}
+	err = json.Unmarshal(bytes, c)
+	if err != nil {
+		return nil, errors.New(fmt.Sprint("Unable to parse cluster config ", configPath, ": ", err))
+	}
+	err = c.validate()
+	if err != nil {
+		return nil, err
+	}
+	c.fillDefaults()
+	err = c.resolveShards()
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// commandCluster is the cluster a subcommand works on: the one in configPath, or else the default
+// one of replicaCount replicas, which there must be some of
+func commandCluster(configPath string, replicaCount int) (*ClusterConfig, error) {
+	if configPath != "" {
+		return LoadClusterConfig(configPath)
+	}
+	if replicaCount <= 0 {
+		return nil, errors.New("Without a cluster config (-c), the replica count (-n) is required.")
+	}
+	return DefaultClusterConfig(replicaCount), nil
+}
+
+// loadCommandCluster is commandCluster for a subcommand that can't go on without it
+func loadCommandCluster(configPath string, replicaCount int) *ClusterConfig {
+	cluster, err := commandCluster(configPath, replicaCount)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return cluster
+}
+
+func (c *ClusterConfig) validate() error {
+	if len(c.Replicas) == 0 {
+		return errors.New("Cluster config must list at least one replica.")
+	}
+	seen := make(map[string]bool)
+	nodes := append(c.coordinators(), c.Replicas...)
+	for _, n := range append(nodes, c.Subordinates...) {
+		if n.Id == "" || n.Address == "" {
+			return errors.New("Every node in the cluster config needs an Id and an Address.")
+		}
+		if seen[n.Id] {
+			return errors.New(fmt.Sprint("Duplicate node id in cluster config: ", n.Id))
+		}
+		seen[n.Id] = true
+		if n.LogFormat != "" {
+			if err := checkLogFormat(n.LogFormat); err != nil {
+				return errors.New(fmt.Sprint("Node ", n.Id, ": ", err))
+			}
+		}
+		if n.Durability != "" {
+			if err := checkDurability(n.Durability); err != nil {
+				return errors.New(fmt.Sprint("Node ", n.Id, ": ", err))
+			}
+		}
+		if n.SyncIntervalMs < 0 {
+			return errors.New(fmt.Sprint("Node ", n.Id, ": SyncIntervalMs can't be negative"))
+		}
+	}
+	for _, n := range c.Replicas {
+		if n.StorageEngine == "" {
+			continue
+		}
+		if err := checkStorageEngine(n.StorageEngine); err != nil {
+			return errors.New(fmt.Sprint("Replica ", n.Id, ": ", err))
+		}
+	}
+	return nil
+}
+
+func (c *ClusterConfig) fillDefaults() {
+	c.Master.fillDefaults()
+	for i := range c.Masters {
+		c.Masters[i].fillDefaults()
+	}
+	for i := range c.Replicas {
+		c.Replicas[i].fillDefaults()
+	}
+	if c.Sharding == "" {
+		c.Sharding = HashSharding
+	}
+	if len(c.Shards) == 0 {
+		all := ShardConfig{Id: "default"}
+		for _, n := range c.Replicas {
+			all.Replicas = append(all.Replicas, n.Id)
+		}
+		c.Shards = []ShardConfig{all}
+	}
+}
+
+// resolveShards checks the shard list and maps each shard's replica ids to replica indexes
+func (c *ClusterConfig) resolveShards() error {
+	if c.Sharding != HashSharding && c.Sharding != RangeSharding {
+		return errors.New(fmt.Sprint("Unknown sharding: ", c.Sharding, ", expected ", HashSharding, " or ", RangeSharding))
+	}
+
+	owner := make(map[int]string)
+	for s := range c.Shards {
+		shard := &c.Shards[s]
+		if len(shard.Replicas) == 0 {
+			return errors.New(fmt.Sprint("Shard ", shard.Id, " has no replicas."))
+		}
+		shard.replicaIndexes = nil
+		for _, id := range shard.Replicas {
+			i, err := c.replicaIndex(id)
+			if err != nil {
+				return err
+			}
+			if other, ok := owner[i]; ok {
+				return errors.New(fmt.Sprint("Replica ", id, " is in both shard ", other, " and shard ", shard.Id))
+			}
+			owner[i] = shard.Id
+			shard.replicaIndexes = append(shard.replicaIndexes, i)
+		}
+	}
+
+	if c.Sharding == RangeSharding {
+		sort.Slice(c.Shards, func(i, j int) bool { return c.Shards[i].StartKey < c.Shards[j].StartKey })
+		if c.Shards[0].StartKey != "" {
+			return errors.New("With range sharding, one shard must have an empty StartKey to own the lowest keys.")
+		}
+	}
+	return nil
+}
+
+// shardFor returns the shard that owns a key
+func (c *ClusterConfig) shardFor(key string) *ShardConfig {
+	if c.Sharding == RangeSharding {
+		i := sort.Search(len(c.Shards), func(i int) bool { return c.Shards[i].StartKey > key })
+		return &c.Shards[i-1]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &c.Shards[h.Sum32()%uint32(len(c.Shards))]
+}
+
+// routeOps splits a transaction's ops by the participants that have to apply them. Participants are
+// replica indexes, followed by subordinate masters numbered from len(Replicas).
+func (c *ClusterConfig) routeOps(ops []TxOp) (opsByReplica map[int][]TxOp, participants []int, err error) {
+	opsByReplica = make(map[int][]TxOp)
+	for _, op := range ops {
+		if op.Cluster != "" && c.coordinatorIndex(op.Cluster) < 0 {
+			i, err := c.subordinateIndex(op.Cluster)
+			if err != nil {
+				return nil, nil, err
+			}
+			// The subordinate routes the op within its own cluster
+			op.Cluster = ""
+			i += len(c.Replicas)
+			opsByReplica[i] = append(opsByReplica[i], op)
+			continue
+		}
+		op.Cluster = ""
+		for _, i := range c.shardFor(op.Key).replicaIndexes {
+			opsByReplica[i] = append(opsByReplica[i], op)
+		}
+	}
+	for i := range opsByReplica {
+		participants = append(participants, i)
+	}
+	sort.Ints(participants)
+	return
+}
+
+func (n *NodeConfig) fillDefaults() {
+	if n.DataDir == "" {
+		n.DataDir = path.Join("data", n.Id)
+	}
+	if n.LogPath == "" {
+		n.LogPath = path.Join("logs", n.Id+".txt")
+	}
+	if n.AcceptorLogPath == "" {
+		n.AcceptorLogPath = path.Join("logs", n.Id+".acceptor.txt")
+	}
+	if n.StorageEngine == "" {
+		n.StorageEngine = FileStorage
+	}
+	if n.LogFormat == "" {
+		n.LogFormat = WalLogFormat
+	}
+	if n.Durability == "" {
+		n.Durability = SyncDurability
+	}
+	if n.ArchiveDir == "" {
+		n.ArchiveDir = path.Join(path.Dir(n.LogPath), "archive")
+	}
+}
+
+func (n *NodeConfig) logDurability() logDurability {
+	return newDurability(n.Durability, time.Duration(n.SyncIntervalMs)*time.Millisecond)
+}
+
+// setLogFormat makes every node use the given log format
+func (c *ClusterConfig) setLogFormat(format string) {
+	c.Master.LogFormat = format
+	for i := range c.Masters {
+		c.Masters[i].LogFormat = format
+	}
+	for i := range c.Replicas {
+		c.Replicas[i].LogFormat = format
+	}
+}
+
+// setDurability makes every node log with the given durability, and an interval of 0 keeps each
+// node's SyncIntervalMs
+func (c *ClusterConfig) setDurability(level string, syncIntervalMs int) {
+	nodes := []*NodeConfig{&c.Master}
+	for i := range c.Masters {
+		nodes = append(nodes, &c.Masters[i])
+	}
+	for i := range c.Replicas {
+		nodes = append(nodes, &c.Replicas[i])
+	}
+	for _, n := range nodes {
+		n.Durability = level
+		if syncIntervalMs > 0 {
+			n.SyncIntervalMs = syncIntervalMs
+		}
+	}
+}
+
+// coordinators lists every master that may coordinate this cluster's transactions, Master first
+func (c *ClusterConfig) coordinators() []NodeConfig {
+	return append([]NodeConfig{c.Master}, c.Masters...)
+}
+
+// coordinatorIndex finds a master by node id, where an empty id means Master. It returns -1 if
+// there is no such master.
+func (c *ClusterConfig) coordinatorIndex(id string) int {
+	if id == "" {
+		return 0
+	}
+	for i, n := range c.coordinators() {
+		if n.Id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (c *ClusterConfig) subordinateIndex(id string) (int, error) {
+	for i, n := range c.Subordinates {
+		if n.Id == id {
+			return i, nil
+		}
+	}
+	return -1, errors.New(fmt.Sprint("Cluster ", id, " is not a subordinate in the cluster config."))
+}
+
+// replicaIndex finds a replica by node id. The index is its position in the config, which is also
+// its Paxos Commit instance number.
+func (c *ClusterConfig) replicaIndex(id string) (int, error) {
+	for i, n := range c.Replicas {
+		if n.Id == id {
+			return i, nil
+		}
+	}
+	return -1, errors.New(fmt.Sprint("Replica ", id, " is not in the cluster config."))
+}
@@ -0,0 +1,138 @@
+// +build !goci
+package main
+
+import (
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"os"
+	"time"
+)
+
+var testClusterPath = "./test.cluster.json"
+
+type ClusterSuite struct{}
+
+var _ = Suite(&ClusterSuite{})
+
+func (s *ClusterSuite) TearDownTest(c *C) {
+	os.Remove(testClusterPath)
+}
+
+func loadTestCluster(c *C, json string) (*ClusterConfig, error) {
+	err := ioutil.WriteFile(testClusterPath, []byte(json), 0777)
+	if err != nil {
+		c.Fatal("Failed to write cluster config:", err)
+	}
+	return LoadClusterConfig(testClusterPath)
+}
+
+func (s *ClusterSuite) TestDefaultClusterHasOneShard(c *C) {
+	cluster := DefaultClusterConfig(3)
+	c.Assert(cluster.Shards, HasLen, 1)
+	c.Assert(cluster.shardFor("anything").replicaIndexes, DeepEquals, []int{0, 1, 2})
+	c.Assert(cluster.Replicas[1].LogPath, Equals, "logs/replica1.txt")
+	c.Assert(cluster.Replicas[1].ArchiveDir, Equals, "logs/archive")
+}
+
+func (s *ClusterSuite) TestCommandClusterNeedsReplicas(c *C) {
+	_, err := commandCluster("", 0)
+	c.Assert(err, ErrorMatches, `Without a cluster config \(-c\), the replica count \(-n\) is required.`)
+	cluster, err := commandCluster("", 2)
+	c.Assert(err, IsNil)
+	c.Assert(cluster.Replicas, HasLen, 2)
+}
+
+func (s *ClusterSuite) TestRangeSharding(c *C) {
+	cluster, err := loadTestCluster(c, `{
+		"Master": {"Id": "m", "Address": "localhost:1"},
+		"Replicas": [{"Id": "a", "Address": "localhost:2"}, {"Id": "b", "Address": "localhost:3"}, {"Id": "c", "Address": "localhost:4"}],
+		"Sharding": "range",
+		"Shards": [{"Id": "high", "Replicas": ["c"], "StartKey": "m"}, {"Id": "low", "Replicas": ["a", "b"]}]
+	}`)
+	c.Assert(err, IsNil)
+
+	c.Assert(cluster.shardFor("apple").Id, Equals, "low")
+	c.Assert(cluster.shardFor("m").Id, Equals, "high")
+	c.Assert(cluster.shardFor("zebra").Id, Equals, "high")
+
+	opsByReplica, participants, err := cluster.routeOps([]TxOp{{PutOp, "apple", []byte("1"), "", ""}, {DelOp, "zebra", nil, "", ""}})
+	c.Assert(err, IsNil)
+	c.Assert(participants, DeepEquals, []int{0, 1, 2})
+	c.Assert(opsByReplica[2], DeepEquals, []TxOp{{DelOp, "zebra", nil, "", ""}})
+}
+
+func (s *ClusterSuite) TestReplicaInTwoShardsIsRejected(c *C) {
+	_, err := loadTestCluster(c, `{
+		"Master": {"Id": "m", "Address": "localhost:1"},
+		"Replicas": [{"Id": "a", "Address": "localhost:2"}],
+		"Shards": [{"Id": "one", "Replicas": ["a"]}, {"Id": "two", "Replicas": ["a"]}]
+	}`)
+	c.Assert(err, Not(IsNil))
+}
+
+func (s *ClusterSuite) TestRouteOpsToSubordinate(c *C) {
+	cluster, err := loadTestCluster(c, `{
+		"Master": {"Id": "m", "Address": "localhost:1"},
+		"Replicas": [{"Id": "a", "Address": "localhost:2"}],
+		"Subordinates": [{"Id": "other", "Address": "localhost:3"}]
+	}`)
+	c.Assert(err, IsNil)
+
+	opsByReplica, participants, err := cluster.routeOps([]TxOp{{PutOp, "k", []byte("1"), "", ""}, {PutOp, "k", []byte("2"), "", "other"}})
+	c.Assert(err, IsNil)
+	c.Assert(participants, DeepEquals, []int{0, 1})
+	c.Assert(opsByReplica[1], DeepEquals, []TxOp{{PutOp, "k", []byte("2"), "", ""}})
+
+	_, _, err = cluster.routeOps([]TxOp{{PutOp, "k", []byte("1"), "", "unknown"}})
+	c.Assert(err, Not(IsNil))
+}
+
+func (s *ClusterSuite) TestCoordinatorIndex(c *C) {
+	cluster, err := loadTestCluster(c, `{
+		"Master": {"Id": "m", "Address": "localhost:1"},
+		"Masters": [{"Id": "m2", "Address": "localhost:5"}],
+		"Replicas": [{"Id": "a", "Address": "localhost:2"}]
+	}`)
+	c.Assert(err, IsNil)
+
+	c.Assert(cluster.coordinatorIndex(""), Equals, 0)
+	c.Assert(cluster.coordinatorIndex("m2"), Equals, 1)
+	c.Assert(cluster.coordinatorIndex("a"), Equals, -1)
+	c.Assert(cluster.coordinators()[1].LogPath, Equals, "logs/m2.txt")
+}
+
+func (s *ClusterSuite) TestStorageEngine(c *C) {
+	cluster, err := loadTestCluster(c, `{
+		"Master": {"Id": "m", "Address": "localhost:1"},
+		"Replicas": [{"Id": "a", "Address": "localhost:2"}, {"Id": "b", "Address": "localhost:3", "StorageEngine": "memory"}]
+	}`)
+	c.Assert(err, IsNil)
+	c.Assert(cluster.Replicas[0].StorageEngine, Equals, FileStorage)
+	c.Assert(cluster.Replicas[1].StorageEngine, Equals, MemoryStorage)
+
+	_, err = loadTestCluster(c, `{
+		"Master": {"Id": "m", "Address": "localhost:1"},
+		"Replicas": [{"Id": "a", "Address": "localhost:2", "StorageEngine": "tape"}]
+	}`)
+	c.Assert(err, NotNil)
+}
+
+func (s *ClusterSuite) TestDurability(c *C) {
+	cluster, err := loadTestCluster(c, `{
+		"Master": {"Id": "m", "Address": "localhost:1"},
+		"Replicas": [{"Id": "a", "Address": "localhost:2", "Durability": "group", "SyncIntervalMs": 5}, {"Id": "b", "Address": "localhost:3", "Durability": "group"}]
+	}`)
+	c.Assert(err, IsNil)
+	c.Assert(cluster.Master.logDurability(), Equals, logDurability{SyncDurability, 0})
+	c.Assert(cluster.Replicas[0].logDurability(), Equals, logDurability{GroupDurability, 5 * time.Millisecond})
+	c.Assert(cluster.Replicas[1].logDurability(), Equals, logDurability{GroupDurability, defaultSyncInterval})
+
+	cluster.setDurability(BufferedDurability, 0)
+	c.Assert(cluster.Replicas[0].logDurability(), Equals, logDurability{BufferedDurability, 0})
+
+	_, err = loadTestCluster(c, `{
+		"Master": {"Id": "m", "Address": "localhost:1", "Durability": "sometimes"},
+		"Replicas": [{"Id": "a", "Address": "localhost:2"}]
+	}`)
+	c.Assert(err, NotNil)
+}
@@ -82,6 +82,16 @@ func ParseOperation(s string) Operation {
 	return NoOp
 }
 
+// TxOp is one write in a transaction. Value and ContentType are only used by PutOp. Cluster names
+// the cluster that owns the key when a master coordinates other clusters, and is empty for its own.
+type TxOp struct {
+	Op          Operation
+	Key         string
+	Value       []byte
+	ContentType string
+	Cluster     string
+}
+
 type ReplicaDeath int
 
 const (
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The CSV format is the legacy one, with each record being the fields of a logEntry written with
+// writeEntry or of a writeRecord call. After csvLogMagic, each record is the length and CRC32 of its
+// CSV encoding as 8 hex digits each, a space-separated header, the CSV itself and a newline. A
+// record that was only partly written when the process died is always the last one in the file,
+// so a bad last record is dropped while a bad record anywhere else means the log is corrupt.
+//
+// The magic may be followed by a header line like "# durability=group sync-interval=10ms", which
+// logs written before durability was recorded don't have.
+const csvLogMagic = "GOTWOPC-LOG 1\n"
+
+const csvHeaderPrefix = "# "
+
+const csvRecordHeaderSize = 18
+
+type csvFormat struct{}
+
+func (csvFormat) name() string {
+	return CsvLogFormat
+}
+
+func (csvFormat) magic() []byte {
+	return []byte(csvLogMagic)
+}
+
+func (csvFormat) header(d logDurability) []byte {
+	line := fmt.Sprint(csvHeaderPrefix, "durability=", d.level)
+	if d.syncInterval > 0 {
+		line += fmt.Sprint(" sync-interval=", d.syncInterval)
+	}
+	return []byte(csvLogMagic + line + "\n")
+}
+
+// csvHeaderLine returns the header line after the magic, without its newline, and the offset of the
+// first record
+func csvHeaderLine(data []byte) (line string, pos int) {
+	pos = len(csvLogMagic)
+	rest := data[pos:]
+	if !bytes.HasPrefix(rest, []byte(csvHeaderPrefix)) {
+		return "", pos
+	}
+	end := bytes.IndexByte(rest, '\n')
+	if end < 0 {
+		return "", len(data)
+	}
+	return string(rest[len(csvHeaderPrefix):end]), pos + end + 1
+}
+
+func (csvFormat) headerDurability(data []byte) (d logDurability) {
+	line, _ := csvHeaderLine(data)
+	for _, field := range strings.Fields(line) {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "durability":
+			d.level = kv[1]
+		case "sync-interval":
+			interval, err := time.ParseDuration(kv[1])
+			if err == nil {
+				d.syncInterval = interval
+			}
+		}
+	}
+	return
+}
+
+func (f csvFormat) encodeEntry(e logEntry) []byte {
+	return f.encodeFields(entryFields(e))
+}
+
+func (csvFormat) encodeFields(fields []string) []byte {
+	var payload bytes.Buffer
+	w := csv.NewWriter(&payload)
+	w.Write(fields)
+	w.Flush()
+	csvBytes := bytes.TrimSuffix(payload.Bytes(), []byte("\n"))
+	header := fmt.Sprintf("%08x %08x ", len(csvBytes), crc32.ChecksumIEEE(csvBytes))
+	return append(append([]byte(header), csvBytes...), '\n')
+}
+
+// csvRecordAt reports whether data starts with a whole record whose checksum matches. It parses the
+// header by hand, as it is tried at every offset of a damaged log.
+func csvRecordAt(data []byte) bool {
+	if len(data) < csvRecordHeaderSize || data[8] != ' ' || data[17] != ' ' {
+		return false
+	}
+	length, err := strconv.ParseUint(string(data[0:8]), 16, 32)
+	if err != nil {
+		return false
+	}
+	crc, err := strconv.ParseUint(string(data[9:17]), 16, 32)
+	if err != nil {
+		return false
+	}
+	end := csvRecordHeaderSize + int(length)
+	return end < len(data) && data[end] == '\n' && crc32.ChecksumIEEE(data[csvRecordHeaderSize:end]) == uint32(crc)
+}
+
+func (csvFormat) decode(logFilePath string, data []byte) (records []logRecord, torn int, err error) {
+	if !bytes.HasPrefix(data, []byte(csvLogMagic)) {
+		return nil, -1, errors.New(fmt.Sprint("Log ", logFilePath, " is not a CSV log"))
+	}
+	_, pos := csvHeaderLine(data)
+	for pos < len(data) {
+		rest := data[pos:]
+		corrupt := errors.New(fmt.Sprint("Corrupt record in log ", logFilePath, " at offset ", pos))
+		if len(rest) < csvRecordHeaderSize {
+			return records, pos, nil
+		}
+		var length, crc uint32
+		_, scanErr := fmt.Sscanf(string(rest[:csvRecordHeaderSize]), "%08x %08x ", &length, &crc)
+		if scanErr != nil {
+			if bytes.IndexByte(rest, '\n') < 0 {
+				return records, pos, nil
+			}
+			return nil, -1, corrupt
+		}
+		end := csvRecordHeaderSize + int(length)
+		if end+1 > len(rest) {
+			if wholeRecordAfter(rest, csvRecordAt) {
+				return nil, -1, corrupt
+			}
+			return records, pos, nil
+		}
+		payload := rest[csvRecordHeaderSize:end]
+		if rest[end] != '\n' || crc32.ChecksumIEEE(payload) != crc {
+			if end+1 == len(rest) {
+				return records, pos, nil
+			}
+			return nil, -1, corrupt
+		}
+		r := csv.NewReader(bytes.NewReader(payload))
+		r.FieldsPerRecord = -1
+		fields, csvErr := r.Read()
+		if csvErr != nil {
+			return nil, -1, corrupt
+		}
+		records = append(records, logRecord{nil, fields})
+		pos += end + 1
+	}
+	return records, -1, nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Masters, replicas and clients write their diagnostics through one structured logger rather than
+// the log package: each line has a time, a level, the node it comes from, a message and key/value
+// fields such as txId, key, replica and phase. Lines are written as text or as JSON objects, and
+// those below the level set with --log-level are dropped. (The transaction logs are logger.go's.)
+
+type logLevel int
+
+const (
+	DebugLevel logLevel = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+func (l logLevel) String() string {
+	switch l {
+	case DebugLevel:
+		return "debug"
+	case InfoLevel:
+		return "info"
+	case WarnLevel:
+		return "warn"
+	case ErrorLevel:
+		return "error"
+	}
+	return "invalid"
+}
+
+func parseLogLevel(s string) (logLevel, error) {
+	for l := DebugLevel; l <= ErrorLevel; l++ {
+		if strings.ToLower(s) == l.String() {
+			return l, nil
+		}
+	}
+	return InfoLevel, errors.New(fmt.Sprint("Unknown log level: ", s, ", use debug, info, warn or error"))
+}
+
+const (
+	TextLogEncoding = "text"
+	JsonLogEncoding = "json"
+)
+
+type diagnosticsLogger struct {
+	level logLevel
+	json  bool
+	node  string
+	out   io.Writer
+	mu    sync.Mutex
+}
+
+var diagnostics = &diagnosticsLogger{InfoLevel, false, "", os.Stdout, sync.Mutex{}}
+
+// configureDiagnostics sets the level and encoding of the diagnostics, and the node they are from
+func configureDiagnostics(level string, encoding string, node string) error {
+	l, err := parseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	if encoding != TextLogEncoding && encoding != JsonLogEncoding {
+		return errors.New(fmt.Sprint("Unknown log encoding: ", encoding, ", use text or json"))
+	}
+
+	diagnostics.mu.Lock()
+	defer diagnostics.mu.Unlock()
+	diagnostics.level = l
+	diagnostics.json = encoding == JsonLogEncoding
+	diagnostics.node = node
+	return nil
+}
+
+func logDebug(msg string, fields ...interface{}) { diagnostics.write(DebugLevel, msg, fields) }
+func logInfo(msg string, fields ...interface{})  { diagnostics.write(InfoLevel, msg, fields) }
+func logWarn(msg string, fields ...interface{})  { diagnostics.write(WarnLevel, msg, fields) }
+func logError(msg string, fields ...interface{}) { diagnostics.write(ErrorLevel, msg, fields) }
+
+// logFatal logs at the error level and exits
+func logFatal(msg string, fields ...interface{}) {
+	diagnostics.write(ErrorLevel, msg, fields)
+	os.Exit(1)
+}
+
+// write logs msg with fields given as name and value pairs
+func (d *diagnosticsLogger) write(level logLevel, msg string, fields []interface{}) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if level < d.level {
+		return
+	}
+
+	now := time.Now().UTC().Format("2006-01-02T15:04:05.000000Z07:00")
+	var line []byte
+	if d.json {
+		line = d.jsonLine(now, level, msg, fields)
+	} else {
+		line = d.textLine(now, level, msg, fields)
+	}
+	d.out.Write(line)
+}
+
+func fieldValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+func (d *diagnosticsLogger) textLine(now string, level logLevel, msg string, fields []interface{}) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %-5s", now, strings.ToUpper(level.String()))
+	if d.node != "" {
+		b.WriteString(" " + d.node)
+	}
+	b.WriteString(" " + msg)
+	for i := 0; i+1 < len(fields); i += 2 {
+		value := fmt.Sprint(fieldValue(fields[i+1]))
+		if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+			value = fmt.Sprintf("%q", value)
+		}
+		fmt.Fprintf(&b, " %v=%s", fields[i], value)
+	}
+	b.WriteString("\n")
+	return []byte(b.String())
+}
+
+func (d *diagnosticsLogger) jsonLine(now string, level logLevel, msg string, fields []interface{}) []byte {
+	// Written by hand to keep the fixed fields first and the rest in the order given
+	var b strings.Builder
+	field := func(name string, value interface{}) {
+		n, _ := json.Marshal(name)
+		v, err := json.Marshal(value)
+		if err != nil {
+			v, _ = json.Marshal(fmt.Sprint(value))
+		}
+		if b.Len() > 1 {
+			b.WriteString(",")
+		}
+		b.Write(n)
+		b.WriteString(":")
+		b.Write(v)
+	}
+	b.WriteString("{")
+	field("time", now)
+	field("level", level.String())
+	if d.node != "" {
+		field("node", d.node)
+	}
+	field("msg", msg)
+	for i := 0; i+1 < len(fields); i += 2 {
+		field(fmt.Sprint(fields[i]), fieldValue(fields[i+1]))
+	}
+	b.WriteString("}\n")
+	return []byte(b.String())
+}
@@ -0,0 +1,58 @@
+// +build !goci
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	. "launchpad.net/gocheck"
+	"strings"
+	"sync"
+)
+
+type DiagnosticsSuite struct{}
+
+var _ = Suite(&DiagnosticsSuite{})
+
+func testDiagnostics(level logLevel, json bool) (*diagnosticsLogger, *bytes.Buffer) {
+	out := &bytes.Buffer{}
+	return &diagnosticsLogger{level, json, "r0", out, sync.Mutex{}}, out
+}
+
+func (s *DiagnosticsSuite) TestLinesBelowTheLevelAreDropped(c *C) {
+	d, out := testDiagnostics(WarnLevel, false)
+	d.write(DebugLevel, "debug", nil)
+	d.write(InfoLevel, "info", nil)
+	d.write(WarnLevel, "warn", nil)
+	d.write(ErrorLevel, "error", nil)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	c.Assert(lines, HasLen, 2)
+	c.Assert(lines[0], Matches, `\S+ WARN  r0 warn`)
+	c.Assert(lines[1], Matches, `\S+ ERROR r0 error`)
+}
+
+func (s *DiagnosticsSuite) TestTextFields(c *C) {
+	d, out := testDiagnostics(DebugLevel, false)
+	d.write(InfoLevel, "Prepared", []interface{}{"txId", "m.tx1", "key", "two words", "replica", 3, "phase", Prepared, "error", errorString(nil)})
+	c.Assert(out.String(), Matches, `\S+ INFO  r0 Prepared txId=m.tx1 key="two words" replica=3 phase=PREPARED error=""\n`)
+}
+
+func (s *DiagnosticsSuite) TestJsonFields(c *C) {
+	d, out := testDiagnostics(DebugLevel, true)
+	d.write(ErrorLevel, "Commit failed", []interface{}{"txId", "m.tx1", "replica", 3, "error", recoveringError("key foo")})
+
+	line := out.String()
+	c.Assert(line, Matches, `\{"time":"[^"]+","level":"error","node":"r0","msg":"Commit failed","txId":"m.tx1","replica":3,"error":"Recovering, retry later: key foo"\}\n`)
+	var fields map[string]interface{}
+	c.Assert(json.Unmarshal([]byte(line), &fields), IsNil)
+	c.Assert(fields["replica"], Equals, float64(3))
+}
+
+func (s *DiagnosticsSuite) TestBadSettingsAreRefused(c *C) {
+	_, err := parseLogLevel("verbose")
+	c.Assert(err, ErrorMatches, "Unknown log level: verbose, .*")
+	level, err := parseLogLevel("WARN")
+	c.Assert(err, IsNil)
+	c.Assert(level, Equals, WarnLevel)
+	c.Assert(configureDiagnostics("info", "xml", "r0"), ErrorMatches, "Unknown log encoding: xml, .*")
+}
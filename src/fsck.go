@@ -0,0 +1,374 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	flag "github.com/ogier/pflag"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+)
+
+// fsckReport is everything fsck found wrong with a stopped cluster
+type fsckReport struct {
+	// DivergentKeys are keys whose committed value isn't the same on every replica of their shard
+	DivergentKeys []divergentKey
+	// LeftoverTempKeys are uncommitted values whose transaction isn't prepared on that replica
+	LeftoverTempKeys []leftoverTempKey
+	// OutcomeMismatches are transactions a replica finished differently from its coordinator
+	OutcomeMismatches []outcomeMismatch
+	// LockedKeys are keys held by transactions a replica is still prepared for
+	LockedKeys []lockedKey
+	// StoreDamage is what a crash left unfinished in a replica's stores, which the replica tidies up
+	// when it starts
+	StoreDamage []storeDamage
+	// Skipped lists what couldn't be checked, and why
+	Skipped []string
+}
+
+type divergentKey struct {
+	Shard string
+	Key   string
+	// Values maps each replica id to the value's size and checksum, or "missing"
+	Values map[string]string
+}
+
+type leftoverTempKey struct {
+	Replica string
+	TempKey string
+	TxId    string
+	// State is the transaction's last state in the replica's log
+	State string
+}
+
+type outcomeMismatch struct {
+	TxId               string
+	CoordinatorOutcome string
+	Replica            string
+	ReplicaOutcome     string
+}
+
+type lockedKey struct {
+	Replica string
+	Key     string
+	TxId    string
+	// CoordinatorOutcome is what recovery will resolve the transaction to, if the coordinator's log
+	// has decided it
+	CoordinatorOutcome string
+}
+
+type storeDamage struct {
+	Replica string
+	Store   string
+	Problem string
+}
+
+func (r *fsckReport) problems() int {
+	return len(r.DivergentKeys) + len(r.LeftoverTempKeys) + len(r.OutcomeMismatches) + len(r.LockedKeys) + len(r.StoreDamage)
+}
+
+// txStates is the last state of each transaction in a log, and the keys it prepared
+type txStates struct {
+	states   map[string]TxState
+	prepared map[string][]string
+}
+
+func readTxStates(logFilePath string) (t txStates, err error) {
+	t = txStates{make(map[string]TxState), make(map[string][]string)}
+	l, err := openLog(logFilePath)
+	if err != nil {
+		return
+	}
+	entries, err := l.read()
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if e.state == NoState {
+			continue
+		}
+		t.states[e.txId] = e.state
+		if e.state == Prepared && e.key != "" {
+			t.prepared[e.txId] = append(t.prepared[e.txId], e.key)
+		}
+	}
+	return
+}
+
+func isOutcome(state TxState) bool {
+	return state == Committed || state == Aborted
+}
+
+func outcomeString(state TxState) string {
+	if isOutcome(state) {
+		return state.String()
+	}
+	return "undecided"
+}
+
+func summarizeValue(value []byte) string {
+	return fmt.Sprintf("%d bytes, crc32 %08x", len(value), crc32.ChecksumIEEE(value))
+}
+
+// openReplicaStore opens one of a replica's stores read-only, or returns why it can't be checked.
+// What a crash left unfinished in the store is left as it is, and returned as damage.
+func openReplicaStore(node NodeConfig, name string) (store storageEngine, damage []storeDamage, reason string) {
+	if node.StorageEngine == MemoryStorage {
+		return nil, nil, fmt.Sprint("replica ", node.Id, " keeps its data in memory")
+	}
+	dbPath := path.Join(node.DataDir, name)
+	if _, err := os.Stat(dbPath); err != nil {
+		return nil, nil, fmt.Sprint("replica ", node.Id, " has no ", name, " store: ", err)
+	}
+	store, problems, err := openStorageEngineReadOnly(node.StorageEngine, dbPath)
+	if err != nil {
+		return nil, nil, fmt.Sprint("replica ", node.Id, " ", name, " store: ", err)
+	}
+	for _, p := range problems {
+		damage = append(damage, storeDamage{node.Id, name, p})
+	}
+	return store, damage, ""
+}
+
+func closeStore(s storageEngine) {
+	if c, ok := s.(interface {
+		close()
+	}); ok {
+		c.close()
+	}
+}
+
+// fsck checks the data and logs of a cluster whose nodes are all stopped
+func fsck(cluster *ClusterConfig) (report fsckReport, err error) {
+	// A clean report must mean the data was checked
+	if len(cluster.Replicas) == 0 {
+		return report, errors.New("The cluster has no replicas to check.")
+	}
+	outcomes := make(map[string]TxState)
+	for _, n := range cluster.coordinators() {
+		t, err := readTxStates(n.LogPath)
+		if err != nil {
+			report.Skipped = append(report.Skipped, fmt.Sprint("log of master ", n.Id, ": ", err))
+			continue
+		}
+		for txId, state := range t.states {
+			outcomes[txId] = state
+		}
+	}
+
+	for _, n := range cluster.Replicas {
+		t, err := readTxStates(n.LogPath)
+		if err != nil {
+			report.Skipped = append(report.Skipped, fmt.Sprint("log of replica ", n.Id, ": ", err))
+			continue
+		}
+		for txId, state := range t.states {
+			outcome := outcomes[txId]
+			if isOutcome(state) && isOutcome(outcome) && state != outcome {
+				report.OutcomeMismatches = append(report.OutcomeMismatches, outcomeMismatch{txId, outcome.String(), n.Id, state.String()})
+			}
+			if state == Prepared {
+				for _, key := range t.prepared[txId] {
+					report.LockedKeys = append(report.LockedKeys, lockedKey{n.Id, key, txId, outcomeString(outcome)})
+				}
+			}
+		}
+
+		tempStore, damage, reason := openReplicaStore(n, "temp")
+		if tempStore == nil {
+			report.Skipped = append(report.Skipped, reason)
+			continue
+		}
+		report.StoreDamage = append(report.StoreDamage, damage...)
+		keys, err := tempStore.list()
+		closeStore(tempStore)
+		if err != nil {
+			return report, err
+		}
+		for _, key := range keys {
+			txId, _, parseErr := parseTempStoreKey(key)
+			if parseErr != nil {
+				// Replicas keep these for transactions prepared before an upgrade
+				var isLegacy bool
+				txId, _, isLegacy = parseLegacyTempStoreKey(key)
+				if isLegacy {
+					parseErr = nil
+				}
+			}
+			state, logged := t.states[txId]
+			if parseErr != nil || state != Prepared {
+				stateName := "not logged"
+				if logged {
+					stateName = state.String()
+				}
+				report.LeftoverTempKeys = append(report.LeftoverTempKeys, leftoverTempKey{n.Id, key, txId, stateName})
+			}
+		}
+	}
+
+	for _, shard := range cluster.Shards {
+		divergent, damage, skipped, err := compareShard(cluster, shard)
+		if err != nil {
+			return report, err
+		}
+		report.DivergentKeys = append(report.DivergentKeys, divergent...)
+		report.StoreDamage = append(report.StoreDamage, damage...)
+		report.Skipped = append(report.Skipped, skipped...)
+	}
+
+	sort.Slice(report.OutcomeMismatches, func(i, j int) bool {
+		a, b := report.OutcomeMismatches[i], report.OutcomeMismatches[j]
+		return a.TxId < b.TxId || (a.TxId == b.TxId && a.Replica < b.Replica)
+	})
+	sort.Slice(report.LeftoverTempKeys, func(i, j int) bool {
+		a, b := report.LeftoverTempKeys[i], report.LeftoverTempKeys[j]
+		return a.Replica < b.Replica || (a.Replica == b.Replica && a.TempKey < b.TempKey)
+	})
+	sort.Slice(report.LockedKeys, func(i, j int) bool {
+		a, b := report.LockedKeys[i], report.LockedKeys[j]
+		return a.Replica < b.Replica || (a.Replica == b.Replica && a.Key < b.Key)
+	})
+	return
+}
+
+// compareShard reports the keys that don't have the same committed value on every replica of shard
+func compareShard(cluster *ClusterConfig, shard ShardConfig) (divergent []divergentKey, damage []storeDamage, skipped []string, err error) {
+	values := make(map[string]map[string]string)
+	var replicaIds []string
+	for _, i := range shard.replicaIndexes {
+		n := cluster.Replicas[i]
+		store, storeDamage, reason := openReplicaStore(n, "committed")
+		if store == nil {
+			skipped = append(skipped, reason)
+			continue
+		}
+		damage = append(damage, storeDamage...)
+		replicaIds = append(replicaIds, n.Id)
+		err = store.iterate(func(key string, value []byte) error {
+			if values[key] == nil {
+				values[key] = make(map[string]string)
+			}
+			values[key][n.Id] = summarizeValue(value)
+			return nil
+		})
+		closeStore(store)
+		if err != nil {
+			return
+		}
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		byReplica := values[key]
+		same := len(byReplica) == len(replicaIds)
+		for _, v := range byReplica {
+			same = same && v == byReplica[replicaIds[0]]
+		}
+		if same {
+			continue
+		}
+		for _, id := range replicaIds {
+			if _, ok := byReplica[id]; !ok {
+				byReplica[id] = "missing"
+			}
+		}
+		divergent = append(divergent, divergentKey{shard.Id, key, byReplica})
+	}
+	return
+}
+
+func printFsckReport(w io.Writer, report fsckReport, asJSON bool) error {
+	if asJSON {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(data))
+		return err
+	}
+
+	var lines []string
+	section := func(title string, n int, line func(i int) string) {
+		if n == 0 {
+			return
+		}
+		lines = append(lines, title)
+		for i := 0; i < n; i++ {
+			lines = append(lines, "  "+line(i))
+		}
+	}
+	section("Keys that differ between replicas:", len(report.DivergentKeys), func(i int) string {
+		d := report.DivergentKeys[i]
+		ids := make([]string, 0, len(d.Values))
+		for id := range d.Values {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		s := fmt.Sprintf("shard %v key %q:", d.Shard, d.Key)
+		for _, id := range ids {
+			s += fmt.Sprint(" ", id, " ", d.Values[id], ";")
+		}
+		return s[:len(s)-1]
+	})
+	section("Temp entries with no prepared transaction:", len(report.LeftoverTempKeys), func(i int) string {
+		t := report.LeftoverTempKeys[i]
+		return fmt.Sprintf("%v %q, tx %v is %v", t.Replica, t.TempKey, t.TxId, t.State)
+	})
+	section("Transactions whose outcome differs between coordinator and replica:", len(report.OutcomeMismatches), func(i int) string {
+		m := report.OutcomeMismatches[i]
+		return fmt.Sprintf("%v: coordinator %v, %v %v", m.TxId, m.CoordinatorOutcome, m.Replica, m.ReplicaOutcome)
+	})
+	section("Keys locked by unresolved transactions:", len(report.LockedKeys), func(i int) string {
+		k := report.LockedKeys[i]
+		return fmt.Sprintf("%v %q by tx %v, coordinator says %v", k.Replica, k.Key, k.TxId, k.CoordinatorOutcome)
+	})
+	section("Writes a crash left unfinished in stores, which the replica tidies up when it starts:", len(report.StoreDamage), func(i int) string {
+		d := report.StoreDamage[i]
+		return fmt.Sprintf("%v %v store: %v", d.Replica, d.Store, d.Problem)
+	})
+	section("Not checked:", len(report.Skipped), func(i int) string {
+		return report.Skipped[i]
+	})
+	if report.problems() == 0 {
+		lines = append(lines, "No problems found.")
+	} else {
+		lines = append(lines, fmt.Sprint("Problems found: ", report.problems()))
+	}
+
+	for _, line := range lines {
+		_, err := fmt.Fprintln(w, line)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fsckCommand implements "fsck", which exits with status 1 if it finds any problems
+func fsckCommand(args []string) {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	configPath := flags.StringP("config", "c", "", "cluster config file (JSON) to check")
+	replicaCount := flags.IntP("replicaCount", "n", 0, "replica count, required without a cluster config")
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+	flags.Parse(args)
+
+	report, err := fsck(loadCommandCluster(*configPath, *replicaCount))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	err = printFsckReport(os.Stdout, report, *asJSON)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if report.problems() > 0 {
+		os.Exit(1)
+	}
+}
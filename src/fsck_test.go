@@ -0,0 +1,150 @@
+// +build !goci
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"os"
+	"strings"
+)
+
+type FsckSuite struct{}
+
+var _ = Suite(&FsckSuite{})
+
+func (s *FsckSuite) TearDownTest(c *C) {
+	os.Remove(testClusterPath)
+	os.RemoveAll("./test.fsck")
+}
+
+func putInStore(c *C, node NodeConfig, store string, key string, value string) {
+	s := newStorageEngine(node.StorageEngine, node.DataDir+"/"+store)
+	c.Assert(s.put(key, []byte(value)), IsNil)
+	closeStore(s)
+}
+
+func (s *FsckSuite) TestClusterWithoutReplicasIsRefused(c *C) {
+	_, err := fsck(DefaultClusterConfig(0))
+	c.Assert(err, ErrorMatches, "The cluster has no replicas to check.")
+}
+
+func (s *FsckSuite) TestHealthyCluster(c *C) {
+	cluster := twoReplicaTestCluster(c, "test.fsck", false)
+	master := newLogger(cluster.Master.LogPath, WalLogFormat, syncDurability)
+	master.writeState("tx1", Committed)
+	for _, n := range cluster.Replicas {
+		newLogger(n.LogPath, WalLogFormat, syncDurability).writeState("tx1", Committed)
+		putInStore(c, n, "committed", "foo", "bar")
+		closeStore(newStorageEngine(n.StorageEngine, n.DataDir+"/temp"))
+	}
+
+	report, err := fsck(cluster)
+	c.Assert(err, IsNil)
+	c.Assert(report.problems(), Equals, 0)
+	c.Assert(report.Skipped, HasLen, 0)
+
+	var out bytes.Buffer
+	c.Assert(printFsckReport(&out, report, false), IsNil)
+	c.Assert(out.String(), Equals, "No problems found.\n")
+}
+
+func (s *FsckSuite) TestEveryKindOfProblemIsReported(c *C) {
+	cluster := twoReplicaTestCluster(c, "test.fsck", false)
+	a, b := cluster.Replicas[0], cluster.Replicas[1]
+	master := newLogger(cluster.Master.LogPath, WalLogFormat, syncDurability)
+	replicaA := newLogger(a.LogPath, WalLogFormat, syncDurability)
+	replicaB := newLogger(b.LogPath, WalLogFormat, syncDurability)
+
+	// tx1 committed on a, but b thinks it aborted
+	master.writeState("tx1", Committed)
+	replicaA.writeState("tx1", Committed)
+	replicaB.writeState("tx1", Aborted)
+	// tx2 is prepared on a, and still locks its key
+	master.writeState("tx2", Started)
+	replicaA.writeEntry(logEntry{"tx2", Prepared, PutOp, "locked", []int{0, 1}, "localhost:1", "m", testStart, 0, nil})
+	putInStore(c, a, "temp", tempStoreKey("tx2", "locked"), "new")
+	// tx3 aborted on b, but its temp entry was never cleaned up
+	replicaB.writeState("tx3", Aborted)
+	putInStore(c, b, "temp", tempStoreKey("tx3", "stale"), "old")
+
+	putInStore(c, a, "committed", "foo", "1")
+	putInStore(c, b, "committed", "foo", "2")
+	putInStore(c, a, "committed", "same", "x")
+	putInStore(c, b, "committed", "same", "x")
+	putInStore(c, a, "committed", "onlyA", "x")
+
+	report, err := fsck(cluster)
+	c.Assert(err, IsNil)
+	c.Assert(report.problems(), Equals, 5)
+	c.Assert(report.DivergentKeys, HasLen, 2)
+	c.Assert(report.DivergentKeys[0].Key, Equals, "foo")
+	c.Assert(report.DivergentKeys[0].Values["a"], Equals, summarizeValue([]byte("1")))
+	c.Assert(report.DivergentKeys[1].Key, Equals, "onlyA")
+	c.Assert(report.DivergentKeys[1].Values["b"], Equals, "missing")
+	c.Assert(report.LeftoverTempKeys, DeepEquals, []leftoverTempKey{{"b", tempStoreKey("tx3", "stale"), "tx3", "ABORTED"}})
+	c.Assert(report.OutcomeMismatches, DeepEquals, []outcomeMismatch{{"tx1", "COMMITTED", "b", "ABORTED"}})
+	c.Assert(report.LockedKeys, DeepEquals, []lockedKey{{"a", "locked", "tx2", "undecided"}})
+
+	var out bytes.Buffer
+	c.Assert(printFsckReport(&out, report, false), IsNil)
+	printed := strings.Split(strings.TrimSpace(out.String()), "\n")
+	c.Assert(printed[len(printed)-1], Equals, "Problems found: 5")
+	c.Assert(out.String(), Matches, `(?s).*tx1: coordinator COMMITTED, b ABORTED.*`)
+
+	out.Reset()
+	c.Assert(printFsckReport(&out, report, true), IsNil)
+	var decoded fsckReport
+	c.Assert(json.Unmarshal(out.Bytes(), &decoded), IsNil)
+	c.Assert(decoded, DeepEquals, report)
+}
+
+func (s *FsckSuite) TestCrashDamageIsReportedAndLeftAlone(c *C) {
+	cluster, err := loadTestCluster(c, `{
+		"Master": {"Id": "m", "Address": "localhost:1", "LogPath": "test.fsck/logs/m.txt"},
+		"Replicas": [
+			{"Id": "a", "Address": "localhost:2", "DataDir": "test.fsck/data/a", "LogPath": "test.fsck/logs/a.txt"},
+			{"Id": "b", "Address": "localhost:3", "DataDir": "test.fsck/data/b", "LogPath": "test.fsck/logs/b.txt", "StorageEngine": "bitcask"}
+		]
+	}`)
+	c.Assert(err, IsNil)
+	newLogger(cluster.Master.LogPath, WalLogFormat, syncDurability).writeState("tx1", Committed)
+	for _, n := range cluster.Replicas {
+		newLogger(n.LogPath, WalLogFormat, syncDurability).writeState("tx1", Committed)
+		putInStore(c, n, "committed", "foo", "bar")
+		closeStore(newStorageEngine(n.StorageEngine, n.DataDir+"/temp"))
+	}
+	partial := "test.fsck/data/a/committed/" + tempFilePrefix + "kfoo"
+	c.Assert(ioutil.WriteFile(partial, []byte("ba"), 0777), IsNil)
+	dataFile := "test.fsck/data/b/committed/000000001" + bitcaskDataSuffix
+	f, err := os.OpenFile(dataFile, os.O_WRONLY|os.O_APPEND, 0)
+	c.Assert(err, IsNil)
+	_, err = f.Write([]byte("torn"))
+	c.Assert(err, IsNil)
+	c.Assert(f.Close(), IsNil)
+	before, err := os.Stat(dataFile)
+	c.Assert(err, IsNil)
+
+	report, err := fsck(cluster)
+	c.Assert(err, IsNil)
+	c.Assert(report.problems(), Equals, 2)
+	c.Assert(report.DivergentKeys, HasLen, 0)
+	c.Assert(report.StoreDamage, HasLen, 2)
+	c.Assert(report.StoreDamage[0], DeepEquals, storeDamage{"a", "committed", "partly written value " + partial})
+	c.Assert(report.StoreDamage[1].Problem, Matches, "unfinished write in "+dataFile+" at offset .*")
+
+	_, err = os.Stat(partial)
+	c.Assert(err, IsNil)
+	after, err := os.Stat(dataFile)
+	c.Assert(err, IsNil)
+	c.Assert(after.Size(), Equals, before.Size())
+}
+
+func (s *FsckSuite) TestMissingLogsAreSkipped(c *C) {
+	cluster := twoReplicaTestCluster(c, "test.fsck", false)
+	report, err := fsck(cluster)
+	c.Assert(err, IsNil)
+	c.Assert(report.problems(), Equals, 0)
+	c.Assert(report.Skipped, HasLen, 5)
+}
@@ -1,4 +1,5 @@
 go build tools\generateRpcClient.go
 generateRpcClient.exe master.go > masterClient.go
 generateRpcClient.exe replica.go > replicaClient.go
+generateRpcClient.exe acceptor.go > acceptorClient.go
 go build
\ No newline at end of file
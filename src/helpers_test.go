@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"io"
 	. "launchpad.net/gocheck"
-	"log"
+	"net"
+	"net/http"
+	"net/rpc"
 	"os"
 	"os/exec"
 	"strconv"
@@ -14,10 +16,13 @@ import (
 
 const ReplicaCount = 4
 
+var testCluster = DefaultClusterConfig(ReplicaCount)
+
 var masterCmd *exec.Cmd
 
-func startMaster(t *C) {
-	masterCmd = startCmd(t, "src.exe", "-m", "-n", strconv.Itoa(ReplicaCount))
+// startMaster runs the master, with any extra command line args
+func startMaster(t *C, args ...string) {
+	masterCmd = startCmd(t, "src.exe", append([]string{"-m", "-n", strconv.Itoa(ReplicaCount)}, args...)...)
 
 	client := NewMasterClient(MasterPort)
 
@@ -32,20 +37,21 @@ func startMaster(t *C) {
 
 var replicas = [ReplicaCount]*exec.Cmd{}
 
-func startReplicas(c *C, shouldRestart bool) {
+// startReplicas runs every replica, with any extra command line args
+func startReplicas(c *C, shouldRestart bool, args ...string) {
 	var wg sync.WaitGroup
 	for i := 0; i < ReplicaCount; i++ {
 		wg.Add(1)
 		go func(i int) {
-			startReplica(c, i, shouldRestart)
+			startReplica(c, i, shouldRestart, args...)
 			wg.Done()
 		}(i)
 	}
 	wg.Wait()
 }
 
-func startReplica(c *C, n int, shouldRestart bool) {
-	replicas[n] = startCmd(c, "src.exe", "-r", "-i", strconv.Itoa(n))
+func startReplica(c *C, n int, shouldRestart bool, args ...string) {
+	replicas[n] = startCmd(c, "src.exe", append([]string{"-r", "-n", strconv.Itoa(ReplicaCount), "-i", testCluster.Replicas[n].Id}, args...)...)
 
 	client := NewReplicaClient(GetReplicaHost(n))
 
@@ -54,7 +60,7 @@ func startReplica(c *C, n int, shouldRestart bool) {
 			if cmd != nil {
 				cmd.Wait()
 				if replicas[n] != nil {
-					startReplica(c, n, shouldRestart)
+					startReplica(c, n, shouldRestart, args...)
 				}
 			}
 		}(replicas[n])
@@ -69,6 +75,20 @@ func startReplica(c *C, n int, shouldRestart bool) {
 		fmt.Sprintf("Unable to Ping after running Replica %v.", n))
 }
 
+// verifyReplicasHave waits until every replica serves value for key
+func verifyReplicasHave(c *C, key string, value string) {
+	for i := 0; i < ReplicaCount; i++ {
+		client := NewReplicaClient(GetReplicaHost(i))
+		verify(c,
+			func() bool {
+				val, err := client.Get(key)
+				return err == nil && string(val.Value) == value
+			},
+			fmt.Sprintf("Replica %v has %v.", i, key),
+			fmt.Sprintf("Replica %v doesn't have %v.", i, key))
+	}
+}
+
 func killMaster(c *C) {
 	if masterCmd == nil {
 		return
@@ -91,7 +111,7 @@ func killMaster(c *C) {
 func verify(c *C, check func() bool, successMessage string, failMessage string) {
 	for i := 0; i < 1000; i++ {
 		if check() {
-			log.Println(successMessage)
+			logInfo(successMessage)
 			return
 		}
 		time.Sleep(10 * time.Millisecond)
@@ -159,3 +179,63 @@ func startCmd(c *C, path string, args ...string) *exec.Cmd {
 
 	return cmd
 }
+
+// serveTestNodes serves RPCs on a local address for each of n nodes run in-process, so that the
+// addresses can go in a cluster config before the nodes exist. Calls to a node fail until it is
+// registered with its server.
+func serveTestNodes(c *C, n int) (servers []*rpc.Server, addresses []interface{}) {
+	for i := 0; i < n; i++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		c.Assert(err, IsNil)
+		server := rpc.NewServer()
+		go http.Serve(listener, server)
+		servers = append(servers, server)
+		addresses = append(addresses, listener.Addr().String())
+	}
+	return
+}
+
+// waitFor polls check until it holds, for up to a second
+func waitFor(c *C, check func() bool) {
+	for i := 0; !check(); i++ {
+		c.Assert(i < 100, Equals, true)
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// startTestReplica recovers replica num of cluster and registers it with server
+func startTestReplica(c *C, cluster *ClusterConfig, num int, server *rpc.Server) *Replica {
+	r := NewReplica(cluster, num)
+	c.Assert(r.recover(), IsNil)
+	server.Register(r)
+	return r
+}
+
+// replicaValue is what r has for key, or <none>
+func replicaValue(r *Replica, key string) string {
+	var result ReplicaGetResult
+	if r.Get(&ReplicaKeyArgs{key}, &result) != nil {
+		return "<none>"
+	}
+	return string(result.Value)
+}
+
+// twoReplicaTestCluster is a cluster of two replicas under dir. Sharded, a holds the keys before m and b
+// the rest; otherwise both hold every key.
+func twoReplicaTestCluster(c *C, dir string, sharded bool) *ClusterConfig {
+	shards := ""
+	if sharded {
+		shards = `,
+		"Sharding": "range",
+		"Shards": [{"Id": "low", "Replicas": ["a"]}, {"Id": "high", "Replicas": ["b"], "StartKey": "m"}]`
+	}
+	cluster, err := loadTestCluster(c, fmt.Sprintf(`{
+		"Master": {"Id": "m", "Address": "localhost:1", "LogPath": "%[1]v/logs/m.txt"},
+		"Replicas": [
+			{"Id": "a", "Address": "localhost:2", "DataDir": "%[1]v/data/a", "LogPath": "%[1]v/logs/a.txt"},
+			{"Id": "b", "Address": "localhost:3", "DataDir": "%[1]v/data/b", "LogPath": "%[1]v/logs/b.txt"}
+		]%[2]v
+	}`, dir, shards))
+	c.Assert(err, IsNil)
+	return cluster
+}
@@ -1,12 +1,55 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"path"
+	"strings"
 )
 
+// Keys are stored as file names, so they are encoded to survive any byte string: lowercase letters,
+// digits and '-' stay as they are, and every other byte becomes '_' plus two hex digits, which also
+// keeps keys distinct on case-insensitive file systems. The prefix keeps names clear of "", ".", ".."
+// and reserved device names like NUL or COM1.
+const keyFilePrefix = "k"
+
+// A key whose encoded name would be longer than the file system allows is stored under keyHashPrefix
+// and the hex SHA-256 of the key instead. Its file starts with the key, as a uvarint length and the
+// key's bytes, so the key can be listed and checked on reads.
+const keyHashPrefix = "h"
+
+// Names starting with a dot never come from encodeKey, so the store can keep its own files there
+const keyEncodingMarker = ".keys-v1"
+
+// Legacy files are moved aside into legacyKeysDir before any of them gets its encoded name, which
+// keeps a migration cut short by a crash from encoding a name twice: until keyMigrationMarker is
+// written every other file in the store is legacy, and after that every file in legacyKeysDir is.
+const legacyKeysDir = ".legacy-keys"
+const keyMigrationMarker = ".keys-migrating"
+
+// Values are written to a temp file that is renamed over the key's file once it is synced, so a
+// crash leaves either the old value or the new one. A temp file still around at startup is from a
+// write that never finished.
+const tempFilePrefix = ".tmp-"
+
+const maxKeyFileNameLength = 255
+
+// maxHashedKeyLength only guards against reading a damaged file's idea of a key length
+const maxHashedKeyLength = 1 << 30
+
+// Stored values start with this header, followed by the content type's length as a uvarint, the
+// content type and then the value's bytes. Files from before content types were stored have no
+// header and are read back as plain values. The NUL bytes keep text values from looking like it.
+var valueHeader = []byte("\x00gotwopc-value\x00")
+
 type keyValueStore struct {
 	basePath string
 }
@@ -14,33 +57,312 @@ type keyValueStore struct {
 func newKeyValueStore(dbPath string) (store *keyValueStore) {
 	err := os.MkdirAll(dbPath, 0)
 	if err != nil {
-		log.Fatalln("newKeyValueStore:", err)
+		logFatal("Unable to open store", "path", dbPath, "error", err)
 	}
 	store = &keyValueStore{dbPath}
+	err = store.migrateLegacyKeys()
+	if err != nil {
+		logFatal("Unable to open store", "path", dbPath, "error", err)
+	}
+	err = store.removePartialWrites()
+	if err != nil {
+		logFatal("Unable to open store", "path", dbPath, "error", err)
+	}
 	return
 }
 
-func (s *keyValueStore) getPath(key string) string {
-	return path.Join(s.basePath, key)
+// openKeyValueStoreReadOnly opens a store for reading without migrating or tidying it, and returns the
+// partly written values that newKeyValueStore would remove
+func openKeyValueStoreReadOnly(dbPath string) (s *keyValueStore, damage []string, err error) {
+	files, err := ioutil.ReadDir(dbPath)
+	if err != nil {
+		return
+	}
+	_, err = os.Stat(path.Join(dbPath, keyEncodingMarker))
+	if os.IsNotExist(err) && len(files) > 0 {
+		return nil, nil, errors.New(fmt.Sprint("Keys in ", dbPath, " aren't encoded into file names yet, which the replica does when it starts"))
+	}
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), tempFilePrefix) {
+			damage = append(damage, fmt.Sprint("partly written value ", path.Join(dbPath, file.Name())))
+		}
+	}
+	return &keyValueStore{dbPath}, damage, nil
 }
 
-func (s *keyValueStore) put(key string, value string) (err error) {
-	err = ioutil.WriteFile(s.getPath(key), []byte(value), 0777)
-	return
+// encodeKey returns the file name for key, and whether it is a hashed one
+func encodeKey(key string) (name string, hashed bool) {
+	encoded := make([]byte, 0, len(keyFilePrefix)+len(key))
+	encoded = append(encoded, keyFilePrefix...)
+	for i := 0; i < len(key); i++ {
+		b := key[i]
+		if (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') || b == '-' {
+			encoded = append(encoded, b)
+		} else {
+			encoded = append(encoded, fmt.Sprintf("_%02x", b)...)
+		}
+	}
+	if len(encoded) > maxKeyFileNameLength {
+		sum := sha256.Sum256([]byte(key))
+		return keyHashPrefix + hex.EncodeToString(sum[:]), true
+	}
+	return string(encoded), false
 }
 
-func (s *keyValueStore) del(key string) (err error) {
-	os.Remove(s.getPath(key))
+// hashedKeyHeader is what a hashed key's file starts with
+func hashedKeyHeader(key string) []byte {
+	var length [binary.MaxVarintLen64]byte
+	return append(length[:binary.PutUvarint(length[:], uint64(len(key)))], key...)
+}
+
+// readHashedKey reads the key a hashed key's file starts with
+func readHashedKey(r *bufio.Reader) (key string, err error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return
+	}
+	if length > maxHashedKeyLength {
+		return "", errors.New(fmt.Sprint("Key length ", length, " is too long to be one"))
+	}
+	keyBytes := make([]byte, length)
+	_, err = io.ReadFull(r, keyBytes)
+	return string(keyBytes), err
+}
+
+// hashedFileKey returns the key stored in a hashed key's file
+func hashedFileKey(filePath string) (key string, err error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	return readHashedKey(bufio.NewReader(f))
+}
+
+func decodeKey(name string) (key string, err error) {
+	if !strings.HasPrefix(name, keyFilePrefix) {
+		return "", errors.New(fmt.Sprint("Not an encoded key: ", name))
+	}
+	name = name[len(keyFilePrefix):]
+	decoded := make([]byte, 0, len(name))
+	for i := 0; i < len(name); i++ {
+		if name[i] != '_' {
+			decoded = append(decoded, name[i])
+			continue
+		}
+		var b byte
+		if i+2 >= len(name) {
+			return "", errors.New(fmt.Sprint("Truncated escape in encoded key: ", name))
+		}
+		_, err = fmt.Sscanf(name[i+1:i+3], "%02x", &b)
+		if err != nil {
+			return "", errors.New(fmt.Sprint("Bad escape in encoded key: ", name))
+		}
+		decoded = append(decoded, b)
+		i += 2
+	}
+	return string(decoded), nil
+}
+
+// migrateLegacyKeys renames files from before keys were encoded, which used the raw key as the name
+func (s *keyValueStore) migrateLegacyKeys() (err error) {
+	markerPath := path.Join(s.basePath, keyEncodingMarker)
+	if _, err = os.Stat(markerPath); err == nil {
+		return nil
+	}
+
+	legacyPath := path.Join(s.basePath, legacyKeysDir)
+	migrationPath := path.Join(s.basePath, keyMigrationMarker)
+	if _, err = os.Stat(migrationPath); os.IsNotExist(err) {
+		err = s.moveAsideLegacyKeys(legacyPath)
+		if err != nil {
+			return
+		}
+		err = writeFileSync(migrationPath, nil)
+		if err != nil {
+			return
+		}
+		err = syncDir(s.basePath)
+	}
+	if err != nil {
+		return
+	}
+
+	files, err := ioutil.ReadDir(legacyPath)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		legacyFile := path.Join(legacyPath, file.Name())
+		name, hashed := encodeKey(file.Name())
+		if !hashed {
+			err = os.Rename(legacyFile, path.Join(s.basePath, name))
+			if err != nil {
+				return
+			}
+			continue
+		}
+		// A hashed key's file starts with the key, so the value is copied rather than renamed. Doing
+		// it again after a crash writes the same file.
+		value, err := ioutil.ReadFile(legacyFile)
+		if err != nil {
+			return err
+		}
+		err = s.put(file.Name(), value)
+		if err != nil {
+			return err
+		}
+		err = os.Remove(legacyFile)
+		if err != nil {
+			return err
+		}
+	}
+	err = writeFileSync(markerPath, nil)
+	if err != nil {
+		return
+	}
+	err = syncDir(s.basePath)
+	if err != nil {
+		return
+	}
+	// Only empty once every key was migrated
+	os.Remove(legacyPath)
+	return os.Remove(migrationPath)
+}
+
+func (s *keyValueStore) moveAsideLegacyKeys(legacyPath string) (err error) {
+	err = os.MkdirAll(legacyPath, 0777)
+	if err != nil {
+		return
+	}
+	files, err := ioutil.ReadDir(s.basePath)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		if file.Name() == legacyKeysDir {
+			continue
+		}
+		err = os.Rename(path.Join(s.basePath, file.Name()), path.Join(legacyPath, file.Name()))
+		if err != nil {
+			return
+		}
+	}
+	err = syncDir(legacyPath)
+	if err != nil {
+		return
+	}
+	return syncDir(s.basePath)
+}
+
+func (s *keyValueStore) removePartialWrites() (err error) {
+	files, err := ioutil.ReadDir(s.basePath)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), tempFilePrefix) {
+			logInfo("Removing partially written value", "file", file.Name())
+			err = os.Remove(path.Join(s.basePath, file.Name()))
+			if err != nil {
+				return
+			}
+		}
+	}
 	return nil
 }
 
-func (s *keyValueStore) get(key string) (value string, err error) {
-	bytes, err := ioutil.ReadFile(s.getPath(key))
+func (s *keyValueStore) getPath(key string) (p string, hashed bool) {
+	name, hashed := encodeKey(key)
+	return path.Join(s.basePath, name), hashed
+}
+
+// encodeValue frames a value and its content type for storage
+func encodeValue(value []byte, contentType string) []byte {
+	encoded := make([]byte, 0, len(valueHeader)+binary.MaxVarintLen64+len(contentType)+len(value))
+	encoded = append(encoded, valueHeader...)
+	var length [binary.MaxVarintLen64]byte
+	encoded = append(encoded, length[:binary.PutUvarint(length[:], uint64(len(contentType)))]...)
+	encoded = append(encoded, contentType...)
+	return append(encoded, value...)
+}
+
+// decodeValue splits a stored value into the value and its content type
+func decodeValue(stored []byte) (value []byte, contentType string) {
+	if !bytes.HasPrefix(stored, valueHeader) {
+		return stored, ""
+	}
+	rest := stored[len(valueHeader):]
+	length, n := binary.Uvarint(rest)
+	if n <= 0 || length > uint64(len(rest)-n) {
+		// Can't be one of ours, so it must be a legacy value that happens to start with the header
+		return stored, ""
+	}
+	rest = rest[n:]
+	return rest[length:], string(rest[:length])
+}
+
+func (s *keyValueStore) put(key string, value []byte) (err error) {
+	p, hashed := s.getPath(key)
+	temp, err := ioutil.TempFile(s.basePath, tempFilePrefix)
 	if err != nil {
 		return
 	}
-	value = string(bytes)
-	return
+	if hashed {
+		_, err = temp.Write(hashedKeyHeader(key))
+	}
+	if err == nil {
+		_, err = temp.Write(value)
+	}
+	if err == nil {
+		err = temp.Sync()
+	}
+	closeErr := temp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), p)
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		return
+	}
+	return syncDir(s.basePath)
+}
+
+// del succeeds if the key doesn't exist, but reports any other failure to remove it
+func (s *keyValueStore) del(key string) (err error) {
+	p, _ := s.getPath(key)
+	err = os.Remove(p)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return
+	}
+	return syncDir(s.basePath)
+}
+
+func (s *keyValueStore) get(key string) (value []byte, err error) {
+	p, hashed := s.getPath(key)
+	if !hashed {
+		return ioutil.ReadFile(p)
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	storedKey, err := readHashedKey(r)
+	if err != nil {
+		return nil, errors.New(fmt.Sprint("Bad key in ", p, ": ", err))
+	}
+	if storedKey != key {
+		return nil, errors.New(fmt.Sprint("Key ", p, " holds a different key with the same hash"))
+	}
+	return ioutil.ReadAll(r)
 }
 
 func (s *keyValueStore) list() (keys []string, err error) {
@@ -48,9 +370,84 @@ func (s *keyValueStore) list() (keys []string, err error) {
 	if err != nil {
 		return nil, err
 	}
-	keys = make([]string, len(files))
-	for i, file := range files {
-		keys[i] = file.Name()
+	keys = make([]string, 0, len(files))
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), keyHashPrefix) {
+			key, err := hashedFileKey(path.Join(s.basePath, file.Name()))
+			if os.IsNotExist(err) {
+				// Deleted since we listed the directory
+				continue
+			}
+			if err != nil {
+				return nil, errors.New(fmt.Sprint("Bad key in ", path.Join(s.basePath, file.Name()), ": ", err))
+			}
+			keys = append(keys, key)
+			continue
+		}
+		key, err := decodeKey(file.Name())
+		if err != nil {
+			// Not one of our keys, like the encoding marker
+			continue
+		}
+		keys = append(keys, key)
 	}
 	return keys, nil
 }
+
+func (s *keyValueStore) iterate(f func(key string, value []byte) error) (err error) {
+	keys, err := s.list()
+	if err != nil {
+		return
+	}
+	for _, key := range keys {
+		value, err := s.get(key)
+		if os.IsNotExist(err) {
+			// Deleted since we listed it
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = f(key, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// batch writes one file per op, so a crash can leave only some of them applied
+func (s *keyValueStore) batch(ops []storeOp) error {
+	return applyBatch(s, ops)
+}
+
+func writeFileSync(filePath string, data []byte) (err error) {
+	f, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0777)
+	if err != nil {
+		return
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return
+}
+
+// syncDir makes file creations, renames and removals in a directory durable. Windows can't open a
+// directory to sync it, but its file system journals those changes anyway.
+func syncDir(dirPath string) (err error) {
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		return
+	}
+	defer dir.Close()
+	err = dir.Sync()
+	if err != nil && os.PathSeparator == '\\' {
+		return nil
+	}
+	return
+}
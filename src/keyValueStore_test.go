@@ -3,8 +3,11 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	. "launchpad.net/gocheck"
 	"os"
+	"path"
+	"strings"
 )
 
 var testDbPath = "./test.db"
@@ -35,7 +38,7 @@ func (s *KeyValueStoreSuite) TestDeleteNonexistent(c *C) {
 
 func (s *KeyValueStoreSuite) TestKeyValueStoreAll(c *C) {
 	store := newKeyValueStore(testDbPath)
-	err := store.put("foo", "bar")
+	err := store.put("foo", []byte("bar"))
 	if err != nil {
 		c.Fatal("Failed to put:", err)
 	}
@@ -45,7 +48,7 @@ func (s *KeyValueStoreSuite) TestKeyValueStoreAll(c *C) {
 		c.Fatal("Failed to get:", err)
 	}
 
-	c.Assert(val, Equals, "bar")
+	c.Assert(string(val), Equals, "bar")
 
 	err = store.del("foo")
 	if err != nil {
@@ -64,7 +67,7 @@ func (s *KeyValueStoreSuite) TestKeyValueStoreMultiple(c *C) {
 
 	for i := 0; i < count; i += 1 {
 		key := fmt.Sprintf("key%v", i)
-		val := fmt.Sprintf("val%v", i)
+		val := []byte(fmt.Sprintf("val%v", i))
 		err := store.put(key, val)
 		if err != nil {
 			c.Fatal("Failed to put:", err)
@@ -79,7 +82,7 @@ func (s *KeyValueStoreSuite) TestKeyValueStoreMultiple(c *C) {
 			c.Fatal("Failed to get:", err)
 		}
 
-		c.Assert(v, Equals, val)
+		c.Assert(string(v), Equals, val)
 	}
 }
 
@@ -88,7 +91,7 @@ func (s *KeyValueStoreSuite) TestList(c *C) {
 	const count = 10
 
 	for i := 0; i < count; i += 1 {
-		store.put(fmt.Sprintf("key%v", i), fmt.Sprintf("val%v", i))
+		store.put(fmt.Sprintf("key%v", i), []byte(fmt.Sprintf("val%v", i)))
 	}
 
 	keys, err := store.list()
@@ -103,11 +106,203 @@ func (s *KeyValueStoreSuite) TestList(c *C) {
 	}
 }
 
+func (s *KeyValueStoreSuite) TestArbitraryKeys(c *C) {
+	store := newKeyValueStore(testDbPath)
+	keys := []string{"", ".", "..", "a/b", "../escape", "NUL", "con.txt", "x\x00y", "Foo", "foo", "tx__key", "k_41"}
+
+	for i, key := range keys {
+		err := store.put(key, []byte(fmt.Sprint("val", i)))
+		if err != nil {
+			c.Fatal("Failed to put ", key, ": ", err)
+		}
+	}
+
+	for i, key := range keys {
+		val, err := store.get(key)
+		if err != nil {
+			c.Fatal("Failed to get ", key, ": ", err)
+		}
+		c.Assert(string(val), Equals, fmt.Sprint("val", i))
+	}
+
+	listed, err := store.list()
+	if err != nil {
+		c.Fatal("Failed to list:", err)
+	}
+	c.Assert(listed, HasLen, len(keys))
+	found := make(map[string]bool)
+	for _, key := range listed {
+		found[key] = true
+	}
+	for _, key := range keys {
+		c.Assert(found[key], Equals, true)
+	}
+}
+
+func (s *KeyValueStoreSuite) TestLongMixedCaseKeys(c *C) {
+	store := newKeyValueStore(testDbPath)
+	// Uppercase letters take three bytes each once encoded, which is too long for a file name
+	long := strings.Repeat("LongMixedCaseKey/", 10)
+	longer := long + "2"
+	c.Assert(store.put(long, []byte("a")), IsNil)
+	c.Assert(store.put(longer, []byte("b")), IsNil)
+	c.Assert(store.put("short", []byte("c")), IsNil)
+
+	val, err := store.get(long)
+	c.Assert(err, IsNil)
+	c.Assert(string(val), Equals, "a")
+	val, err = store.get(longer)
+	c.Assert(err, IsNil)
+	c.Assert(string(val), Equals, "b")
+	keys, err := store.list()
+	c.Assert(err, IsNil)
+	c.Assert(keys, HasLen, 3)
+	found := make(map[string]bool)
+	for _, key := range keys {
+		found[key] = true
+	}
+	c.Assert(found[long] && found[longer] && found["short"], Equals, true)
+
+	c.Assert(store.del(long), IsNil)
+	_, err = store.get(long)
+	c.Assert(os.IsNotExist(err), Equals, true)
+	val, err = store.get(longer)
+	c.Assert(err, IsNil)
+	c.Assert(string(val), Equals, "b")
+}
+
+func (s *KeyValueStoreSuite) TestLongLegacyKeysAreMigrated(c *C) {
+	c.Assert(os.MkdirAll(testDbPath, 0777), IsNil)
+	long := strings.Repeat("Legacy", 30)
+	c.Assert(ioutil.WriteFile(path.Join(testDbPath, long), []byte("old"), 0777), IsNil)
+
+	store := newKeyValueStore(testDbPath)
+	val, err := store.get(long)
+	c.Assert(err, IsNil)
+	c.Assert(string(val), Equals, "old")
+	keys, err := store.list()
+	c.Assert(err, IsNil)
+	c.Assert(keys, DeepEquals, []string{long})
+	_, err = os.Stat(path.Join(testDbPath, legacyKeysDir))
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (s *KeyValueStoreSuite) TestLegacyKeysAreMigrated(c *C) {
+	err := os.MkdirAll(testDbPath, 0777)
+	if err != nil {
+		c.Fatal(err)
+	}
+	err = ioutil.WriteFile(path.Join(testDbPath, "legacy"), []byte("old"), 0777)
+	if err != nil {
+		c.Fatal(err)
+	}
+
+	store := newKeyValueStore(testDbPath)
+	val, err := store.get("legacy")
+	c.Assert(err, IsNil)
+	c.Assert(string(val), Equals, "old")
+
+	// Reopening must not encode the keys a second time
+	store = newKeyValueStore(testDbPath)
+	keys, err := store.list()
+	c.Assert(err, IsNil)
+	c.Assert(keys, DeepEquals, []string{"legacy"})
+}
+
+func (s *KeyValueStoreSuite) TestLegacyKeysThatLookEncodedAreMigrated(c *C) {
+	err := os.MkdirAll(testDbPath, 0777)
+	c.Assert(err, IsNil)
+	// "foo" encodes to the name of the other legacy key
+	c.Assert(ioutil.WriteFile(path.Join(testDbPath, "foo"), []byte("a"), 0777), IsNil)
+	c.Assert(ioutil.WriteFile(path.Join(testDbPath, "kfoo"), []byte("b"), 0777), IsNil)
+
+	store := newKeyValueStore(testDbPath)
+	keys, err := store.list()
+	c.Assert(err, IsNil)
+	c.Assert(keys, DeepEquals, []string{"foo", "kfoo"})
+	val, err := store.get("kfoo")
+	c.Assert(err, IsNil)
+	c.Assert(string(val), Equals, "b")
+}
+
+func (s *KeyValueStoreSuite) TestInterruptedMigrationCarriesOn(c *C) {
+	// A crash after "foo" got its encoded name, but before "kfoo" did
+	err := os.MkdirAll(path.Join(testDbPath, legacyKeysDir), 0777)
+	c.Assert(err, IsNil)
+	c.Assert(ioutil.WriteFile(path.Join(testDbPath, keyMigrationMarker), nil, 0777), IsNil)
+	c.Assert(ioutil.WriteFile(path.Join(testDbPath, "kfoo"), []byte("a"), 0777), IsNil)
+	c.Assert(ioutil.WriteFile(path.Join(testDbPath, legacyKeysDir, "kfoo"), []byte("b"), 0777), IsNil)
+
+	store := newKeyValueStore(testDbPath)
+	val, err := store.get("foo")
+	c.Assert(err, IsNil)
+	c.Assert(string(val), Equals, "a")
+	val, err = store.get("kfoo")
+	c.Assert(err, IsNil)
+	c.Assert(string(val), Equals, "b")
+	_, err = os.Stat(path.Join(testDbPath, legacyKeysDir))
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (s *KeyValueStoreSuite) TestBinaryValues(c *C) {
+	store := newKeyValueStore(testDbPath)
+	value := []byte{0, 1, 2, 0xff, '\n', '\r', 0}
+	err := store.put("binary", encodeValue(value, "application/octet-stream"))
+	c.Assert(err, IsNil)
+
+	stored, err := store.get("binary")
+	c.Assert(err, IsNil)
+	decoded, contentType := decodeValue(stored)
+	c.Assert(decoded, DeepEquals, value)
+	c.Assert(contentType, Equals, "application/octet-stream")
+}
+
+func (s *KeyValueStoreSuite) TestValuesWithoutContentType(c *C) {
+	decoded, contentType := decodeValue(encodeValue(nil, ""))
+	c.Assert(decoded, HasLen, 0)
+	c.Assert(contentType, Equals, "")
+
+	// Values written before content types were stored have no header
+	decoded, contentType = decodeValue([]byte("legacy"))
+	c.Assert(string(decoded), Equals, "legacy")
+	c.Assert(contentType, Equals, "")
+}
+
+func (s *KeyValueStoreSuite) TestPartialWritesAreRemoved(c *C) {
+	store := newKeyValueStore(testDbPath)
+	err := store.put("foo", []byte("bar"))
+	c.Assert(err, IsNil)
+	// What a crash in the middle of a put leaves behind
+	err = ioutil.WriteFile(path.Join(testDbPath, tempFilePrefix+"123"), []byte("ba"), 0777)
+	c.Assert(err, IsNil)
+
+	store = newKeyValueStore(testDbPath)
+	files, err := ioutil.ReadDir(testDbPath)
+	c.Assert(err, IsNil)
+	for _, file := range files {
+		c.Assert(strings.HasPrefix(file.Name(), tempFilePrefix), Equals, false)
+	}
+	val, err := store.get("foo")
+	c.Assert(err, IsNil)
+	c.Assert(string(val), Equals, "bar")
+}
+
+func (s *KeyValueStoreSuite) TestDelReportsErrors(c *C) {
+	store := newKeyValueStore(testDbPath)
+	// A non-empty directory where the key's file should be can't be removed
+	p, _ := store.getPath("stuck")
+	err := os.MkdirAll(path.Join(p, "inside"), 0777)
+	c.Assert(err, IsNil)
+
+	err = store.del("stuck")
+	c.Assert(err, NotNil)
+}
+
 func (s *KeyValueStoreSuite) BenchmarkKeyValueStorePut(c *C) {
 	store := newKeyValueStore(testDbPath)
 	for i := 0; i < c.N; i++ {
 		key := fmt.Sprintf("key%v", i)
-		val := fmt.Sprintf("val%v", i)
+		val := []byte(fmt.Sprintf("val%v", i))
 		err := store.put(key, val)
 		if err != nil {
 			c.Fatal("Failed to put:", err)
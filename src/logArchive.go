@@ -0,0 +1,179 @@
+package main
+
+import (
+	"time"
+)
+
+// A node archives a log segment once recovery could no longer need any of its transactions. That is
+// never the case while a transaction is undecided. A committed transaction is needed by its
+// coordinator until every participant has acknowledged the commit, since recovery resends it; an
+// aborted one is not, because participants presume abort for a transaction the coordinator has
+// forgotten. A participant, be it a replica or a subordinate master, keeps a finished transaction
+// until its coordinator has forgotten it, so that a resent decision never finds it gone. A master
+// also keeps the segment with its latest commit sequence number, which recovery carries on from.
+//
+// Once a segment is archived its transactions are forgotten, unless they still show up in a segment
+// that isn't, which keeps what a node knows the same across restarts.
+const logArchiveInterval = time.Minute
+
+func archiveLoop(archive func() error) {
+	for {
+		time.Sleep(logArchiveInterval)
+		err := archive()
+		if err != nil {
+			logError("Unable to archive log", "error", err)
+		}
+	}
+}
+
+// coordinatorsForgot asks each transaction's coordinator about it, and reports whether they all
+// answered that they don't know it
+func coordinatorsForgot(coordinators map[string]string) bool {
+	clients := make(map[string]*MasterClient)
+	for txId, coordinator := range coordinators {
+		client, ok := clients[coordinator]
+		if !ok {
+			client = NewMasterClient(coordinator)
+			clients[coordinator] = client
+		}
+		state, err := client.Status(txId)
+		if err != nil || *state != NoState {
+			return false
+		}
+	}
+	return true
+}
+
+// archiveLog archives l's unneeded segments, and returns the ids of the transactions in them
+func archiveLog(l *logger, node NodeConfig, needed func(entries []logEntry) bool) (txIds []string, err error) {
+	var candidates []string
+	archived, err := l.archive(node.ArchiveDir, node.CompressArchive, func(entries []logEntry) bool {
+		if needed(entries) {
+			return true
+		}
+		for _, e := range entries {
+			candidates = append(candidates, e.txId)
+		}
+		return false
+	})
+	if err != nil || len(archived) == 0 {
+		return
+	}
+	logInfo("Archived log segments", "segments", archived, "archiveDir", node.ArchiveDir)
+	return candidates, nil
+}
+
+// unlogged returns the transactions that no longer appear in the log
+func unlogged(l *logger, txIds []string) (gone []string, err error) {
+	entries, err := l.read()
+	if err != nil {
+		return
+	}
+	live := make(map[string]bool)
+	for _, e := range entries {
+		live[e.txId] = true
+	}
+	for _, txId := range txIds {
+		if !live[txId] {
+			gone = append(gone, txId)
+		}
+	}
+	return
+}
+
+func (m *Master) archiveLog() error {
+	txIds, err := archiveLog(m.log, m.node, m.logEntriesNeeded)
+	if err != nil || len(txIds) == 0 {
+		return err
+	}
+	gone, err := unlogged(m.log, txIds)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, txId := range gone {
+		delete(m.txs, txId)
+		delete(m.participants, txId)
+		delete(m.acked, txId)
+		delete(m.superiors, txId)
+	}
+	return nil
+}
+
+func (m *Master) logEntriesNeeded(entries []logEntry) bool {
+	superiors := make(map[string]string)
+	m.mu.Lock()
+	for _, e := range entries {
+		switch e.txId {
+		case killedSelfMarker, firstRestartAfterSuicideMarker:
+			if m.didSuicide {
+				m.mu.Unlock()
+				return true
+			}
+			continue
+		}
+		if e.coordinator != "" {
+			superiors[e.txId] = e.coordinator
+		}
+		// Recovery picks up the commit sequence where the live log leaves it
+		if e.seq > 0 && e.seq == m.seq {
+			m.mu.Unlock()
+			return true
+		}
+		state, ok := m.txs[e.txId]
+		if ok && (state == Started || state == Prepared || (state == Committed && !m.acked[e.txId])) {
+			m.mu.Unlock()
+			return true
+		}
+	}
+	m.mu.Unlock()
+	return !coordinatorsForgot(superiors)
+}
+
+func (r *Replica) archiveLog() error {
+	txIds, err := archiveLog(r.log, r.cluster.Replicas[r.num], r.logEntriesNeeded)
+	if err != nil || len(txIds) == 0 {
+		return err
+	}
+	gone, err := unlogged(r.log, txIds)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, txId := range gone {
+		delete(r.txs, txId)
+	}
+	return nil
+}
+
+func (r *Replica) logEntriesNeeded(entries []logEntry) bool {
+	coordinators := make(map[string]string)
+	r.mu.Lock()
+	for _, e := range entries {
+		switch e.txId {
+		case killedSelfMarker, firstRestartAfterSuicideMarker:
+			if r.didSuicide {
+				r.mu.Unlock()
+				return true
+			}
+			continue
+		}
+		tx, ok := r.txs[e.txId]
+		if !ok {
+			continue
+		}
+		if tx.state != Committed && tx.state != Aborted {
+			r.mu.Unlock()
+			return true
+		}
+		// Logs from before coordinators were recorded only ever had the one master
+		coordinators[e.txId] = tx.coordinator
+		if tx.coordinator == "" {
+			coordinators[e.txId] = r.cluster.Master.Address
+		}
+	}
+	r.mu.Unlock()
+	return !coordinatorsForgot(coordinators)
+}
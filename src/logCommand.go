@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	flag "github.com/ogier/pflag"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// nodeLog is the entries of one master's or replica's log
+type nodeLog struct {
+	node    string
+	entries []logEntry
+}
+
+// logFilter picks the entries to show, an empty field matching everything. Entries without a
+// time, like those of CSV logs, never match a time range.
+type logFilter struct {
+	txId  string
+	key   string
+	state TxState
+	since time.Time
+	until time.Time
+}
+
+// logLine is one entry of one node's log, as printed by the log command
+type logLine struct {
+	Node          string
+	Time          string
+	TxId          string
+	State         string
+	Op            string
+	Key           string
+	Participants  []int
+	Coordinator   string
+	CoordinatorId string
+	Seq           uint64 `json:",omitempty"`
+
+	time time.Time
+}
+
+// logCommand implements "log": it prints the entries of the cluster's logs, or of the logs given
+// as arguments, merged in time order
+func logCommand(args []string) {
+	flags := flag.NewFlagSet("log", flag.ExitOnError)
+	configPath := flags.StringP("config", "c", "", "cluster config file (JSON) whose logs to read")
+	replicaCount := flags.IntP("replicaCount", "n", 0, "replica count, required without a cluster config")
+	txId := flags.String("tx", "", "only show this transaction, along with a summary of how it went on every node")
+	key := flags.String("key", "", "only show entries for this key")
+	state := flags.String("state", "", "only show entries in this state: STARTED, PREPARED, COMMITTED or ABORTED")
+	since := flags.String("since", "", "only show entries written at or after this time (RFC 3339)")
+	until := flags.String("until", "", "only show entries written before this time (RFC 3339)")
+	asJSON := flags.Bool("json", false, "print one JSON object per entry")
+	flags.Parse(args)
+
+	filter, err := parseLogFilter(*txId, *key, *state, *since, *until)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	paths := flags.Args()
+	if len(paths) == 0 {
+		cluster := loadCommandCluster(*configPath, *replicaCount)
+		for _, n := range append(cluster.coordinators(), cluster.Replicas...) {
+			paths = append(paths, n.LogPath)
+		}
+	}
+
+	logs, err := readNodeLogs(paths)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	lines := queryLogs(logs, filter)
+	err = printLogLines(os.Stdout, lines, *asJSON)
+	if err == nil && filter.txId != "" && !*asJSON {
+		err = printLifecycle(os.Stdout, logs, lines)
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func parseLogFilter(txId string, key string, state string, since string, until string) (filter logFilter, err error) {
+	filter.txId = txId
+	filter.key = key
+	if state != "" {
+		filter.state = ParseTxState(strings.ToUpper(state))
+		if filter.state == NoState {
+			return filter, errors.New(fmt.Sprint("Unknown state: ", state))
+		}
+	}
+	if since != "" {
+		filter.since, err = time.Parse(time.RFC3339, since)
+		if err != nil {
+			return
+		}
+	}
+	if until != "" {
+		filter.until, err = time.Parse(time.RFC3339, until)
+	}
+	return
+}
+
+func (f logFilter) match(e logEntry) bool {
+	switch {
+	case f.txId != "" && e.txId != f.txId:
+		return false
+	case f.key != "" && e.key != f.key:
+		return false
+	case f.state != NoState && e.state != f.state:
+		return false
+	case (!f.since.IsZero() || !f.until.IsZero()) && e.time.IsZero():
+		return false
+	case !f.since.IsZero() && e.time.Before(f.since):
+		return false
+	case !f.until.IsZero() && !e.time.Before(f.until):
+		return false
+	}
+	return true
+}
+
+// readNodeLogs reads each log without changing it, naming the node after the log's file name
+func readNodeLogs(paths []string) (logs []nodeLog, err error) {
+	for _, p := range paths {
+		l, err := openLog(p)
+		if err != nil {
+			return nil, err
+		}
+		entries, err := l.read()
+		if err != nil {
+			return nil, err
+		}
+		logs = append(logs, nodeLog{strings.TrimSuffix(path.Base(p), path.Ext(p)), entries})
+	}
+	return
+}
+
+// queryLogs returns the matching entries of every log. They are merged in time order when every one
+// has a time, and otherwise listed log by log.
+func queryLogs(logs []nodeLog, filter logFilter) (lines []logLine) {
+	timed := true
+	for _, l := range logs {
+		for _, e := range l.entries {
+			if !filter.match(e) {
+				continue
+			}
+			line := logLine{l.node, "", e.txId, e.state.String(), e.op.String(), e.key, e.participants, e.coordinator, e.coordinatorId, e.seq, e.time}
+			if e.time.IsZero() {
+				timed = false
+			} else {
+				line.Time = e.time.UTC().Format(time.RFC3339Nano)
+			}
+			lines = append(lines, line)
+		}
+	}
+	if timed {
+		sort.Stable(logLinesByTime(lines))
+	}
+	return
+}
+
+type logLinesByTime []logLine
+
+func (l logLinesByTime) Len() int           { return len(l) }
+func (l logLinesByTime) Less(i, j int) bool { return l[i].time.Before(l[j].time) }
+func (l logLinesByTime) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+func printLogLines(w io.Writer, lines []logLine, asJSON bool) error {
+	if asJSON {
+		encoder := json.NewEncoder(w)
+		for _, line := range lines {
+			err := encoder.Encode(line)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, line := range lines {
+		_, err := fmt.Fprintln(w, formatLogLine(line))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func formatLogLine(line logLine) string {
+	t := line.Time
+	if t == "" {
+		t = "-"
+	}
+	s := fmt.Sprintf("%-30s %-10s %-9s %-9s %s", t, line.Node, line.State, line.Op, line.TxId)
+	if line.Key != "" {
+		s += fmt.Sprintf(" key=%q", line.Key)
+	}
+	if len(line.Participants) > 0 {
+		s += " participants=" + formatParticipants(line.Participants)
+	}
+	if line.Seq > 0 {
+		s += fmt.Sprint(" seq=", line.Seq)
+	}
+	if line.CoordinatorId != "" {
+		s += " coordinator=" + line.CoordinatorId + "@" + line.Coordinator
+	} else if line.Coordinator != "" {
+		s += " coordinator=" + line.Coordinator
+	}
+	return s
+}
+
+// printLifecycle sums up how one transaction went on each node: the states it went through, in
+// order, or that the node never heard of it
+func printLifecycle(w io.Writer, logs []nodeLog, lines []logLine) error {
+	states := make(map[string][]string)
+	for _, line := range lines {
+		states[line.Node] = append(states[line.Node], line.State)
+	}
+	_, err := fmt.Fprintln(w)
+	for _, l := range logs {
+		if err != nil {
+			return err
+		}
+		if s, ok := states[l.node]; ok {
+			_, err = fmt.Fprintf(w, "%-10s %s\n", l.node, strings.Join(s, " -> "))
+		} else {
+			_, err = fmt.Fprintf(w, "%-10s %s\n", l.node, "not involved")
+		}
+	}
+	return err
+}
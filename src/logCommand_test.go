@@ -0,0 +1,123 @@
+// +build !goci
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	. "launchpad.net/gocheck"
+	"os"
+	"strings"
+	"time"
+)
+
+type LogCommandSuite struct{}
+
+var _ = Suite(&LogCommandSuite{})
+
+func (s *LogCommandSuite) TearDownTest(c *C) {
+	os.RemoveAll("./test.logs")
+}
+
+var testStart = time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// writeTestLogs writes tx1 committing on both replicas, and tx2 aborting on the first one
+func writeTestLogs(c *C) []nodeLog {
+	master := newLogger("./test.logs/master.txt", WalLogFormat, syncDurability)
+	r0 := newLogger("./test.logs/replica0.txt", WalLogFormat, syncDurability)
+	r1 := newLogger("./test.logs/replica1.txt", WalLogFormat, syncDurability)
+	at := func(seconds int) time.Time {
+		return testStart.Add(time.Duration(seconds) * time.Second)
+	}
+	master.writeEntry(logEntry{"tx1", Started, NoOp, "", []int{0, 1}, "", "", at(0), 0, nil})
+	r1.writeEntry(logEntry{"tx1", Prepared, PutOp, "foo", []int{0, 1}, "localhost:7170", "master", at(1), 0, nil})
+	r0.writeEntry(logEntry{"tx1", Prepared, PutOp, "foo", []int{0, 1}, "localhost:7170", "master", at(2), 0, nil})
+	master.writeEntry(logEntry{"tx1", Committed, NoOp, "", nil, "", "", at(3), 0, nil})
+	r0.writeEntry(logEntry{"tx1", Committed, NoOp, "", nil, "", "", at(4), 0, nil})
+	r1.writeEntry(logEntry{"tx1", Committed, NoOp, "", nil, "", "", at(5), 0, nil})
+	master.writeEntry(logEntry{"tx2", Started, NoOp, "", []int{0}, "", "", at(6), 0, nil})
+	r0.writeEntry(logEntry{"tx2", Prepared, DelOp, "bar", []int{0}, "localhost:7170", "master", at(7), 0, nil})
+	master.writeEntry(logEntry{"tx2", Aborted, NoOp, "", nil, "", "", at(8), 0, nil})
+	r0.writeEntry(logEntry{"tx2", Aborted, NoOp, "", nil, "", "", at(9), 0, nil})
+
+	logs, err := readNodeLogs([]string{"./test.logs/master.txt", "./test.logs/replica0.txt", "./test.logs/replica1.txt"})
+	c.Assert(err, IsNil)
+	return logs
+}
+
+func nodesAndStates(lines []logLine) (s []string) {
+	for _, line := range lines {
+		s = append(s, line.Node+" "+line.State)
+	}
+	return
+}
+
+func (s *LogCommandSuite) TestLogsAreMergedInTimeOrder(c *C) {
+	lines := queryLogs(writeTestLogs(c), logFilter{})
+	c.Assert(lines, HasLen, 10)
+	c.Assert(nodesAndStates(lines[:4]), DeepEquals, []string{"master STARTED", "replica1 PREPARED", "replica0 PREPARED", "master COMMITTED"})
+}
+
+func (s *LogCommandSuite) TestFilters(c *C) {
+	logs := writeTestLogs(c)
+
+	filter, err := parseLogFilter("", "bar", "", "", "")
+	c.Assert(err, IsNil)
+	c.Assert(nodesAndStates(queryLogs(logs, filter)), DeepEquals, []string{"replica0 PREPARED"})
+
+	filter, err = parseLogFilter("", "", "aborted", "", "")
+	c.Assert(err, IsNil)
+	c.Assert(nodesAndStates(queryLogs(logs, filter)), DeepEquals, []string{"master ABORTED", "replica0 ABORTED"})
+
+	filter, err = parseLogFilter("", "", "", "2014-01-01T00:00:03Z", "2014-01-01T00:00:05Z")
+	c.Assert(err, IsNil)
+	c.Assert(nodesAndStates(queryLogs(logs, filter)), DeepEquals, []string{"master COMMITTED", "replica0 COMMITTED"})
+
+	_, err = parseLogFilter("", "", "DONE", "", "")
+	c.Assert(err, ErrorMatches, "Unknown state: DONE")
+}
+
+func (s *LogCommandSuite) TestLifecycleOfOneTransaction(c *C) {
+	logs := writeTestLogs(c)
+	filter, err := parseLogFilter("tx2", "", "", "", "")
+	c.Assert(err, IsNil)
+	lines := queryLogs(logs, filter)
+
+	var out bytes.Buffer
+	c.Assert(printLogLines(&out, lines, false), IsNil)
+	c.Assert(printLifecycle(&out, logs, lines), IsNil)
+	printed := strings.Split(strings.TrimSpace(out.String()), "\n")
+	c.Assert(printed, HasLen, 8)
+	c.Assert(printed[1], Matches, `2014-01-01T00:00:07Z +replica0 +PREPARED +DEL +tx2 key="bar" participants=0 coordinator=master@localhost:7170`)
+	c.Assert(printed[5], Matches, "master +STARTED -> ABORTED")
+	c.Assert(printed[6], Matches, "replica0 +PREPARED -> ABORTED")
+	c.Assert(printed[7], Matches, "replica1 +not involved")
+}
+
+func (s *LogCommandSuite) TestJson(c *C) {
+	logs := writeTestLogs(c)
+	filter, err := parseLogFilter("tx1", "", "PREPARED", "", "")
+	c.Assert(err, IsNil)
+
+	var out bytes.Buffer
+	c.Assert(printLogLines(&out, queryLogs(logs, filter), true), IsNil)
+	decoder := json.NewDecoder(&out)
+	var line logLine
+	c.Assert(decoder.Decode(&line), IsNil)
+	c.Assert(line.Node, Equals, "replica1")
+	c.Assert(line.Key, Equals, "foo")
+	c.Assert(line.Participants, DeepEquals, []int{0, 1})
+	c.Assert(line.Time, Equals, "2014-01-01T00:00:01Z")
+}
+
+func (s *LogCommandSuite) TestReadingLeavesTheLogAlone(c *C) {
+	l := newLogger(testLogPath, WalLogFormat, syncDurability)
+	l.writeState("tx1", Started)
+	appendToLog(c, l, []byte{0, 0, 0, 9})
+	size := logSize(c, l)
+
+	logs, err := readNodeLogs([]string{testLogPath})
+	c.Assert(err, IsNil)
+	c.Assert(logs[0].node, Equals, "log")
+	c.Assert(logs[0].entries, HasLen, 1)
+	c.Assert(logSize(c, l), Equals, size)
+}
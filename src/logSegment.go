@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A log is split into segments that sit next to where the log's path points, numbered from 1:
+// logs/master.txt is written as logs/master.000000001.txt, logs/master.000000002.txt and so on.
+// Each segment starts with the format's header, and once the active one reaches logSegmentSize the
+// next record starts a new one. Segments whose records recovery no longer needs can be moved to an
+// archive directory, gzipped if asked to, where they keep their names plus a .gz suffix.
+const logSegmentSize = 16 << 20
+
+const segmentSeqDigits = 9
+
+const compressedSuffix = ".gz"
+
+func segmentPath(logFilePath string, seq int) string {
+	ext := path.Ext(logFilePath)
+	return fmt.Sprintf("%s.%0*d%s", strings.TrimSuffix(logFilePath, ext), segmentSeqDigits, seq, ext)
+}
+
+// parseSegmentName returns the sequence number of a file named like a segment of the log, which may
+// be compressed if it was archived
+func parseSegmentName(logFilePath string, name string) (seq int, compressed bool, ok bool) {
+	ext := path.Ext(logFilePath)
+	prefix := strings.TrimSuffix(path.Base(logFilePath), ext) + "."
+	if !strings.HasPrefix(name, prefix) {
+		return
+	}
+	rest := name[len(prefix):]
+	if strings.HasSuffix(rest, compressedSuffix) {
+		rest = strings.TrimSuffix(rest, compressedSuffix)
+		compressed = true
+	}
+	if !strings.HasSuffix(rest, ext) {
+		return
+	}
+	digits := strings.TrimSuffix(rest, ext)
+	if len(digits) != segmentSeqDigits {
+		return
+	}
+	seq, err := strconv.Atoi(digits)
+	if err != nil {
+		return
+	}
+	return seq, compressed, true
+}
+
+// listSegments returns the sequence numbers of the log's segments in dir, oldest first
+func listSegments(dir string, logFilePath string) (seqs []int, err error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	for _, file := range files {
+		if seq, _, ok := parseSegmentName(logFilePath, file.Name()); ok && !file.IsDir() {
+			seqs = append(seqs, seq)
+		}
+	}
+	sort.Ints(seqs)
+	return
+}
+
+// openSegments brings every segment of a log to the given format and durability, and returns the
+// sequence number of the active one. A log from before segments is adopted as the first segment.
+func openSegments(logFilePath string, format logFormat, durability logDurability) (active int, err error) {
+	seqs, err := listSegments(path.Dir(logFilePath), logFilePath)
+	if err != nil {
+		return
+	}
+	if _, statErr := os.Stat(logFilePath); statErr == nil {
+		if len(seqs) > 0 {
+			return 0, errors.New(fmt.Sprint("Log ", logFilePath, " exists alongside its segments"))
+		}
+		logInfo("Making log its first segment", "path", logFilePath)
+		err = os.Rename(logFilePath, segmentPath(logFilePath, 1))
+		if err != nil {
+			return
+		}
+		err = syncDir(path.Dir(logFilePath))
+		if err != nil {
+			return
+		}
+		seqs = []int{1}
+	}
+	if len(seqs) == 0 {
+		seqs = []int{1}
+	}
+	for _, seq := range seqs {
+		err = convertLog(segmentPath(logFilePath, seq), format, durability)
+		if err != nil {
+			return
+		}
+	}
+	return seqs[len(seqs)-1], nil
+}
+
+// openLog opens a log only for reading, leaving it exactly as it is, which is safe even while its
+// node is running
+func openLog(logFilePath string) (l *logger, err error) {
+	seqs, err := listSegments(path.Dir(logFilePath), logFilePath)
+	if err != nil {
+		return
+	}
+	if len(seqs) == 0 {
+		return nil, errors.New(fmt.Sprint("Log ", logFilePath, " has no segments"))
+	}
+	data, err := ioutil.ReadFile(segmentPath(logFilePath, seqs[len(seqs)-1]))
+	if err != nil {
+		return
+	}
+	format := detectLogFormat(data)
+	if format == nil {
+		return nil, errors.New(fmt.Sprint("Log ", logFilePath, " is in an unknown format"))
+	}
+	return &logger{logFilePath, format, format.headerDurability(data), nil, seqs[len(seqs)-1], 0, nil, 0, 0, nil, sync.Mutex{}}, nil
+}
+
+// activePath is the segment new records go to
+func (l *logger) activePath() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return segmentPath(l.path, l.active)
+}
+
+// rotate starts the next segment. The finished one is synced first whatever the durability, so only
+// the active segment can ever end in a partly written record.
+func (l *logger) rotate() {
+	l.sync()
+	l.file.Close()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	next := segmentPath(l.path, l.active+1)
+	err := convertLog(next, l.format, l.durability)
+	if err != nil {
+		logFatal("Unable to start log segment", "path", next, "error", err)
+	}
+	l.file, err = os.OpenFile(next, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		logFatal("Unable to start log segment", "path", next, "error", err)
+	}
+	l.active++
+	l.size = int64(len(l.format.header(l.durability)))
+}
+
+// readSegment returns the complete records of one segment. Only the active segment may end in a
+// partly written record, which is cut off unless the log was opened with openLog.
+func (l *logger) readSegment(seq int, active bool) (records []logRecord, err error) {
+	segment := segmentPath(l.path, seq)
+	data, err := ioutil.ReadFile(segment)
+	if err != nil {
+		return
+	}
+	records, torn, err := l.format.decode(segment, data)
+	if err != nil || torn < 0 {
+		return
+	}
+	if !active {
+		return nil, errors.New(fmt.Sprint("Corrupt record in log ", segment, " at offset ", torn))
+	}
+	if l.file == nil {
+		return
+	}
+	logWarn("Truncating partly written record in log", "path", segment, "offset", torn)
+	err = os.Truncate(segment, int64(torn))
+	return
+}
+
+// archive moves the oldest segments to archiveDir for as long as needed reports that recovery no
+// longer needs any of a segment's entries. The active segment is never archived.
+func (l *logger) archive(archiveDir string, compress bool, needed func(entries []logEntry) bool) (archived []string, err error) {
+	l.mu.Lock()
+	active := l.active
+	l.mu.Unlock()
+	seqs, err := listSegments(path.Dir(l.path), l.path)
+	if err != nil {
+		return
+	}
+	for _, seq := range seqs {
+		if seq >= active {
+			break
+		}
+		records, err := l.readSegment(seq, false)
+		if err != nil {
+			return archived, err
+		}
+		if needed(recordEntries(records)) {
+			break
+		}
+		err = archiveSegment(segmentPath(l.path, seq), archiveDir, compress)
+		if err != nil {
+			return archived, err
+		}
+		archived = append(archived, segmentPath(l.path, seq))
+	}
+	return
+}
+
+// archiveSegment copies a segment into archiveDir and only then removes it, so a crash part way
+// leaves it in both places rather than in neither
+func archiveSegment(segment string, archiveDir string, compress bool) (err error) {
+	data, err := ioutil.ReadFile(segment)
+	if err != nil {
+		return
+	}
+	dest := path.Join(archiveDir, path.Base(segment))
+	if compress {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		w.Write(data)
+		err = w.Close()
+		if err != nil {
+			return
+		}
+		data = buf.Bytes()
+		dest += compressedSuffix
+	}
+
+	err = os.MkdirAll(archiveDir, 0777)
+	if err != nil {
+		return
+	}
+	temp := dest + ".tmp"
+	err = writeFileSync(temp, data)
+	if err != nil {
+		return
+	}
+	err = os.Rename(temp, dest)
+	if err != nil {
+		return
+	}
+	err = syncDir(archiveDir)
+	if err != nil {
+		return
+	}
+	err = os.Remove(segment)
+	if err != nil {
+		return
+	}
+	return syncDir(path.Dir(segment))
+}
+
+// readHistory returns the entries of every segment of the log, oldest first, the ones archived to
+// archiveDir included. An archived segment is read in whatever format it was written in.
+func (l *logger) readHistory(archiveDir string) (entries []logEntry, err error) {
+	live, err := listSegments(path.Dir(l.path), l.path)
+	if err != nil {
+		return
+	}
+	isLive := make(map[int]bool)
+	for _, seq := range live {
+		isLive[seq] = true
+	}
+
+	archived := make(map[int]string)
+	files, err := ioutil.ReadDir(archiveDir)
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+	for _, file := range files {
+		// A segment in both places was being archived when the node stopped
+		if seq, _, ok := parseSegmentName(l.path, file.Name()); ok && !file.IsDir() && !isLive[seq] {
+			archived[seq] = path.Join(archiveDir, file.Name())
+		}
+	}
+	seqs := append([]int{}, live...)
+	for seq := range archived {
+		seqs = append(seqs, seq)
+	}
+	sort.Ints(seqs)
+
+	for _, seq := range seqs {
+		var records []logRecord
+		if isLive[seq] {
+			records, err = l.readSegment(seq, len(live) > 0 && seq == live[len(live)-1])
+		} else {
+			records, err = readArchivedSegment(archived[seq])
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, recordEntries(records)...)
+	}
+	return entries, nil
+}
+
+func readArchivedSegment(segment string) (records []logRecord, err error) {
+	data, err := ioutil.ReadFile(segment)
+	if err != nil {
+		return
+	}
+	if strings.HasSuffix(segment, compressedSuffix) {
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		data, err = ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	format := detectLogFormat(data)
+	if format == nil {
+		return nil, errors.New(fmt.Sprint("Archived log ", segment, " is in an unknown format"))
+	}
+	records, torn, err := format.decode(segment, data)
+	if err == nil && torn >= 0 {
+		err = errors.New(fmt.Sprint("Corrupt record in archived log ", segment, " at offset ", torn))
+	}
+	return
+}
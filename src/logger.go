@@ -1,63 +1,380 @@
 package main
 
 import (
+	"bytes"
+	"encoding/base64"
 	"encoding/csv"
-	"log"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
+const (
+	WalLogFormat = "wal"
+	CsvLogFormat = "csv"
+)
+
+// Durability levels, from safest to fastest. With SyncDurability a write returns once its record is
+// on disk. GroupDurability returns once the record is handed to the OS and fsyncs every
+// syncInterval, so a power failure or OS crash loses at most the last syncInterval of records.
+// BufferedDurability never fsyncs and leaves it to the OS when records reach the disk. Every level
+// survives the process itself dying, since the OS still has the records.
+const (
+	SyncDurability     = "sync"
+	GroupDurability    = "group"
+	BufferedDurability = "buffered"
+)
+
+const defaultSyncInterval = 10 * time.Millisecond
+
+type logDurability struct {
+	level        string
+	syncInterval time.Duration
+}
+
+func (d logDurability) String() string {
+	if d.level == GroupDurability {
+		return fmt.Sprint(d.level, " every ", d.syncInterval)
+	}
+	return d.level
+}
+
+func checkDurability(level string) error {
+	switch level {
+	case SyncDurability, GroupDurability, BufferedDurability:
+		return nil
+	}
+	return errors.New(fmt.Sprint("Unknown durability: ", level, ", expected ", SyncDurability, ", ", GroupDurability, " or ", BufferedDurability))
+}
+
+// newDurability fills in the defaults for an empty level or interval
+func newDurability(level string, syncInterval time.Duration) logDurability {
+	if level == "" {
+		level = SyncDurability
+	}
+	if level != GroupDurability {
+		syncInterval = 0
+	} else if syncInterval <= 0 {
+		syncInterval = defaultSyncInterval
+	}
+	return logDurability{level, syncInterval}
+}
+
 type logEntry struct {
-	txId  string
-	state TxState
-	op    Operation
-	key   string
+	txId         string
+	state        TxState
+	op           Operation
+	key          string
+	participants []int
+	// coordinator is the address of the master deciding the transaction, coordinatorId its node id
+	coordinator   string
+	coordinatorId string
+	// time is when the entry was written, which only the WAL format keeps
+	time time.Time
+	// seq is the commit sequence number a coordinator gives each transaction it commits
+	seq uint64
+	// value is what a put stores, logged when it is prepared and again when it is committed, so that
+	// the commit can be redone from the log
+	value []byte
 }
 
 type logRequest struct {
-	record []string
-	done   chan int
+	data []byte
+	done chan int
 }
 
+// logger writes a log as a series of segments, see logSegment.go. path is the log's name, not a file.
 type logger struct {
-	path      string
-	file      *os.File
-	csvWriter *csv.Writer
-	requests  chan *logRequest
+	path       string
+	format     logFormat
+	durability logDurability
+	// file is the active segment, numbered active, of size bytes
+	file     *os.File
+	active   int
+	size     int64
+	requests chan *logRequest
+	// maxBatch caps how many records share one fsync, 1 turns group commit off
+	maxBatch    int
+	segmentSize int64
+	// fsyncs times each sync of the active segment
+	fsyncs *histogram
+	mu     sync.Mutex
+}
+
+const logMaxBatch = 1024
+
+// logFormat is one way of laying out a log file. A log starts with the format's header, and each
+// write appends one encoded record.
+type logFormat interface {
+	name() string
+	magic() []byte
+	// header starts a new log, recording the durability it is written with
+	header(d logDurability) []byte
+	// headerDurability returns the durability recorded in a log's header, with an empty level for
+	// logs from before it was recorded
+	headerDurability(data []byte) logDurability
+	encodeEntry(e logEntry) []byte
+	encodeFields(fields []string) []byte
+	// decode parses a whole log file. torn is the offset of a last record that a crash left partly
+	// written, or -1 if there is none.
+	decode(logFilePath string, data []byte) (records []logRecord, torn int, err error)
+}
+
+// wholeRecordAfter reports whether a whole record, as recognized by isRecord, starts anywhere in data
+// after its first byte. A record's length isn't covered by its checksum, so one running past the end
+// of the log is only a record a crash cut short if nothing whole follows it.
+func wholeRecordAfter(data []byte, isRecord func(data []byte) bool) bool {
+	for i := 1; i < len(data); i++ {
+		if isRecord(data[i:]) {
+			return true
+		}
+	}
+	return false
 }
 
-func newLogger(logFilePath string) *logger {
-	err := os.MkdirAll(path.Dir(logFilePath), 0)
-	file, err := os.OpenFile(logFilePath, os.O_APPEND|os.O_CREATE, 0)
+// logRecord is either a transaction entry or, for logs that hold something else and for every record
+// of a CSV log, a list of fields
+type logRecord struct {
+	entry  *logEntry
+	fields []string
+}
+
+func checkLogFormat(format string) error {
+	_, err := getLogFormat(format)
+	return err
+}
+
+func getLogFormat(format string) (logFormat, error) {
+	switch format {
+	case WalLogFormat:
+		return walFormat{}, nil
+	case CsvLogFormat:
+		return csvFormat{}, nil
+	}
+	return nil, errors.New(fmt.Sprint("Unknown log format: ", format, ", expected ", WalLogFormat, " or ", CsvLogFormat))
+}
+
+func newLogger(logFilePath string, format string, durability logDurability) *logger {
+	f, err := getLogFormat(format)
 	if err != nil {
-		log.Fatalln("newLogger:", err)
+		logFatal("Unable to open log", "path", logFilePath, "error", err)
+	}
+	err = os.MkdirAll(path.Dir(logFilePath), 0)
+	active, err := openSegments(logFilePath, f, durability)
+	if err != nil {
+		logFatal("Unable to open log", "path", logFilePath, "error", err)
+	}
+	file, err := os.OpenFile(segmentPath(logFilePath, active), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		logFatal("Unable to open log", "path", logFilePath, "error", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		logFatal("Unable to open log", "path", logFilePath, "error", err)
 	}
 
-	l := &logger{logFilePath, file, csv.NewWriter(file), make(chan *logRequest)}
+	l := &logger{logFilePath, f, durability, file, active, info.Size(), make(chan *logRequest, logMaxBatch), logMaxBatch, logSegmentSize, newHistogram(), sync.Mutex{}}
 
 	go l.loggingLoop()
 
 	return l
 }
 
+// detectLogFormat returns the format a log was written in, or nil for an empty log or one in the
+// plain CSV of older versions
+func detectLogFormat(data []byte) logFormat {
+	for _, f := range []logFormat{walFormat{}, csvFormat{}} {
+		if bytes.HasPrefix(data, f.magic()) {
+			return f
+		}
+	}
+	return nil
+}
+
+// readAnyLog reads a log in whatever format it was written in, without its partly written last record
+func readAnyLog(logFilePath string, data []byte) (records []logRecord, err error) {
+	if f := detectLogFormat(data); f != nil {
+		records, _, err = f.decode(logFilePath, data)
+		return
+	}
+	for _, f := range []logFormat{walFormat{}, csvFormat{}} {
+		if bytes.HasPrefix(f.magic(), data) {
+			// Empty, or the process died while creating it
+			return nil, nil
+		}
+	}
+
+	r := csv.NewReader(bytes.NewReader(data))
+	r.FieldsPerRecord = -1
+	fields, err := r.ReadAll()
+	if err != nil {
+		return nil, errors.New(fmt.Sprint("Unable to read log ", logFilePath, ": ", err))
+	}
+	for _, f := range fields {
+		records = append(records, logRecord{nil, f})
+	}
+	return
+}
+
+// convertLog creates a log, or rewrites an existing one that is in another format or whose header
+// records another durability
+func convertLog(logFilePath string, format logFormat, durability logDurability) (err error) {
+	data, err := ioutil.ReadFile(logFilePath)
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+	if f := detectLogFormat(data); f != nil && f.name() == format.name() {
+		recorded := f.headerDurability(data)
+		if recorded == durability {
+			return nil
+		}
+		logInfo("Log durability changed", "path", logFilePath, "durability", durability)
+	}
+
+	records, err := readAnyLog(logFilePath, data)
+	if err != nil {
+		return
+	}
+	converted := format.header(durability)
+	for _, record := range records {
+		converted = append(converted, encodeLogRecord(format, record)...)
+	}
+	if len(records) > 0 {
+		logInfo("Converting log", "path", logFilePath, "format", format.name())
+	}
+
+	temp := logFilePath + ".tmp"
+	err = writeFileSync(temp, converted)
+	if err != nil {
+		return
+	}
+	err = os.Rename(temp, logFilePath)
+	if err != nil {
+		return
+	}
+	return syncDir(path.Dir(logFilePath))
+}
+
+// migrateLogs converts every log under dir to the given format. The nodes using them must be stopped.
+func migrateLogs(dir string, format string) (converted []string, err error) {
+	f, err := getLogFormat(format)
+	if err != nil {
+		return
+	}
+	err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || filepath.Ext(p) != ".txt" {
+			return nil
+		}
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		durability := newDurability("", 0)
+		if detected := detectLogFormat(data); detected != nil {
+			if detected.name() == f.name() {
+				return nil
+			}
+			recorded := detected.headerDurability(data)
+			durability = newDurability(recorded.level, recorded.syncInterval)
+		}
+		err = convertLog(p, f, durability)
+		if err != nil {
+			return err
+		}
+		converted = append(converted, p)
+		return nil
+	})
+	return
+}
+
+func encodeLogRecord(format logFormat, record logRecord) []byte {
+	if record.entry != nil {
+		return format.encodeEntry(*record.entry)
+	}
+	return format.encodeFields(record.fields)
+}
+
+// loggingLoop does group commit: every request that queued up while the last fsync was running goes
+// out in a single write and fsync, and then all of their writers are released together. Below
+// SyncDurability, writers are released as soon as their batch is written, and fsyncs happen on a
+// timer or not at all.
 func (l *logger) loggingLoop() {
+	var tick <-chan time.Time
+	if l.durability.level == GroupDurability {
+		tick = time.NewTicker(l.durability.syncInterval).C
+	}
+	unsynced := false
+	var batch []*logRequest
+	var buf bytes.Buffer
 	for {
-		req := <-l.requests
-		err := l.csvWriter.Write(req.record)
-		if err != nil {
-			log.Fatalln("logger.write fatal:", err)
+		select {
+		case req := <-l.requests:
+			batch = append(batch[:0], req)
+		case <-tick:
+			if unsynced {
+				l.sync()
+				unsynced = false
+			}
+			continue
+		}
+	collect:
+		for len(batch) < l.maxBatch {
+			select {
+			case req := <-l.requests:
+				batch = append(batch, req)
+			default:
+				break collect
+			}
 		}
 
-		l.csvWriter.Flush()
-		err = l.file.Sync()
+		buf.Reset()
+		for _, req := range batch {
+			buf.Write(req.data)
+		}
+		_, err := l.file.Write(buf.Bytes())
 		if err != nil {
-			log.Fatalln("logger.write fatal:", err)
+			logFatal("Unable to write log", "path", l.path, "error", err)
+		}
+		l.size += int64(buf.Len())
+
+		if l.size >= l.segmentSize {
+			l.rotate()
+			unsynced = false
+		} else if l.durability.level == SyncDurability {
+			l.sync()
+		} else {
+			unsynced = true
 		}
-		req.done <- 1
+		for _, req := range batch {
+			req.done <- 1
+		}
+	}
+}
+
+func (l *logger) sync() {
+	defer l.fsyncs.since(time.Now())
+	err := l.file.Sync()
+	if err != nil {
+		logFatal("Unable to sync log", "path", l.path, "error", err)
 	}
 }
 
+func (l *logger) write(data []byte) {
+	done := make(chan int, 1)
+	l.requests <- &logRequest{data, done}
+	<-done
+}
+
 func (l *logger) writeSpecial(directive string) {
 	l.writeOp(directive, NoState, NoOp, "")
 }
@@ -67,42 +384,133 @@ func (l *logger) writeState(txId string, state TxState) {
 }
 
 func (l *logger) writeOp(txId string, state TxState, op Operation, key string) {
-	record := []string{txId, state.String(), op.String(), key}
-	done := make(chan int)
-	l.requests <- &logRequest{record, done}
-	<-done
+	l.writeEntry(logEntry{txId, state, op, key, nil, "", "", time.Time{}, 0, nil})
 }
 
-func (l *logger) read() (entries []logEntry, err error) {
-	entries = make([]logEntry, 0)
-	file, err := os.OpenFile(l.path, os.O_RDONLY, 0)
-	if err != nil {
-		if os.IsNotExist(err) {
-			err = nil
+// writeTxOp is writeOp plus the indexes of the replicas taking part in the transaction
+func (l *logger) writeTxOp(txId string, state TxState, op Operation, key string, participants []int) {
+	l.writeEntry(logEntry{txId, state, op, key, participants, "", "", time.Time{}, 0, nil})
+}
+
+func (l *logger) writeEntry(e logEntry) {
+	l.writeEntries(e)
+}
+
+// writeEntries appends the entries in a single write
+func (l *logger) writeEntries(entries ...logEntry) {
+	var data []byte
+	for _, e := range entries {
+		if e.time.IsZero() {
+			e.time = time.Now()
 		}
-		return
+		data = append(data, l.format.encodeEntry(e)...)
 	}
-	r := csv.NewReader(file)
-	records, err := r.ReadAll()
+	l.write(data)
+}
+
+// writeRecord durably appends an arbitrary record, for logs that don't hold transaction entries
+func (l *logger) writeRecord(record ...string) {
+	l.write(l.format.encodeFields(record))
+}
+
+func formatParticipants(participants []int) string {
+	s := make([]string, len(participants))
+	for i, p := range participants {
+		s[i] = strconv.Itoa(p)
+	}
+	return strings.Join(s, " ")
+}
+
+func parseParticipants(s string) (participants []int) {
+	for _, field := range strings.Fields(s) {
+		p, err := strconv.Atoi(field)
+		if err == nil {
+			participants = append(participants, p)
+		}
+	}
+	return
+}
+
+// entryFields only adds the sequence number and the base64 value when the entry has either, so
+// other entries look the same as before they existed
+func entryFields(e logEntry) []string {
+	fields := []string{e.txId, e.state.String(), e.op.String(), e.key, formatParticipants(e.participants), e.coordinator, e.coordinatorId}
+	if e.seq > 0 || e.value != nil {
+		fields = append(fields, strconv.FormatUint(e.seq, 10), base64.StdEncoding.EncodeToString(e.value))
+	}
+	return fields
+}
+
+func parseEntryFields(fields []string) logEntry {
+	for len(fields) < 4 {
+		fields = append(fields, "")
+	}
+	entry := logEntry{fields[0], ParseTxState(fields[1]), ParseOperation(fields[2]), fields[3], nil, "", "", time.Time{}, 0, nil}
+	if len(fields) > 4 {
+		entry.participants = parseParticipants(fields[4])
+	}
+	if len(fields) > 5 {
+		entry.coordinator = fields[5]
+	}
+	if len(fields) > 6 {
+		entry.coordinatorId = fields[6]
+	}
+	if len(fields) > 8 {
+		entry.seq, _ = strconv.ParseUint(fields[7], 10, 64)
+		entry.value, _ = base64.StdEncoding.DecodeString(fields[8])
+	}
+	return entry
+}
+
+// readLog returns every complete record of the segments that haven't been archived, cutting off a
+// record that a crash left partly written
+func (l *logger) readLog() (records []logRecord, err error) {
+	seqs, err := listSegments(path.Dir(l.path), l.path)
 	if err != nil {
 		return
 	}
-
-	for _, record := range records {
-		entries = append(entries, logEntry{record[0], ParseTxState(record[1]), ParseOperation(record[2]), record[3]})
+	for i, seq := range seqs {
+		segmentRecords, err := l.readSegment(seq, i == len(seqs)-1)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, segmentRecords...)
 	}
 	return
 }
 
-type ConditionalWriter struct{}
+// readRecords returns the records of a log written with writeRecord
+func (l *logger) readRecords() (records [][]string, err error) {
+	logRecords, err := l.readLog()
+	if err != nil {
+		return
+	}
+	for _, record := range logRecords {
+		if record.entry != nil {
+			records = append(records, entryFields(*record.entry))
+		} else {
+			records = append(records, record.fields)
+		}
+	}
+	return
+}
 
-func NewConditionalWriter() *ConditionalWriter {
-	return &ConditionalWriter{}
+func (l *logger) read() (entries []logEntry, err error) {
+	records, err := l.readLog()
+	if err != nil {
+		return make([]logEntry, 0), err
+	}
+	return recordEntries(records), nil
 }
 
-func (w *ConditionalWriter) Write(b []byte) (n int, err error) {
-	if !strings.Contains(string(b), "The specified network name is no longer available") {
-		n, err = os.Stdout.Write(b)
+func recordEntries(records []logRecord) (entries []logEntry) {
+	entries = make([]logEntry, 0)
+	for _, record := range records {
+		if record.entry != nil {
+			entries = append(entries, *record.entry)
+		} else {
+			entries = append(entries, parseEntryFields(record.fields))
+		}
 	}
 	return
 }
@@ -0,0 +1,416 @@
+// +build !goci
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+var testLogPath = "./test.logs/log.txt"
+
+var syncDurability = newDurability(SyncDurability, 0)
+
+// LoggerSuite runs against every log format
+type LoggerSuite struct {
+	format string
+}
+
+var _ = Suite(&LoggerSuite{WalLogFormat})
+var _ = Suite(&LoggerSuite{CsvLogFormat})
+
+func (s *LoggerSuite) TearDownTest(c *C) {
+	os.RemoveAll("./test.logs")
+}
+
+func appendToLog(c *C, l *logger, data []byte) {
+	f, err := os.OpenFile(l.activePath(), os.O_WRONLY|os.O_APPEND, 0)
+	c.Assert(err, IsNil)
+	_, err = f.Write(data)
+	c.Assert(err, IsNil)
+	f.Close()
+}
+
+func readTestFile(c *C, p string) []byte {
+	data, err := ioutil.ReadFile(p)
+	c.Assert(err, IsNil)
+	return data
+}
+
+func logSize(c *C, l *logger) int64 {
+	return int64(len(readTestFile(c, l.activePath())))
+}
+
+func (s *LoggerSuite) TestWriteAndRead(c *C) {
+	l := newLogger(testLogPath, s.format, syncDurability)
+	l.writeState("tx1", Started)
+	l.writeEntry(logEntry{"tx1", Prepared, PutOp, "key with, comma\nand newline", []int{0, 2}, "localhost:1", "m", time.Time{}, 0, nil})
+	l.writeRecord("not", "an", "entry")
+
+	entries, err := l.read()
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 3)
+	c.Assert(entries[0].state, Equals, Started)
+	c.Assert(entries[1].key, Equals, "key with, comma\nand newline")
+	c.Assert(entries[1].participants, DeepEquals, []int{0, 2})
+	c.Assert(entries[1].coordinatorId, Equals, "m")
+
+	records, err := l.readRecords()
+	c.Assert(err, IsNil)
+	c.Assert(records[2], DeepEquals, []string{"not", "an", "entry"})
+}
+
+func (s *LoggerSuite) TestRedoEntriesKeepTheirValues(c *C) {
+	l := newLogger(testLogPath, s.format, syncDurability)
+	l.writeEntries(redoEntries("tx1", []storeOp{{PutOp, "foo", []byte{0, 1, ','}}, {PutOp, "empty", []byte{}}, {DelOp, "bar", nil}})...)
+	l.writeEntry(logEntry{"tx1", Committed, NoOp, "", nil, "", "", time.Time{}, 7, nil})
+
+	entries, err := l.read()
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 5)
+	c.Assert(entries[0].value, DeepEquals, []byte{0, 1, ','})
+	c.Assert(entries[1].value, DeepEquals, []byte{})
+	c.Assert(entries[2].op, Equals, DelOp)
+	c.Assert(entries[2].value, IsNil)
+	c.Assert(entries[3].op, Equals, NoOp)
+	c.Assert(entries[4].seq, Equals, uint64(7))
+}
+
+func (s *LoggerSuite) TestTornRecordIsTruncated(c *C) {
+	l := newLogger(testLogPath, s.format, syncDurability)
+	l.writeState("tx1", Started)
+	size := logSize(c, l)
+
+	torn := l.format.encodeEntry(logEntry{"tx1", Committed, NoOp, "", nil, "", "", time.Now(), 0, nil})
+	for _, data := range [][]byte{torn[:5], torn[:len(torn)-3], append(torn[:len(torn)-1:len(torn)-1], 'x')} {
+		appendToLog(c, l, data)
+		entries, err := l.read()
+		c.Assert(err, IsNil)
+		c.Assert(entries, HasLen, 1)
+		c.Assert(logSize(c, l), Equals, size)
+	}
+
+	// The log keeps working after the truncation
+	l.writeState("tx1", Committed)
+	entries, err := l.read()
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 2)
+	c.Assert(entries[1].state, Equals, Committed)
+}
+
+func (s *LoggerSuite) TestCorruptionInTheMiddleIsAnError(c *C) {
+	l := newLogger(testLogPath, s.format, syncDurability)
+	offset := logSize(c, l)
+	l.writeState("tx1", Started)
+	end := logSize(c, l)
+	l.writeState("tx1", Committed)
+
+	// Flip a byte near the end of the first record
+	data := readTestFile(c, l.activePath())
+	data[end-2] ^= 1
+	err := ioutil.WriteFile(l.activePath(), data, 0777)
+	c.Assert(err, IsNil)
+
+	_, err = l.read()
+	c.Assert(err, ErrorMatches, fmt.Sprint(".* at offset ", offset, "(:.*)?"))
+}
+
+func (s *LoggerSuite) TestBadLengthInTheMiddleIsAnError(c *C) {
+	l := newLogger(testLogPath, s.format, syncDurability)
+	offset := logSize(c, l)
+	l.writeState("tx1", Started)
+	l.writeState("tx1", Committed)
+	l.writeState("tx2", Started)
+
+	// A length running past the end looks like a torn record, but whole records follow it
+	data := readTestFile(c, l.activePath())
+	if s.format == WalLogFormat {
+		binary.BigEndian.PutUint32(data[offset:], 1<<30)
+	} else {
+		copy(data[offset:], "3fffffff")
+	}
+	err := ioutil.WriteFile(l.activePath(), data, 0777)
+	c.Assert(err, IsNil)
+
+	_, err = l.read()
+	c.Assert(err, ErrorMatches, fmt.Sprint(".* at offset ", offset, "(:.*)?"))
+	c.Assert(readTestFile(c, l.activePath()), DeepEquals, data)
+}
+
+func (s *LoggerSuite) TestPlainCsvLogIsConverted(c *C) {
+	err := os.MkdirAll("./test.logs", 0777)
+	c.Assert(err, IsNil)
+	err = ioutil.WriteFile(testLogPath, []byte("tx1,STARTED,INVALID,\ntx1,PREPARED,PUT,foo\n"), 0777)
+	c.Assert(err, IsNil)
+
+	l := newLogger(testLogPath, s.format, syncDurability)
+	entries, err := l.read()
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 2)
+	c.Assert(entries[1].op, Equals, PutOp)
+	c.Assert(entries[1].key, Equals, "foo")
+}
+
+func (s *LoggerSuite) TestOtherFormatIsConverted(c *C) {
+	other := WalLogFormat
+	if s.format == WalLogFormat {
+		other = CsvLogFormat
+	}
+	l := newLogger(testLogPath, other, syncDurability)
+	l.writeTxOp("tx1", Started, NoOp, "", []int{1})
+	l.writeRecord("a", "b")
+
+	l = newLogger(testLogPath, s.format, syncDurability)
+	c.Assert(detectLogFormat(readTestFile(c, l.activePath())).name(), Equals, s.format)
+	records, err := l.readRecords()
+	c.Assert(err, IsNil)
+	c.Assert(records, HasLen, 2)
+	c.Assert(records[0][0], Equals, "tx1")
+	c.Assert(records[1], DeepEquals, []string{"a", "b"})
+	entries, err := l.read()
+	c.Assert(err, IsNil)
+	c.Assert(entries[0].participants, DeepEquals, []int{1})
+}
+
+func (s *LoggerSuite) TestMigrateLogs(c *C) {
+	err := os.MkdirAll("./test.logs/nested", 0777)
+	c.Assert(err, IsNil)
+	err = ioutil.WriteFile("./test.logs/nested/replica.txt", []byte("tx1,COMMITTED,INVALID,\n"), 0777)
+	c.Assert(err, IsNil)
+	err = ioutil.WriteFile("./test.logs/notes.md", []byte("not a log"), 0777)
+	c.Assert(err, IsNil)
+
+	converted, err := migrateLogs("./test.logs", s.format)
+	c.Assert(err, IsNil)
+	c.Assert(converted, DeepEquals, []string{"test.logs/nested/replica.txt"})
+	c.Assert(string(readTestFile(c, "./test.logs/notes.md")), Equals, "not a log")
+
+	// Running it again has nothing left to do
+	converted, err = migrateLogs("./test.logs", s.format)
+	c.Assert(err, IsNil)
+	c.Assert(converted, HasLen, 0)
+}
+
+func (s *LoggerSuite) TestWalKeepsTimestamps(c *C) {
+	if s.format != WalLogFormat {
+		c.Skip("only the WAL keeps timestamps")
+	}
+	l := newLogger(testLogPath, s.format, syncDurability)
+	before := time.Now()
+	l.writeState("tx1", Started)
+
+	entries, err := l.read()
+	c.Assert(err, IsNil)
+	c.Assert(entries[0].time.Before(before), Equals, false)
+}
+
+func (s *LoggerSuite) TestWalSkipsUnknownFields(c *C) {
+	if s.format != WalLogFormat {
+		c.Skip("only the WAL has typed fields")
+	}
+	l := newLogger(testLogPath, s.format, syncDurability)
+	var fields []byte
+	fields = appendWalField(fields, walTxIdTag, []byte("tx1"))
+	fields = appendWalField(fields, 99, []byte("from a later version"))
+	fields = appendWalUint(fields, walStateTag, uint64(Committed))
+	appendToLog(c, l, walFrame(walEntryRecord, fields))
+	appendToLog(c, l, walFrame(99, nil))
+
+	entries, err := l.read()
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 1)
+	c.Assert(entries[0].txId, Equals, "tx1")
+	c.Assert(entries[0].state, Equals, Committed)
+}
+
+func (s *LoggerSuite) TestWalRejectsNewerVersion(c *C) {
+	if s.format != WalLogFormat {
+		c.Skip("only the WAL is versioned")
+	}
+	header := walFrame(walHeaderRecord, appendWalUint(nil, walVersionTag, walVersion+1))
+	_, _, err := walFormat{}.decode(testLogPath, append(append([]byte{}, walMagic...), header...))
+	c.Assert(err, ErrorMatches, ".*newer than the supported version.*")
+}
+
+func (s *LoggerSuite) TestDurabilityIsRecordedInTheHeader(c *C) {
+	group := newDurability(GroupDurability, 5*time.Millisecond)
+	l := newLogger(testLogPath, s.format, group)
+	l.writeState("tx1", Started)
+	c.Assert(l.format.headerDurability(readTestFile(c, l.activePath())), Equals, group)
+
+	// Reopening with another level rewrites the header and keeps the records
+	buffered := newDurability(BufferedDurability, 0)
+	l = newLogger(testLogPath, s.format, buffered)
+	l.writeState("tx1", Committed)
+	c.Assert(l.format.headerDurability(readTestFile(c, l.activePath())), Equals, buffered)
+	entries, err := l.read()
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 2)
+	c.Assert(entries[1].state, Equals, Committed)
+}
+
+func (s *LoggerSuite) TestLogsWithoutDurabilityGetOne(c *C) {
+	l := newLogger(testLogPath, s.format, syncDurability)
+	l.writeState("tx1", Started)
+	// Strip the durability from the header, as in a log from before it was recorded
+	var old []byte
+	if s.format == WalLogFormat {
+		old = append(append([]byte{}, walMagic...), walFrame(walHeaderRecord, appendWalUint(nil, walVersionTag, walVersion))...)
+	} else {
+		old = []byte(csvLogMagic)
+	}
+	old = append(old, l.format.encodeEntry(logEntry{"tx1", Started, NoOp, "", nil, "", "", time.Now(), 0, nil})...)
+	c.Assert(l.format.headerDurability(old), Equals, logDurability{})
+	err := ioutil.WriteFile(l.activePath(), old, 0777)
+	c.Assert(err, IsNil)
+
+	l = newLogger(testLogPath, s.format, syncDurability)
+	c.Assert(l.format.headerDurability(readTestFile(c, l.activePath())), Equals, syncDurability)
+	entries, err := l.read()
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 1)
+}
+
+func (s *LoggerSuite) TestSegmentsRotateAndAreReadInOrder(c *C) {
+	l := newLogger(testLogPath, s.format, syncDurability)
+	l.segmentSize = 100
+	for i := 0; i < 10; i++ {
+		l.writeState(fmt.Sprint("tx", i), Committed)
+	}
+	seqs, err := listSegments("./test.logs", testLogPath)
+	c.Assert(err, IsNil)
+	c.Assert(len(seqs) > 2, Equals, true)
+	c.Assert(l.activePath(), Equals, segmentPath(testLogPath, seqs[len(seqs)-1]))
+
+	l = newLogger(testLogPath, s.format, syncDurability)
+	entries, err := l.read()
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 10)
+	for i, e := range entries {
+		c.Assert(e.txId, Equals, fmt.Sprint("tx", i))
+	}
+}
+
+func (s *LoggerSuite) TestTornRecordInAnOlderSegmentIsAnError(c *C) {
+	l := newLogger(testLogPath, s.format, syncDurability)
+	l.segmentSize = 1
+	l.writeState("tx1", Started)
+	l.writeState("tx1", Committed)
+
+	first := segmentPath(testLogPath, 1)
+	data := readTestFile(c, first)
+	err := ioutil.WriteFile(first, data[:len(data)-2], 0777)
+	c.Assert(err, IsNil)
+	_, err = l.read()
+	c.Assert(err, ErrorMatches, "Corrupt record in log .*000000001.txt at offset .*")
+}
+
+func (s *LoggerSuite) TestArchive(c *C) {
+	for _, compress := range []bool{false, true} {
+		os.RemoveAll("./test.logs")
+		l := newLogger(testLogPath, s.format, syncDurability)
+		l.segmentSize = 1
+		for _, txId := range []string{"done1", "done2", "pending", "done3"} {
+			l.writeState(txId, Committed)
+		}
+
+		// Archiving stops at the first segment that is still needed
+		archived, err := l.archive("./test.logs/archive", compress, func(entries []logEntry) bool {
+			return entries[0].txId == "pending"
+		})
+		c.Assert(err, IsNil)
+		c.Assert(archived, DeepEquals, []string{segmentPath(testLogPath, 1), segmentPath(testLogPath, 2)})
+		entries, err := l.read()
+		c.Assert(err, IsNil)
+		c.Assert(entries, HasLen, 2)
+		c.Assert(entries[0].txId, Equals, "pending")
+
+		name := path.Base(segmentPath(testLogPath, 1))
+		var data []byte
+		if compress {
+			r, err := gzip.NewReader(bytes.NewReader(readTestFile(c, path.Join("./test.logs/archive", name+compressedSuffix))))
+			c.Assert(err, IsNil)
+			data, err = ioutil.ReadAll(r)
+			c.Assert(err, IsNil)
+		} else {
+			data = readTestFile(c, path.Join("./test.logs/archive", name))
+		}
+		records, _, err := l.format.decode(name, data)
+		c.Assert(err, IsNil)
+		c.Assert(recordEntries(records)[0].txId, Equals, "done1")
+
+		// The active segment stays even when nothing needs it
+		archived, err = l.archive("./test.logs/archive", compress, func(entries []logEntry) bool { return false })
+		c.Assert(err, IsNil)
+		c.Assert(archived, HasLen, 2)
+		entries, err = l.read()
+		c.Assert(err, IsNil)
+		c.Assert(entries, HasLen, 0)
+	}
+}
+
+func (s *LoggerSuite) TestConcurrentWritesAreAllLogged(c *C) {
+	l := newLogger(testLogPath, s.format, syncDurability)
+	const writers = 50
+	var wg sync.WaitGroup
+	wg.Add(writers)
+	for i := 0; i < writers; i++ {
+		go func(i int) {
+			defer wg.Done()
+			l.writeState(fmt.Sprint("tx", i), Committed)
+		}(i)
+	}
+	wg.Wait()
+
+	entries, err := l.read()
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, writers)
+	seen := make(map[string]bool)
+	for _, e := range entries {
+		seen[e.txId] = true
+	}
+	c.Assert(seen, HasLen, writers)
+}
+
+// benchmarkConcurrentWrites writes c.N records from many goroutines, like the master does when it
+// has many transactions going at once
+func benchmarkConcurrentWrites(c *C, format string, durability logDurability, maxBatch int) {
+	l := newLogger(testLogPath, format, durability)
+	l.maxBatch = maxBatch
+	const writers = 64
+	var wg sync.WaitGroup
+	wg.Add(writers)
+	c.ResetTimer()
+	for w := 0; w < writers; w++ {
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < c.N; i += writers {
+				l.writeState(fmt.Sprint("tx", i), Committed)
+			}
+		}(w)
+	}
+	wg.Wait()
+}
+
+func (s *LoggerSuite) BenchmarkConcurrentWrites(c *C) {
+	benchmarkConcurrentWrites(c, s.format, syncDurability, logMaxBatch)
+}
+
+func (s *LoggerSuite) BenchmarkConcurrentWritesWithoutGroupCommit(c *C) {
+	benchmarkConcurrentWrites(c, s.format, syncDurability, 1)
+}
+
+func (s *LoggerSuite) BenchmarkConcurrentWritesWithGroupDurability(c *C) {
+	benchmarkConcurrentWrites(c, s.format, newDurability(GroupDurability, 0), logMaxBatch)
+}
+
+func (s *LoggerSuite) BenchmarkConcurrentWritesWithBufferedDurability(c *C) {
+	benchmarkConcurrentWrites(c, s.format, newDurability(BufferedDurability, 0), logMaxBatch)
+}
@@ -1,29 +1,94 @@
 package main
 
 import (
-	"fmt"
 	flag "github.com/ogier/pflag"
 	"log"
-	"strconv"
+	"os"
 )
 
 func main() {
+	// Subcommands take their own flags, and print their results on stdout, so diagnostics go to stderr
+	if len(os.Args) > 1 {
+		commands := map[string]func(args []string){
+			"log":     logCommand,
+			"fsck":    fsckCommand,
+			"pitr":    pitrCommand,
+			"backup":  backupCommand,
+			"restore": restoreCommand,
+			"trace":   traceCommand,
+		}
+		if command, ok := commands[os.Args[1]]; ok {
+			log.SetFlags(0)
+			diagnostics.out = os.Stderr
+			command(os.Args[2:])
+			return
+		}
+	}
+
 	isMaster := flag.BoolP("master", "m", false, "start the master process")
-	replicaCount := flag.IntP("replicaCount", "n", 0, "replica count for master")
+	replicaCount := flag.IntP("replicaCount", "n", 0, "replica count, required without a cluster config")
 	isReplica := flag.BoolP("replica", "r", false, "start a replica process")
-	replicaNumber := flag.IntP("replicaIndex", "i", 0, "replica index to run, starting at 0")
+	nodeId := flag.StringP("id", "i", "", "id of the node to run, as listed in the cluster config (defaults to Master for -m)")
+	configPath := flag.StringP("config", "c", "", "cluster config file (JSON), defaults to a localhost cluster of -n replicas")
+	paxos := flag.BoolP("paxos", "p", false, "use Paxos Commit, with the replicas as acceptors")
+	logFormat := flag.String("log-format", "", "log format for every node, wal or csv (the legacy format), overriding the cluster config")
+	durability := flag.String("durability", "", "durability of every node's logs: sync (fsync every record), group (fsync every --sync-interval) or buffered (leave it to the OS), overriding the cluster config")
+	syncInterval := flag.Int("sync-interval", 0, "milliseconds between fsyncs with --durability=group, overriding the cluster config")
+	migrate := flag.String("migrate-logs", "", "convert every log (*.txt) under this directory to --log-format, or wal, and exit; stop the nodes first")
+	logLevel := flag.String("log-level", "info", "least severe diagnostics to print: debug, info, warn or error")
+	logEncoding := flag.String("log-encoding", TextLogEncoding, "how to print diagnostics: text, or json for one object per line")
 	flag.Parse()
 
-	log.SetOutput(NewConditionalWriter())
-	log.SetFlags(0) //log.Ltime | log.Lmicroseconds)
+	node := *nodeId
+	if *isMaster && node == "" {
+		node = "Master"
+	}
+	err := configureDiagnostics(*logLevel, *logEncoding, node)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	cluster := DefaultClusterConfig(*replicaCount)
+	if *configPath != "" || *isMaster || *isReplica {
+		cluster, err = commandCluster(*configPath, *replicaCount)
+		if err != nil {
+			logFatal("Unable to load the cluster config", "path", *configPath, "error", err)
+		}
+	}
+
+	if *logFormat != "" {
+		err := checkLogFormat(*logFormat)
+		if err != nil {
+			logFatal("Bad --log-format", "error", err)
+		}
+		cluster.setLogFormat(*logFormat)
+	}
+
+	if *durability != "" {
+		err := checkDurability(*durability)
+		if err != nil {
+			logFatal("Bad --durability", "error", err)
+		}
+		cluster.setDurability(*durability, *syncInterval)
+	}
 
 	switch {
+	case *migrate != "":
+		format := *logFormat
+		if format == "" {
+			format = WalLogFormat
+		}
+		converted, err := migrateLogs(*migrate, format)
+		for _, p := range converted {
+			logInfo("Converted log", "path", p)
+		}
+		if err != nil {
+			logFatal("Unable to convert logs", "error", err)
+		}
 	case *isMaster:
-		log.SetPrefix("M  ")
-		runMaster(*replicaCount)
+		runMaster(cluster, *nodeId, *paxos)
 	case *isReplica:
-		log.SetPrefix(fmt.Sprint("R", strconv.Itoa(*replicaNumber), " "))
-		runReplica(*replicaNumber)
+		runReplica(cluster, *nodeId, *paxos)
 	default:
 		flag.Usage()
 	}
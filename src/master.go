@@ -3,7 +3,6 @@ package main
 import (
 	"errors"
 	"github.com/dchest/uniuri"
-	"log"
 	"math/rand"
 	"net/http"
 	"net/rpc"
@@ -17,21 +16,42 @@ var (
 )
 
 type Master struct {
+	cluster      *ClusterConfig
+	node         NodeConfig
+	num          int
 	replicaCount int
 	replicas     []*ReplicaClient
+	subordinates []*subordinateClient
 	log          *logger
 	txs          map[string]TxState
-	didSuicide   bool
+	participants map[string][]int
+	// acked holds the committed transactions that every participant has acknowledged
+	acked map[string]bool
+	// superiors holds the superior master of each transaction we took part in as a subordinate
+	superiors map[string]string
+	// seq is the last commit sequence number given out. Commits are numbered from 1 in the order they
+	// are logged, and conflicting transactions commit in that order since they hold their locks.
+	seq        uint64
+	didSuicide bool
+	paxos      *paxosCommit
+	commits    *commitGate
+	metrics    *masterMetrics
+	tracer     *tracer
+	mu         sync.Mutex
 }
 
+// PutArgs carries a value as raw bytes, with an optional content type like "image/png" that is
+// handed back by Get
 type PutArgs struct {
-	Key   string
-	Value string
+	Key         string
+	Value       []byte
+	ContentType string
 }
 
 type PutTestArgs struct {
 	Key           string
-	Value         string
+	Value         []byte
+	ContentType   string
 	MasterDeath   MasterDeath
 	ReplicaDeaths []ReplicaDeath
 }
@@ -67,17 +87,83 @@ type PingArgs struct {
 	Key string
 }
 
-type GetResult struct {
+type PingResult struct {
 	Value string
 }
 
-func NewMaster(replicaCount int) *Master {
-	l := newLogger("logs/master.txt")
+type DurabilityArgs struct{}
+
+// DurabilityResult is how a node's logs reach the disk, SyncIntervalMs only being set for the
+// group level
+type DurabilityResult struct {
+	Level          string
+	SyncIntervalMs int
+}
+
+// BackupArgs names the file to write the backup to, on the master's machine
+type BackupArgs struct {
+	Path string
+}
+
+type BackupResult struct {
+	Keys   int
+	Shards int
+}
+
+type GetResult struct {
+	Value       []byte
+	ContentType string
+}
+
+type TransactArgs struct {
+	Ops []TxOp
+}
+
+type ShardArgs struct {
+	Key string
+}
+
+type ShardResult struct {
+	ShardId  string
+	Replicas []string
+}
+
+type PrepareArgs struct {
+	TxId     string
+	Ops      []TxOp
+	Superior string
+}
+
+type DecisionArgs struct {
+	TxId string
+}
+
+type VoteResult struct {
+	Success bool
+}
+
+// NewMaster creates the coordinator with the given index in cluster.coordinators()
+func NewMaster(cluster *ClusterConfig, num int) *Master {
+	node := cluster.coordinators()[num]
+	l := newLogger(node.LogPath, node.LogFormat, node.logDurability())
+	replicaCount := len(cluster.Replicas)
 	replicas := make([]*ReplicaClient, replicaCount)
-	for i := 0; i < replicaCount; i++ {
-		replicas[i] = NewReplicaClient(GetReplicaHost(i))
+	for i, node := range cluster.Replicas {
+		replicas[i] = NewReplicaClient(node.Address)
 	}
-	return &Master{replicaCount, replicas, l, make(map[string]TxState), false}
+	subordinates := make([]*subordinateClient, len(cluster.Subordinates))
+	for i, node := range cluster.Subordinates {
+		subordinates[i] = &subordinateClient{NewMasterClient(node.Address)}
+	}
+	m := &Master{cluster, node, num, replicaCount, replicas, subordinates, l, make(map[string]TxState), make(map[string][]int), make(map[string]bool), make(map[string]string), 0, false, nil, newCommitGate(), nil, newTracer(node.Id), sync.Mutex{}}
+	m.metrics = newMasterMetrics(m)
+	return m
+}
+
+// enablePaxosCommit makes the master learn each transaction's outcome from the replica-hosted
+// acceptors, so its own log is no longer the only record of the decision.
+func (m *Master) enablePaxosCommit() {
+	m.paxos = newPaxosCommit(m.replicaCount+m.num, m.cluster, nil)
 }
 
 func (m *Master) Get(args *GetArgs, reply *GetResult) (err error) {
@@ -85,17 +171,30 @@ func (m *Master) Get(args *GetArgs, reply *GetResult) (err error) {
 }
 
 func (m *Master) GetTest(args *GetTestArgs, reply *GetResult) (err error) {
-	log.Println("Master.Get is being called")
-	rn := args.ReplicaNum
-	if rn < 0 {
-		rn = rand.Intn(m.replicaCount)
+	logDebug("Get", "key", args.Key, "replica", args.ReplicaNum)
+	candidates := []int{args.ReplicaNum}
+	if args.ReplicaNum < 0 {
+		// Start at a random replica of the shard, and move on from any that is still recovering the key
+		shardReplicas := m.cluster.shardFor(args.Key).replicaIndexes
+		start := rand.Intn(len(shardReplicas))
+		candidates = candidates[:0]
+		for i := range shardReplicas {
+			candidates = append(candidates, shardReplicas[(start+i)%len(shardReplicas)])
+		}
+	}
+	var r *ReplicaGetResult
+	for _, rn := range candidates {
+		r, err = m.replicas[rn].Get(args.Key)
+		if err == nil || !isRetryable(err) {
+			break
+		}
 	}
-	r, err := m.replicas[rn].Get(args.Key)
 	if err != nil {
-		log.Printf("Master.Get: request to replica %v for key %v failed\n", rn, args.Key)
+		logWarn("Get failed", "key", args.Key, "replicas", candidates, "error", err)
 		return
 	}
-	reply.Value = *r
+	reply.Value = r.Value
+	reply.ContentType = r.ContentType
 	return nil
 }
 
@@ -105,30 +204,30 @@ func (m *Master) Del(args *DelArgs, _ *int) (err error) {
 }
 
 func (m *Master) DelTest(args *DelTestArgs, _ *int) (err error) {
-	return m.mutate(
-		DelOp,
-		args.Key,
-		args.MasterDeath,
-		args.ReplicaDeaths,
-		func(r *ReplicaClient, txId string, i int, rd ReplicaDeath) (*bool, error) {
-			return r.TryDel(args.Key, txId, rd)
-		})
+	return m.mutate([]TxOp{{DelOp, args.Key, nil, "", ""}}, args.MasterDeath, args.ReplicaDeaths)
 }
 
 func (m *Master) Put(args *PutArgs, _ *int) (err error) {
 	var i int
-	return m.PutTest(&PutTestArgs{args.Key, args.Value, MasterDontDie, make([]ReplicaDeath, m.replicaCount)}, &i)
+	return m.PutTest(&PutTestArgs{args.Key, args.Value, args.ContentType, MasterDontDie, make([]ReplicaDeath, m.replicaCount)}, &i)
 }
 
 func (m *Master) PutTest(args *PutTestArgs, _ *int) (err error) {
-	return m.mutate(
-		PutOp,
-		args.Key,
-		args.MasterDeath,
-		args.ReplicaDeaths,
-		func(r *ReplicaClient, txId string, i int, rd ReplicaDeath) (*bool, error) {
-			return r.TryPut(args.Key, args.Value, txId, rd)
-		})
+	return m.mutate([]TxOp{{PutOp, args.Key, args.Value, args.ContentType, ""}}, args.MasterDeath, args.ReplicaDeaths)
+}
+
+// Transact atomically applies puts and deletes to any number of keys, even when they live in
+// different shards
+func (m *Master) Transact(args *TransactArgs, _ *int) (err error) {
+	return m.mutate(args.Ops, MasterDontDie, nil)
+}
+
+// Shard reports which shard owns a key, and the replicas in it
+func (m *Master) Shard(args *ShardArgs, reply *ShardResult) (err error) {
+	shard := m.cluster.shardFor(args.Key)
+	reply.ShardId = shard.Id
+	reply.Replicas = shard.Replicas
+	return nil
 }
 
 func getReplicaDeath(replicaDeaths []ReplicaDeath, n int) ReplicaDeath {
@@ -139,90 +238,291 @@ func getReplicaDeath(replicaDeaths []ReplicaDeath, n int) ReplicaDeath {
 	return rd
 }
 
-func (m *Master) mutate(operation Operation, key string, masterDeath MasterDeath, replicaDeaths []ReplicaDeath, f func(r *ReplicaClient, txId string, i int, rd ReplicaDeath) (*bool, error)) (err error) {
-	action := operation.String()
-	txId := uniuri.New()
-	m.log.writeState(txId, Started)
-	m.txs[txId] = Started
+func (m *Master) mutate(ops []TxOp, masterDeath MasterDeath, replicaDeaths []ReplicaDeath) (err error) {
+	if len(ops) == 0 {
+		return errors.New("Transaction has no operations.")
+	}
+	action := "TX"
+	if len(ops) == 1 {
+		action = ops[0].Op.String()
+	}
+	keys := make([]string, len(ops))
+	for i, op := range ops {
+		keys[i] = op.Key
+	}
+
+	// Only the replicas of the shards the keys live in take part, plus any other clusters' masters
+	opsByReplica, participants, err := m.cluster.routeOps(ops)
+	if err != nil {
+		return
+	}
+	if m.paxos != nil && participants[len(participants)-1] >= m.replicaCount {
+		return errors.New("Paxos Commit transactions can't include other clusters.")
+	}
+	// Our node id keeps txIds from different masters apart
+	txId := m.node.Id + "-" + uniuri.New()
+	start := time.Now()
+	m.log.writeTxOp(txId, Started, NoOp, "", participants)
+	m.setTx(txId, Started, participants)
+	m.tracer.record(txId, "", "log started", start)
+	defer func() {
+		m.tracer.record(txId, "", "transaction", start, "keys", keys, "participants", participants, "error", errorString(err))
+	}()
+
+	logInfo("Asking participants to prepare", "txId", txId, "phase", "prepare", "action", action, "keys", keys)
+	if !m.prepare(action, txId, opsByReplica, participants, replicaDeaths) {
+		logInfo("Asking participants to abort", "txId", txId, "phase", "abort", "action", action, "keys", keys)
+		logStart := time.Now()
+		m.log.writeTxOp(txId, Aborted, NoOp, "", participants)
+		m.tracer.record(txId, "", "log decision", logStart, "decision", Aborted.String())
+		m.setTx(txId, Aborted, participants)
+		m.metrics.transactions.inc("outcome", "aborted", "reason", "vote")
+		m.sendAbort(action, txId, participants)
+		return TxAbortedError
+	}
+
+	// The transaction is now officially committed
+	m.dieIf(masterDeath, MasterDieBeforeLoggingCommitted)
+	logStart := time.Now()
+	seq := m.nextCommitSeq()
+	// The participants go with the decision too, since the Started entry may be archived before a
+	// restart has to commit again
+	m.log.writeEntry(logEntry{txId, Committed, NoOp, "", participants, "", "", time.Time{}, seq, nil})
+	m.tracer.record(txId, "", "log decision", logStart, "decision", Committed.String(), "seq", seq)
+	m.dieIf(masterDeath, MasterDieAfterLoggingCommitted)
+	m.setTx(txId, Committed, participants)
+	m.metrics.transactions.inc("outcome", "committed", "reason", "prepared")
+
+	logInfo("Asking participants to commit", "txId", txId, "phase", "commit", "action", action, "keys", keys)
+	m.sendAndWaitForCommit(action, txId, participants, replicaDeaths)
+
+	return
+}
+
+// prepare runs the first phase, and reports whether every participant is prepared to commit
+func (m *Master) prepare(action string, txId string, opsByReplica map[int][]TxOp, participants []int, replicaDeaths []ReplicaDeath) bool {
+	start := time.Now()
+	defer m.metrics.prepare.since(start)
 
 	// Send out all mutate requests in parallel. If any abort, send on the channel.
 	// Channel must be buffered to allow the non-blocking read in the switch.
-	shouldAbort := make(chan int, m.replicaCount)
-	log.Println("Master."+action+" asking replicas to "+action+" tx:", txId, "key:", key)
-	m.forEachReplica(func(i int, r *ReplicaClient) {
-		success, err := f(r, txId, i, getReplicaDeath(replicaDeaths, i))
+	shouldAbort := make(chan int, len(participants))
+	m.forEachReplica(participants, func(i int, r participant) {
+		rpcStart := time.Now()
+		success, err := r.TryTx(txId, opsByReplica[i], participants, m.node.Id, m.node.Address, getReplicaDeath(replicaDeaths, i))
 		if err != nil {
-			log.Println("Master."+action+" r.Try"+action+":", err)
+			logWarn("Prepare failed", "txId", txId, "phase", "prepare", "replica", m.participantId(i), "error", err)
 		}
-		if success == nil || !*success {
+		vote := success != nil && *success
+		m.tracer.record(txId, m.participantId(i), "prepare", rpcStart, "participant", m.participantId(i), "vote", vote, "error", errorString(err))
+		if !vote {
 			shouldAbort <- 1
 		}
 	})
 
+	// With Paxos Commit the acceptors hold the decision, the replies only tell us who voted.
+	// Replicas that didn't answer get Aborted forced onto their instance.
+	if m.paxos != nil {
+		for len(shouldAbort) > 0 {
+			<-shouldAbort
+		}
+		if m.paxos.outcome(txId, participants, true) != Committed {
+			shouldAbort <- 1
+		}
+	}
+
 	// If at least one replica needed to abort
 	select {
 	case <-shouldAbort:
-		log.Println("Master."+action+" asking replicas to abort tx:", txId, "key:", key)
-		m.log.writeState(txId, Aborted)
-		m.txs[txId] = Aborted
-		m.sendAbort(action, txId)
-		return TxAbortedError
+		return false
 	default:
-		break
+		return true
 	}
+}
 
-	// The transaction is now officially committed
-	m.dieIf(masterDeath, MasterDieBeforeLoggingCommitted)
-	m.log.writeState(txId, Committed)
-	m.dieIf(masterDeath, MasterDieAfterLoggingCommitted)
-	m.txs[txId] = Committed
-
-	log.Println("Master."+action+" asking replicas to commit tx:", txId, "key:", key)
-	m.sendAndWaitForCommit(action, txId, replicaDeaths)
+func (m *Master) nextCommitSeq() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.seq++
+	return m.seq
+}
 
+// countTxs is how many transactions are in state
+func (m *Master) countTxs(state TxState) (n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, s := range m.txs {
+		if s == state {
+			n++
+		}
+	}
 	return
 }
 
-func (m *Master) sendAbort(action string, txId string) {
-	m.forEachReplica(func(i int, r *ReplicaClient) {
+func (m *Master) setTx(txId string, state TxState, participants []int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.txs[txId] = state
+	m.participants[txId] = participants
+}
+
+func (m *Master) sendAbort(action string, txId string, participants []int) {
+	m.forEachReplica(participants, func(i int, r participant) {
+		start := time.Now()
 		_, err := r.Abort(txId)
 		if err != nil {
-			log.Println("Master."+action+" r.Abort:", err)
+			logWarn("Abort failed", "txId", txId, "phase", "abort", "replica", m.participantId(i), "error", err)
 		}
+		m.tracer.record(txId, m.participantId(i), "abort", start, "participant", m.participantId(i), "error", errorString(err))
 	})
 }
 
-func (m *Master) sendAndWaitForCommit(action string, txId string, replicaDeaths []ReplicaDeath) {
-	m.forEachReplica(func(i int, r *ReplicaClient) {
+func (m *Master) sendAndWaitForCommit(action string, txId string, participants []int, replicaDeaths []ReplicaDeath) {
+	defer m.metrics.commit.since(time.Now())
+	// A backup's snapshots must not start while a commit is only applied on some participants
+	m.commits.enter()
+	defer m.commits.leave()
+
+	m.forEachReplica(participants, func(i int, r participant) {
+		start := time.Now()
+		retries := 0
 		for {
 			_, err := r.Commit(txId, getReplicaDeath(replicaDeaths, i))
 			if err == nil {
 				break
 			}
-			log.Println("Master."+action+" r.Commit:", err)
+			logWarn("Commit failed, retrying", "txId", txId, "phase", "commit", "replica", m.participantId(i), "error", err)
+			retries++
 			time.Sleep(100 * time.Millisecond)
 		}
+		m.tracer.record(txId, m.participantId(i), "commit", start, "participant", m.participantId(i), "retries", retries)
 	})
+
+	m.mu.Lock()
+	m.acked[txId] = true
+	m.mu.Unlock()
 }
 
-func (m *Master) forEachReplica(f func(i int, r *ReplicaClient)) {
+func (m *Master) forEachReplica(participants []int, f func(i int, r participant)) {
 	var wg sync.WaitGroup
-	wg.Add(m.replicaCount)
-	for i := 0; i < m.replicaCount; i++ {
-		go func(i int, r *ReplicaClient) {
+	wg.Add(len(participants))
+	for _, i := range participants {
+		go func(i int, r participant) {
 			defer wg.Done()
 			f(i, r)
-		}(i, m.replicas[i])
+		}(i, m.participant(i))
 	}
 	wg.Wait()
 }
 
-func (m *Master) Ping(args *PingArgs, reply *GetResult) (err error) {
+// participantId is the id of the replica, or subordinate master, with participant index i
+func (m *Master) participantId(i int) string {
+	if i < m.replicaCount {
+		return m.cluster.Replicas[i].Id
+	}
+	return m.cluster.Subordinates[i-m.replicaCount].Id
+}
+
+func (m *Master) participant(i int) participant {
+	if i < m.replicaCount {
+		return m.replicas[i]
+	}
+	return m.subordinates[i-m.replicaCount]
+}
+
+func (m *Master) allReplicas() []int {
+	all := make([]int, m.replicaCount)
+	for i := range all {
+		all[i] = i
+	}
+	return all
+}
+
+// Prepare runs the first phase of a superior master's transaction on this cluster. Once prepared, the
+// outcome is up to the superior, which is logged so recovery knows whom to ask.
+func (m *Master) Prepare(args *PrepareArgs, reply *VoteResult) (err error) {
+	reply.Success = false
+	if m.paxos != nil {
+		return errors.New("A master using Paxos Commit can't be a subordinate.")
+	}
+
+	opsByReplica, participants, err := m.cluster.routeOps(args.Ops)
+	if err != nil {
+		return
+	}
+	txId := args.TxId
+	m.log.writeEntry(logEntry{txId, Started, NoOp, "", participants, args.Superior, "", time.Time{}, 0, nil})
+	m.setTx(txId, Started, participants)
+	m.mu.Lock()
+	m.superiors[txId] = args.Superior
+	m.mu.Unlock()
+
+	logInfo("Asking participants to prepare for the superior", "txId", txId, "phase", "prepare", "superior", args.Superior)
+	prepared := m.prepare("Prepare", txId, opsByReplica, participants, nil)
+
+	// The superior's Abort may have overtaken us, in which case it is already logged
+	m.mu.Lock()
+	abortedMeanwhile := m.txs[txId] == Aborted
+	if prepared && !abortedMeanwhile {
+		m.log.writeEntry(logEntry{txId, Prepared, NoOp, "", participants, args.Superior, "", time.Time{}, 0, nil})
+		m.txs[txId] = Prepared
+	} else if !abortedMeanwhile {
+		m.log.writeTxOp(txId, Aborted, NoOp, "", participants)
+		m.txs[txId] = Aborted
+		m.metrics.transactions.inc("outcome", "aborted", "reason", "vote")
+	}
+	m.mu.Unlock()
+
+	if !prepared || abortedMeanwhile {
+		m.sendAbort("Prepare", txId, participants)
+		return nil
+	}
+	reply.Success = true
+	return nil
+}
+
+func (m *Master) Commit(args *DecisionArgs, reply *VoteResult) (err error) {
+	err = m.finishSubordinateTx(args.TxId, Committed)
+	reply.Success = err == nil
+	return
+}
+
+func (m *Master) Abort(args *DecisionArgs, reply *VoteResult) (err error) {
+	err = m.finishSubordinateTx(args.TxId, Aborted)
+	reply.Success = err == nil
+	return
+}
+
+func (m *Master) Ping(args *PingArgs, reply *PingResult) (err error) {
 	reply.Value = args.Key
 	return nil
 }
 
+// Durability reports the durability level of the master's log
+func (m *Master) Durability(args *DurabilityArgs, reply *DurabilityResult) (err error) {
+	reply.Level = m.log.durability.level
+	reply.SyncIntervalMs = int(m.log.durability.syncInterval / time.Millisecond)
+	return nil
+}
+
+// Backup writes a transactionally consistent snapshot of the committed data to a file. Commits are
+// only paused until each shard's snapshot has started.
+func (m *Master) Backup(args *BackupArgs, reply *BackupResult) (err error) {
+	manifest, err := m.backup(args.Path)
+	if err != nil {
+		logError("Backup failed", "path", args.Path, "error", err)
+		return
+	}
+	for _, shard := range manifest.Shards {
+		reply.Keys += shard.Keys
+	}
+	reply.Shards = len(manifest.Shards)
+	return nil
+}
+
 func (m *Master) Status(args *StatusArgs, reply *StatusResult) (err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	state, ok := m.txs[args.TxId]
 	if !ok {
 		state = NoState
@@ -237,6 +537,7 @@ func (m *Master) recover() (err error) {
 		return
 	}
 
+	inDoubt := make([]string, 0)
 	m.didSuicide = false
 	for _, entry := range entries {
 		switch entry.txId {
@@ -249,48 +550,128 @@ func (m *Master) recover() (err error) {
 		}
 
 		m.txs[entry.txId] = entry.state
+		if entry.seq > m.seq {
+			m.seq = entry.seq
+		}
+		if entry.participants != nil {
+			m.participants[entry.txId] = entry.participants
+		}
+		if entry.coordinator != "" {
+			m.superiors[entry.txId] = entry.coordinator
+		}
+	}
+
+	for txId := range m.txs {
+		// Logs from before sharding don't list participants, every replica took part
+		if _, ok := m.participants[txId]; !ok {
+			m.participants[txId] = m.allReplicas()
+		}
+	}
+
+	// A transaction we never logged an outcome for may still have been decided by the acceptors.
+	// Deciding it waits for a majority of them, so it happens in the background, with the transaction
+	// left undecided as Prepared meanwhile.
+	var undecided []string
+	if m.paxos != nil {
+		for txId, state := range m.txs {
+			if state == Started {
+				m.txs[txId] = Prepared
+				undecided = append(undecided, txId)
+			}
+		}
 	}
 
 	for txId, state := range m.txs {
+		participants := m.participants[txId]
 		switch state {
 		case Started:
+			// Never decided, so it never will be. Log it, since replicas and subordinates may ask.
+			m.log.writeTxOp(txId, Aborted, NoOp, "", participants)
+			m.txs[txId] = Aborted
+			m.metrics.transactions.inc("outcome", "aborted", "reason", "recovery")
 			fallthrough
 		case Aborted:
-			log.Println("Aborting tx", txId, "during recovery.")
-			m.sendAbort("recover", txId)
+			logInfo("Aborting during recovery", "txId", txId, "phase", "recovery")
+			m.sendAbort("recover", txId, participants)
 		case Committed:
-			log.Println("Committing tx", txId, "during recovery.")
-			m.sendAndWaitForCommit("recover", txId, make([]ReplicaDeath, m.replicaCount))
+			logInfo("Committing during recovery", "txId", txId, "phase", "recovery")
+			m.sendAndWaitForCommit("recover", txId, participants, make([]ReplicaDeath, m.replicaCount))
+		case Prepared:
+			// With Paxos Commit we can't be a subordinate, so these are the undecided ones
+			if m.paxos == nil {
+				inDoubt = append(inDoubt, txId)
+			}
 		}
 	}
 
+	for _, txId := range undecided {
+		go m.decideWithAcceptors(txId)
+	}
+
+	// Only a subordinate prepares, and the superior may still be recovering itself, so ask it in the
+	// background rather than holding up startup
+	for _, txId := range inDoubt {
+		logInfo("Asking the superior about an in-doubt transaction", "txId", txId, "phase", "recovery", "superior", m.superiors[txId])
+		go m.resolveWithSuperior(txId, m.superiors[txId])
+	}
+
 	if m.didSuicide {
 		m.log.writeSpecial(firstRestartAfterSuicideMarker)
 	}
 	return
 }
 
+// decideWithAcceptors settles a transaction recovery found undecided, once the acceptors decide it.
+// Instances of participants that never voted get Aborted forced onto them.
+func (m *Master) decideWithAcceptors(txId string) {
+	m.mu.Lock()
+	participants := m.participants[txId]
+	m.mu.Unlock()
+	state := m.paxos.outcome(txId, participants, true)
+	m.mu.Lock()
+	m.txs[txId] = state
+	m.mu.Unlock()
+
+	if state == Committed {
+		logInfo("Committing during recovery", "txId", txId, "phase", "recovery")
+		m.sendAndWaitForCommit("recover", txId, participants, make([]ReplicaDeath, m.replicaCount))
+		return
+	}
+	logInfo("Aborting during recovery", "txId", txId, "phase", "recovery")
+	m.sendAbort("recover", txId, participants)
+}
+
 func (m *Master) dieIf(actual MasterDeath, expected MasterDeath) {
 	if !m.didSuicide && actual == expected {
-		log.Println("Killing self as requested at", expected)
+		logWarn("Killing self as requested", "deathPoint", expected)
 		m.log.writeSpecial(killedSelfMarker)
 		os.Exit(1)
 	}
 }
 
-func runMaster(replicaCount int) {
-	if replicaCount <= 0 {
-		log.Fatalln("Replica count must be greater than 0.")
+func runMaster(cluster *ClusterConfig, id string, paxos bool) {
+	if len(cluster.Replicas) <= 0 {
+		logFatal("Replica count must be greater than 0.")
+	}
+
+	num := cluster.coordinatorIndex(id)
+	if num < 0 {
+		logFatal("Master is not in the cluster config.", "master", id)
 	}
 
-	master := NewMaster(replicaCount)
+	master := NewMaster(cluster, num)
+	if paxos {
+		master.enablePaxosCommit()
+	}
 	err := master.recover()
 	if err != nil {
-		log.Fatal("Error during recovery: ", err)
+		logFatal("Error during recovery", "error", err)
 	}
+	go archiveLoop(master.archiveLog)
+	go master.superiorLoop()
 
 	server := rpc.NewServer()
 	server.Register(master)
-	log.Println("Master listening on port", MasterPort)
-	http.ListenAndServe(MasterPort, server)
+	logInfo("Master listening", "address", master.node.Address)
+	http.ListenAndServe(master.node.Address, serveMux(server, master.metrics.registry, master.tracer))
 }
@@ -2,7 +2,7 @@
 package main
 
 import (
-	"log"
+	"io"
 	"net"
 	"net/rpc"
 )
@@ -33,14 +33,15 @@ func (c *MasterClient) tryConnect() (err error) {
 
 func (c *MasterClient) call(serviceMethod string, args interface{}, reply interface{}) (err error) {
 	err = c.rpcClient.Call(serviceMethod, args, reply)
+	// A server that died mid-call leaves an EOF rather than ErrShutdown, and the connection is dead too
 	_, isNetOpError := err.(*net.OpError)
-	if err == rpc.ErrShutdown || isNetOpError {
+	if err == rpc.ErrShutdown || err == io.EOF || err == io.ErrUnexpectedEOF || isNetOpError {
 		c.rpcClient = nil
 	}
 	return
 }
 
-func (c *MasterClient) Get(key string) (Value *string, err error) {
+func (c *MasterClient) Get(key string) (Result *GetResult, err error) {
 	if err = c.tryConnect(); err != nil {
 		return
 	}
@@ -48,16 +49,16 @@ func (c *MasterClient) Get(key string) (Value *string, err error) {
 	var reply GetResult
 	err = c.call("Master.Get", &GetArgs{ key }, &reply)
 	if err != nil {
-		log.Println("MasterClient.Get:", err)
+		logDebug("RPC failed", "call", "Master.Get", "host", c.host, "error", err)
 		return
 	}
 	
-	Value = &reply.Value
+	Result = &reply
 	
 	return
 }
 
-func (c *MasterClient) GetTest(key string, replicanum int) (Value *string, err error) {
+func (c *MasterClient) GetTest(key string, replicanum int) (Result *GetResult, err error) {
 	if err = c.tryConnect(); err != nil {
 		return
 	}
@@ -65,11 +66,11 @@ func (c *MasterClient) GetTest(key string, replicanum int) (Value *string, err e
 	var reply GetResult
 	err = c.call("Master.GetTest", &GetTestArgs{ key, replicanum }, &reply)
 	if err != nil {
-		log.Println("MasterClient.GetTest:", err)
+		logDebug("RPC failed", "call", "Master.GetTest", "host", c.host, "error", err)
 		return
 	}
 	
-	Value = &reply.Value
+	Result = &reply
 	
 	return
 }
@@ -82,7 +83,7 @@ func (c *MasterClient) Del(key string) (err error) {
 	var reply int
 	err = c.call("Master.Del", &DelArgs{ key }, &reply)
 	if err != nil {
-		log.Println("MasterClient.Del:", err)
+		logDebug("RPC failed", "call", "Master.Del", "host", c.host, "error", err)
 		return
 	}
 	
@@ -97,40 +98,123 @@ func (c *MasterClient) DelTest(key string, masterdeath MasterDeath, replicadeath
 	var reply int
 	err = c.call("Master.DelTest", &DelTestArgs{ key, masterdeath, replicadeaths }, &reply)
 	if err != nil {
-		log.Println("MasterClient.DelTest:", err)
+		logDebug("RPC failed", "call", "Master.DelTest", "host", c.host, "error", err)
+		return
+	}
+	
+	return
+}
+
+func (c *MasterClient) Put(key string, value []byte, contenttype string) (err error) {
+	if err = c.tryConnect(); err != nil {
+		return
+	}
+
+	var reply int
+	err = c.call("Master.Put", &PutArgs{ key, value, contenttype }, &reply)
+	if err != nil {
+		logDebug("RPC failed", "call", "Master.Put", "host", c.host, "error", err)
 		return
 	}
 	
 	return
 }
 
-func (c *MasterClient) Put(key string, value string) (err error) {
+func (c *MasterClient) PutTest(key string, value []byte, contenttype string, masterdeath MasterDeath, replicadeaths []ReplicaDeath) (err error) {
 	if err = c.tryConnect(); err != nil {
 		return
 	}
 
 	var reply int
-	err = c.call("Master.Put", &PutArgs{ key, value }, &reply)
+	err = c.call("Master.PutTest", &PutTestArgs{ key, value, contenttype, masterdeath, replicadeaths }, &reply)
 	if err != nil {
-		log.Println("MasterClient.Put:", err)
+		logDebug("RPC failed", "call", "Master.PutTest", "host", c.host, "error", err)
 		return
 	}
 	
 	return
 }
 
-func (c *MasterClient) PutTest(key string, value string, masterdeath MasterDeath, replicadeaths []ReplicaDeath) (err error) {
+func (c *MasterClient) Transact(ops []TxOp) (err error) {
 	if err = c.tryConnect(); err != nil {
 		return
 	}
 
 	var reply int
-	err = c.call("Master.PutTest", &PutTestArgs{ key, value, masterdeath, replicadeaths }, &reply)
+	err = c.call("Master.Transact", &TransactArgs{ ops }, &reply)
+	if err != nil {
+		logDebug("RPC failed", "call", "Master.Transact", "host", c.host, "error", err)
+		return
+	}
+	
+	return
+}
+
+func (c *MasterClient) Shard(key string) (Result *ShardResult, err error) {
+	if err = c.tryConnect(); err != nil {
+		return
+	}
+
+	var reply ShardResult
+	err = c.call("Master.Shard", &ShardArgs{ key }, &reply)
+	if err != nil {
+		logDebug("RPC failed", "call", "Master.Shard", "host", c.host, "error", err)
+		return
+	}
+	
+	Result = &reply
+	
+	return
+}
+
+func (c *MasterClient) Prepare(txid string, ops []TxOp, superior string) (Success *bool, err error) {
+	if err = c.tryConnect(); err != nil {
+		return
+	}
+
+	var reply VoteResult
+	err = c.call("Master.Prepare", &PrepareArgs{ txid, ops, superior }, &reply)
 	if err != nil {
-		log.Println("MasterClient.PutTest:", err)
+		logDebug("RPC failed", "call", "Master.Prepare", "host", c.host, "error", err)
 		return
 	}
 	
+	Success = &reply.Success
+	
+	return
+}
+
+func (c *MasterClient) Commit(txid string) (Success *bool, err error) {
+	if err = c.tryConnect(); err != nil {
+		return
+	}
+
+	var reply VoteResult
+	err = c.call("Master.Commit", &DecisionArgs{ txid }, &reply)
+	if err != nil {
+		logDebug("RPC failed", "call", "Master.Commit", "host", c.host, "error", err)
+		return
+	}
+	
+	Success = &reply.Success
+	
+	return
+}
+
+func (c *MasterClient) Abort(txid string) (Success *bool, err error) {
+	if err = c.tryConnect(); err != nil {
+		return
+	}
+
+	var reply VoteResult
+	err = c.call("Master.Abort", &DecisionArgs{ txid }, &reply)
+	if err != nil {
+		logDebug("RPC failed", "call", "Master.Abort", "host", c.host, "error", err)
+		return
+	}
+	
+	Success = &reply.Success
+	
 	return
 }
 
@@ -139,10 +223,10 @@ func (c *MasterClient) Ping(key string) (Value *string, err error) {
 		return
 	}
 
-	var reply GetResult
+	var reply PingResult
 	err = c.call("Master.Ping", &PingArgs{ key }, &reply)
 	if err != nil {
-		log.Println("MasterClient.Ping:", err)
+		logDebug("RPC failed", "call", "Master.Ping", "host", c.host, "error", err)
 		return
 	}
 	
@@ -151,6 +235,40 @@ func (c *MasterClient) Ping(key string) (Value *string, err error) {
 	return
 }
 
+func (c *MasterClient) Durability() (Result *DurabilityResult, err error) {
+	if err = c.tryConnect(); err != nil {
+		return
+	}
+
+	var reply DurabilityResult
+	err = c.call("Master.Durability", &DurabilityArgs{  }, &reply)
+	if err != nil {
+		logDebug("RPC failed", "call", "Master.Durability", "host", c.host, "error", err)
+		return
+	}
+	
+	Result = &reply
+	
+	return
+}
+
+func (c *MasterClient) Backup(path string) (Result *BackupResult, err error) {
+	if err = c.tryConnect(); err != nil {
+		return
+	}
+
+	var reply BackupResult
+	err = c.call("Master.Backup", &BackupArgs{ path }, &reply)
+	if err != nil {
+		logDebug("RPC failed", "call", "Master.Backup", "host", c.host, "error", err)
+		return
+	}
+	
+	Result = &reply
+	
+	return
+}
+
 func (c *MasterClient) Status(txid string) (State *TxState, err error) {
 	if err = c.tryConnect(); err != nil {
 		return
@@ -159,7 +277,7 @@ func (c *MasterClient) Status(txid string) (State *TxState, err error) {
 	var reply StatusResult
 	err = c.call("Master.Status", &StatusArgs{ txid }, &reply)
 	if err != nil {
-		log.Println("MasterClient.Status:", err)
+		logDebug("RPC failed", "call", "Master.Status", "host", c.host, "error", err)
 		return
 	}
 	
@@ -0,0 +1,116 @@
+// +build !goci
+package main
+
+import (
+	"fmt"
+	. "launchpad.net/gocheck"
+	"os"
+	"strings"
+	"sync"
+)
+
+type MasterSuite struct{}
+
+var _ = Suite(&MasterSuite{})
+
+func (s *MasterSuite) TearDownTest(c *C) {
+	os.Remove(testClusterPath)
+	os.RemoveAll("./test.master")
+}
+
+func (s *MasterSuite) TestTwoMastersTransactAtOnce(c *C) {
+	servers, addresses := serveTestNodes(c, 4)
+	cluster, err := loadTestCluster(c, fmt.Sprintf(`{
+		"Master": {"Id": "m1", "Address": "%v", "LogPath": "test.master/logs/m1.txt"},
+		"Masters": [{"Id": "m2", "Address": "%v", "LogPath": "test.master/logs/m2.txt"}],
+		"Replicas": [
+			{"Id": "a", "Address": "%v", "DataDir": "test.master/data/a", "LogPath": "test.master/logs/a.txt"},
+			{"Id": "b", "Address": "%v", "DataDir": "test.master/data/b", "LogPath": "test.master/logs/b.txt"}
+		]
+	}`, addresses...))
+	c.Assert(err, IsNil)
+	replicas := []*Replica{startTestReplica(c, cluster, 0, servers[2]), startTestReplica(c, cluster, 1, servers[3])}
+	masters := []*Master{NewMaster(cluster, 0), NewMaster(cluster, 1)}
+	for i, m := range masters {
+		c.Assert(m.recover(), IsNil)
+		servers[i].Register(m)
+	}
+
+	// Each client writes a key of its own, which must commit, then races the others for a shared key,
+	// which may abort on a lock the other master holds
+	var wg sync.WaitGroup
+	errs := make(chan error, 40)
+	for i, m := range masters {
+		for j := 0; j < 10; j++ {
+			wg.Add(1)
+			go func(m *Master, client string) {
+				defer wg.Done()
+				var reply int
+				errs <- m.Put(&PutArgs{client, []byte(client), ""}, &reply)
+				err := m.Put(&PutArgs{"shared", []byte(client), ""}, &reply)
+				if err != TxAbortedError {
+					errs <- err
+				}
+			}(m, fmt.Sprint(cluster.coordinators()[i].Id, ".client", j))
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		c.Assert(err, IsNil)
+	}
+
+	for _, r := range replicas {
+		for _, node := range cluster.coordinators() {
+			for j := 0; j < 10; j++ {
+				client := fmt.Sprint(node.Id, ".client", j)
+				c.Assert(replicaValue(r, client), Equals, client)
+			}
+		}
+		c.Assert(replicaValue(r, "shared"), Equals, replicaValue(replicas[0], "shared"))
+		c.Assert(r.lockedKeys, HasLen, 0)
+		// Every transaction is tagged with the master that ran it, so their txIds can't collide
+		for txId, tx := range r.txs {
+			c.Assert(strings.HasPrefix(txId, tx.coordinatorId+"-"), Equals, true)
+		}
+	}
+}
+
+func (s *MasterSuite) TestCommitsAreRecoveredWithTheirParticipantsOnceStartedIsArchived(c *C) {
+	servers, addresses := serveTestNodes(c, 3)
+	cluster, err := loadTestCluster(c, fmt.Sprintf(`{
+		"Master": {"Id": "m", "Address": "%v", "LogPath": "test.master/logs/m.txt"},
+		"Replicas": [
+			{"Id": "a", "Address": "%v", "DataDir": "test.master/data/a", "LogPath": "test.master/logs/a.txt"},
+			{"Id": "b", "Address": "%v", "DataDir": "test.master/data/b", "LogPath": "test.master/logs/b.txt"}
+		],
+		"Sharding": "range",
+		"Shards": [{"Id": "low", "Replicas": ["a"]}, {"Id": "high", "Replicas": ["b"], "StartKey": "m"}]
+	}`, addresses...))
+	c.Assert(err, IsNil)
+	startTestReplica(c, cluster, 0, servers[1])
+	startTestReplica(c, cluster, 1, servers[2])
+	m := NewMaster(cluster, 0)
+	c.Assert(m.recover(), IsNil)
+	var reply int
+	c.Assert(m.Put(&PutArgs{"zebra", []byte("striped"), ""}, &reply), IsNil)
+
+	// Leave out the Started entry, as if its segment had been archived
+	entries, err := m.log.read()
+	c.Assert(err, IsNil)
+	cluster.Master.LogPath = "test.master/logs/m2.txt"
+	l := newLogger(cluster.Master.LogPath, WalLogFormat, syncDurability)
+	for _, e := range entries {
+		if e.state != Started {
+			l.writeEntry(e)
+		}
+	}
+
+	// Replica a never saw the transaction, so committing it there again would never succeed
+	m = NewMaster(cluster, 0)
+	c.Assert(m.recover(), IsNil)
+	for txId, state := range m.txs {
+		c.Assert(state, Equals, Committed)
+		c.Assert(m.participants[txId], DeepEquals, []int{1})
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// memoryStore keeps values in a map. Values are copied in and out, so callers can't change what is
+// stored by holding on to a slice.
+type memoryStore struct {
+	values map[string][]byte
+	mu     sync.RWMutex
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{make(map[string][]byte), sync.RWMutex{}}
+}
+
+func copyBytes(b []byte) []byte {
+	return append([]byte{}, b...)
+}
+
+func (s *memoryStore) get(key string) (value []byte, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	value, ok := s.values[key]
+	if !ok {
+		return nil, errors.New(fmt.Sprint("Key not found: ", key))
+	}
+	return copyBytes(value), nil
+}
+
+func (s *memoryStore) put(key string, value []byte) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[key] = copyBytes(value)
+	return nil
+}
+
+func (s *memoryStore) del(key string) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, key)
+	return nil
+}
+
+func (s *memoryStore) list() (keys []string, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys = make([]string, 0, len(s.values))
+	for key := range s.values {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// iterate works on a snapshot, so f may write to the store
+func (s *memoryStore) iterate(f func(key string, value []byte) error) (err error) {
+	s.mu.RLock()
+	snapshot := make(map[string][]byte, len(s.values))
+	for key, value := range s.values {
+		snapshot[key] = value
+	}
+	s.mu.RUnlock()
+
+	for key, value := range snapshot {
+		err = f(key, copyBytes(value))
+		if err != nil {
+			return
+		}
+	}
+	return nil
+}
+
+// batch applies all of the ops or, if one is invalid, none of them
+func (s *memoryStore) batch(ops []storeOp) (err error) {
+	for _, op := range ops {
+		if op.op != PutOp && op.op != DelOp {
+			return errors.New(fmt.Sprint("Unsupported op in batch: ", op.op.String()))
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, op := range ops {
+		if op.op == PutOp {
+			s.values[op.key] = copyBytes(op.value)
+		} else {
+			delete(s.values, op.key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/rpc"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Masters and replicas publish their metrics at /metrics, next to the RPC handler, in the
+// Prometheus text exposition format. Only counters, gauges and latency histograms are needed, which
+// is little enough not to pull in a metrics library.
+
+// latencyBuckets are the upper bounds, in seconds, of the buckets every histogram counts into
+var latencyBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// counter counts events, separately for each set of labels
+type counter struct {
+	mu     sync.Mutex
+	values map[string]uint64
+}
+
+func newCounter() *counter {
+	return &counter{values: make(map[string]uint64)}
+}
+
+// add adds n to the count of the labels, given as name and value pairs
+func (c *counter) add(n uint64, labels ...string) {
+	key := formatLabels(labels)
+	c.mu.Lock()
+	c.values[key] += n
+	c.mu.Unlock()
+}
+
+func (c *counter) inc(labels ...string) {
+	c.add(1, labels...)
+}
+
+func (c *counter) write(w io.Writer, name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %d\n", name, key, c.values[key])
+	}
+}
+
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// histogram counts durations into latencyBuckets
+type histogram struct {
+	mu     sync.Mutex
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]uint64, len(latencyBuckets))}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	seconds := d.Seconds()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// since observes the time passed since start, for deferring at the start of what is timed
+func (h *histogram) since(start time.Time) {
+	h.observe(time.Since(start))
+}
+
+func (h *histogram) write(w io.Writer, name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, bound := range latencyBuckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, bound, h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %g\n", name, h.sum)
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+type metric struct {
+	name  string
+	help  string
+	kind  string
+	write func(w io.Writer, name string)
+}
+
+// metricsRegistry is the metrics of one node, in the order they are published
+type metricsRegistry struct {
+	metrics []metric
+}
+
+func (r *metricsRegistry) counter(name string, help string) *counter {
+	c := newCounter()
+	r.metrics = append(r.metrics, metric{name, help, "counter", c.write})
+	return c
+}
+
+func (r *metricsRegistry) histogram(name string, help string, h *histogram) *histogram {
+	r.metrics = append(r.metrics, metric{name, help, "histogram", h.write})
+	return h
+}
+
+// gauge publishes what value returns at the time of each scrape
+func (r *metricsRegistry) gauge(name string, help string, value func() int) {
+	r.metrics = append(r.metrics, metric{name, help, "gauge", func(w io.Writer, name string) {
+		fmt.Fprintf(w, "%s %d\n", name, value())
+	}})
+}
+
+func (r *metricsRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.writeTo(w)
+}
+
+func (r *metricsRegistry) writeTo(w io.Writer) {
+	for _, m := range r.metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+		m.write(w, m.name)
+	}
+}
+
+// serveMux serves a node's RPCs, its metrics and its traces on one address
+func serveMux(server *rpc.Server, metrics *metricsRegistry, traces *tracer) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle(rpc.DefaultRPCPath, server)
+	mux.Handle("/metrics", metrics)
+	mux.Handle("/trace", traces)
+	return mux
+}
+
+// masterMetrics are what a master publishes. Transactions are counted by outcome, and by the reason
+// for it: "prepared" or "vote" when the master decided it, "recovery" when a restart did, and
+// "superior" for the decisions of a superior master.
+type masterMetrics struct {
+	registry     *metricsRegistry
+	transactions *counter
+	prepare      *histogram
+	commit       *histogram
+}
+
+func newMasterMetrics(m *Master) *masterMetrics {
+	r := &metricsRegistry{}
+	metrics := &masterMetrics{
+		r,
+		r.counter("twopc_master_transactions_total", "Transactions the master finished, by outcome and reason."),
+		r.histogram("twopc_master_prepare_seconds", "Time the prepare phase took.", newHistogram()),
+		r.histogram("twopc_master_commit_seconds", "Time until every participant acknowledged a commit.", newHistogram()),
+	}
+	r.gauge("twopc_master_in_flight_transactions", "Transactions started but not yet decided.", func() int {
+		return m.countTxs(Started)
+	})
+	r.gauge("twopc_master_in_doubt_transactions", "Transactions prepared as a subordinate, waiting on the superior.", func() int {
+		return m.countTxs(Prepared)
+	})
+	r.histogram("twopc_log_fsync_seconds", "Time each fsync of the log took.", m.log.fsyncs)
+	return metrics
+}
+
+// replicaMetrics are what a replica publishes. Transactions are counted by outcome and reason:
+// "coordinator" for its Commit or Abort, "resolved" when the replica asked for the outcome itself,
+// and "lock_conflict" or "temp_store_error" when the replica voted to abort.
+type replicaMetrics struct {
+	registry      *metricsRegistry
+	transactions  *counter
+	lockConflicts *counter
+	prepare       *histogram
+	commit        *histogram
+}
+
+func newReplicaMetrics(r *Replica) *replicaMetrics {
+	reg := &metricsRegistry{}
+	metrics := &replicaMetrics{
+		reg,
+		reg.counter("twopc_replica_transactions_total", "Transactions the replica finished, by outcome and reason."),
+		reg.counter("twopc_replica_lock_conflicts_total", "Transactions aborted because a key was locked by another one."),
+		reg.histogram("twopc_replica_prepare_seconds", "Time preparing a transaction took.", newHistogram()),
+		reg.histogram("twopc_replica_commit_seconds", "Time applying a commit took.", newHistogram()),
+	}
+	metrics.lockConflicts.add(0)
+	reg.gauge("twopc_replica_prepared_transactions", "Transactions prepared and waiting for the outcome.", func() int {
+		return r.countPrepared()
+	})
+	reg.gauge("twopc_replica_in_doubt_transactions", "Transactions left prepared by a restart that are not resolved yet.", func() int {
+		return r.countInDoubt()
+	})
+	reg.histogram("twopc_log_fsync_seconds", "Time each fsync of the log took.", r.log.fsyncs)
+	return metrics
+}
@@ -0,0 +1,51 @@
+// +build !goci
+package main
+
+import (
+	"bytes"
+	. "launchpad.net/gocheck"
+	"net/http/httptest"
+	"strings"
+	"time"
+)
+
+type MetricsSuite struct{}
+
+var _ = Suite(&MetricsSuite{})
+
+func (s *MetricsSuite) TestExpositionFormat(c *C) {
+	r := &metricsRegistry{}
+	txs := r.counter("txs_total", "Transactions.")
+	txs.inc("outcome", "committed")
+	txs.add(2, "outcome", "aborted")
+	latency := r.histogram("latency_seconds", "Latency.", newHistogram())
+	latency.observe(3 * time.Millisecond)
+	latency.observe(2 * time.Second)
+	r.gauge("in_flight", "In flight.", func() int { return 7 })
+
+	var out bytes.Buffer
+	r.writeTo(&out)
+	lines := strings.Split(out.String(), "\n")
+	c.Assert(lines[:4], DeepEquals, []string{
+		"# HELP txs_total Transactions.",
+		"# TYPE txs_total counter",
+		`txs_total{outcome="aborted"} 2`,
+		`txs_total{outcome="committed"} 1`,
+	})
+	c.Assert(lines[6], Equals, `latency_seconds_bucket{le="0.0005"} 0`)
+	c.Assert(lines[9], Equals, `latency_seconds_bucket{le="0.005"} 1`)
+	c.Assert(lines[17], Equals, `latency_seconds_bucket{le="2.5"} 2`)
+	c.Assert(lines[20], Equals, `latency_seconds_bucket{le="+Inf"} 2`)
+	c.Assert(lines[21], Equals, "latency_seconds_sum 2.003")
+	c.Assert(lines[22], Equals, "latency_seconds_count 2")
+	c.Assert(lines[23:26], DeepEquals, []string{"# HELP in_flight In flight.", "# TYPE in_flight gauge", "in_flight 7"})
+}
+
+func (s *MetricsSuite) TestServedOverHttp(c *C) {
+	r := &metricsRegistry{}
+	r.counter("txs_total", "Transactions.").inc()
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	c.Assert(recorder.Header().Get("Content-Type"), Equals, "text/plain; version=0.0.4")
+	c.Assert(recorder.Body.String(), Matches, "(?s).*\ntxs_total 1\n")
+}
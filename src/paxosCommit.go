@@ -0,0 +1,175 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// In Paxos Commit every participant's vote is its own Paxos instance, decided by the acceptor group
+// rather than by a single coordinator's log. A participant proposes its vote at ballot 0; anyone who
+// later finds an instance undecided may start a higher ballot, which can only ever choose Aborted
+// for a participant that never got its vote accepted. The transaction commits iff every instance
+// chose Prepared.
+
+const paxosResolveTimeout = 2 * time.Second
+
+type acceptorEndpoint interface {
+	Prepare(txId string, instance int, ballot int) (*AcceptorPromise, error)
+	Accept(txId string, instance int, ballot int, value TxState) (*bool, error)
+	Learn(txId string, instance int) (*AcceptorPromise, error)
+}
+
+type paxosCommit struct {
+	proposerId int
+	proposers  int
+	acceptors  []acceptorEndpoint
+	round      int
+	mu         sync.Mutex
+}
+
+// newPaxosCommit builds a proposer/learner over the replica-hosted acceptors. Replicas use their own
+// number as proposer id, masters the replica count plus their coordinator index, so ballots never
+// collide.
+func newPaxosCommit(proposerId int, cluster *ClusterConfig, local *Acceptor) *paxosCommit {
+	replicaCount := len(cluster.Replicas)
+	acceptors := make([]acceptorEndpoint, replicaCount)
+	for i, node := range cluster.Replicas {
+		if local != nil && local.num == i {
+			acceptors[i] = &localAcceptor{local}
+		} else {
+			acceptors[i] = NewAcceptorClient(node.Address)
+		}
+	}
+	return &paxosCommit{proposerId, replicaCount + len(cluster.coordinators()), acceptors, 0, sync.Mutex{}}
+}
+
+func (p *paxosCommit) majority() int {
+	return len(p.acceptors)/2 + 1
+}
+
+func (p *paxosCommit) nextBallot(atLeast int) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		p.round++
+		ballot := p.round*p.proposers + p.proposerId
+		if ballot > atLeast {
+			return ballot
+		}
+	}
+}
+
+func (p *paxosCommit) forEachAcceptor(f func(a acceptorEndpoint)) {
+	var wg sync.WaitGroup
+	wg.Add(len(p.acceptors))
+	for _, a := range p.acceptors {
+		go func(a acceptorEndpoint) {
+			defer wg.Done()
+			f(a)
+		}(a)
+	}
+	wg.Wait()
+}
+
+// vote proposes a participant's own vote at ballot 0 and reports whether a majority accepted it
+func (p *paxosCommit) vote(txId string, instance int, value TxState) bool {
+	return p.accept(txId, instance, 0, value)
+}
+
+func (p *paxosCommit) accept(txId string, instance int, ballot int, value TxState) bool {
+	var mu sync.Mutex
+	accepted := 0
+	p.forEachAcceptor(func(a acceptorEndpoint) {
+		ok, err := a.Accept(txId, instance, ballot, value)
+		if err == nil && *ok {
+			mu.Lock()
+			accepted++
+			mu.Unlock()
+		}
+	})
+	return accepted >= p.majority()
+}
+
+// learnInstance returns the value chosen for an instance, if a majority has accepted the same ballot
+func (p *paxosCommit) learnInstance(txId string, instance int) (value TxState, chosen bool) {
+	var mu sync.Mutex
+	counts := make(map[int]int)
+	values := make(map[int]TxState)
+	p.forEachAcceptor(func(a acceptorEndpoint) {
+		promise, err := a.Learn(txId, instance)
+		if err != nil || !promise.Ok {
+			return
+		}
+		mu.Lock()
+		counts[promise.AcceptedBallot]++
+		values[promise.AcceptedBallot] = promise.AcceptedValue
+		mu.Unlock()
+	})
+	for ballot, count := range counts {
+		if count >= p.majority() {
+			return values[ballot], true
+		}
+	}
+	return NoState, false
+}
+
+// decideInstance runs a full ballot for an undecided instance, proposing Aborted unless some acceptor
+// already accepted a value, in which case that value must be carried forward.
+func (p *paxosCommit) decideInstance(txId string, instance int) TxState {
+	highestSeen := 0
+	for {
+		if value, chosen := p.learnInstance(txId, instance); chosen {
+			return value
+		}
+
+		ballot := p.nextBallot(highestSeen)
+		var mu sync.Mutex
+		promises := 0
+		acceptedBallot := NoBallot
+		value := Aborted
+		p.forEachAcceptor(func(a acceptorEndpoint) {
+			promise, err := a.Prepare(txId, instance, ballot)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if promise.AcceptedBallot > highestSeen {
+				highestSeen = promise.AcceptedBallot
+			}
+			if !promise.Ok {
+				return
+			}
+			promises++
+			if promise.AcceptedBallot > acceptedBallot {
+				acceptedBallot = promise.AcceptedBallot
+				value = promise.AcceptedValue
+			}
+		})
+
+		if promises >= p.majority() && p.accept(txId, instance, ballot, value) {
+			return value
+		}
+
+		logInfo("Paxos ballot failed, retrying", "txId", txId, "instance", instance, "ballot", ballot)
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// outcome learns the decision for a transaction from the instances of its participants. If force is
+// set, undecided instances are driven to a decision, otherwise they are reported as NoState.
+func (p *paxosCommit) outcome(txId string, participants []int, force bool) TxState {
+	for _, i := range participants {
+		value, chosen := p.learnInstance(txId, i)
+		if !chosen {
+			if !force {
+				return NoState
+			}
+			value = p.decideInstance(txId, i)
+		}
+		if value != Prepared {
+			return Aborted
+		}
+	}
+	return Committed
+}
@@ -0,0 +1,193 @@
+// +build !goci
+package main
+
+import (
+	"errors"
+	"fmt"
+	. "launchpad.net/gocheck"
+	"os"
+	"sync"
+)
+
+type PaxosCommitSuite struct{}
+
+var _ = Suite(&PaxosCommitSuite{})
+
+func (s *PaxosCommitSuite) TearDownTest(c *C) {
+	os.Remove(testClusterPath)
+	os.RemoveAll("./test.paxos")
+}
+
+// downAcceptor is an acceptor that can't be reached
+type downAcceptor struct{}
+
+var errAcceptorDown = errors.New("acceptor is down")
+
+func (downAcceptor) Prepare(txId string, instance int, ballot int) (*AcceptorPromise, error) {
+	return nil, errAcceptorDown
+}
+
+func (downAcceptor) Accept(txId string, instance int, ballot int, value TxState) (*bool, error) {
+	return nil, errAcceptorDown
+}
+
+func (downAcceptor) Learn(txId string, instance int) (*AcceptorPromise, error) {
+	return nil, errAcceptorDown
+}
+
+// lateAcceptor is an acceptor that can't be reached until ready is closed
+type lateAcceptor struct {
+	acceptorEndpoint
+	ready chan bool
+}
+
+func (a lateAcceptor) reachable() bool {
+	select {
+	case <-a.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+func (a lateAcceptor) Prepare(txId string, instance int, ballot int) (*AcceptorPromise, error) {
+	if !a.reachable() {
+		return nil, errAcceptorDown
+	}
+	return a.acceptorEndpoint.Prepare(txId, instance, ballot)
+}
+
+func (a lateAcceptor) Accept(txId string, instance int, ballot int, value TxState) (*bool, error) {
+	if !a.reachable() {
+		return nil, errAcceptorDown
+	}
+	return a.acceptorEndpoint.Accept(txId, instance, ballot, value)
+}
+
+func (a lateAcceptor) Learn(txId string, instance int) (*AcceptorPromise, error) {
+	if !a.reachable() {
+		return nil, errAcceptorDown
+	}
+	return a.acceptorEndpoint.Learn(txId, instance)
+}
+
+func testAcceptor(num int) *Acceptor {
+	return NewAcceptor(num, fmt.Sprint("test.paxos/acceptor", num, ".txt"), WalLogFormat, syncDurability)
+}
+
+// testPaxos is a proposer over in-process acceptors, with proposerId out of proposers
+func testPaxos(proposerId int, proposers int, acceptors ...*Acceptor) *paxosCommit {
+	endpoints := make([]acceptorEndpoint, len(acceptors))
+	for i, a := range acceptors {
+		endpoints[i] = &localAcceptor{a}
+	}
+	return &paxosCommit{proposerId, proposers, endpoints, 0, sync.Mutex{}}
+}
+
+func (s *PaxosCommitSuite) TestUndecidedInstanceIsDecidedAborted(c *C) {
+	p := testPaxos(0, 2, testAcceptor(0), testAcceptor(1), testAcceptor(2))
+	c.Assert(p.decideInstance("tx1", 0), Equals, Aborted)
+
+	value, chosen := p.learnInstance("tx1", 0)
+	c.Assert(chosen, Equals, true)
+	c.Assert(value, Equals, Aborted)
+	// A late vote can't change the decision
+	c.Assert(p.vote("tx1", 0, Prepared), Equals, false)
+}
+
+func (s *PaxosCommitSuite) TestAnAcceptedVoteIsCarriedForward(c *C) {
+	acceptors := []*Acceptor{testAcceptor(0), testAcceptor(1), testAcceptor(2)}
+	// Only one acceptor got the participant's vote before it died
+	var reply AcceptorAcceptResult
+	c.Assert(acceptors[0].Accept(&AcceptorAcceptArgs{"tx1", 0, 0, Prepared}, &reply), IsNil)
+	c.Assert(reply.Accepted, Equals, true)
+
+	p := testPaxos(1, 2, acceptors...)
+	_, chosen := p.learnInstance("tx1", 0)
+	c.Assert(chosen, Equals, false)
+	c.Assert(p.decideInstance("tx1", 0), Equals, Prepared)
+}
+
+func (s *PaxosCommitSuite) TestAMajorityDecidesWithoutTheRest(c *C) {
+	acceptors := []*Acceptor{testAcceptor(0), testAcceptor(1), testAcceptor(2)}
+	p := testPaxos(0, 2, acceptors...)
+	p.acceptors[2] = downAcceptor{}
+	c.Assert(p.vote("tx1", 0, Prepared), Equals, true)
+	c.Assert(p.vote("tx1", 1, Prepared), Equals, true)
+	c.Assert(p.outcome("tx1", []int{0, 1}, false), Equals, Committed)
+
+	p.acceptors[1] = downAcceptor{}
+	c.Assert(p.vote("tx2", 0, Prepared), Equals, false)
+	c.Assert(p.outcome("tx2", []int{0}, false), Equals, NoState)
+}
+
+func (s *PaxosCommitSuite) TestOutcome(c *C) {
+	p := testPaxos(0, 2, testAcceptor(0), testAcceptor(1), testAcceptor(2))
+	c.Assert(p.vote("tx1", 0, Prepared), Equals, true)
+	c.Assert(p.vote("tx1", 1, Prepared), Equals, true)
+	c.Assert(p.outcome("tx1", []int{0, 1}, false), Equals, Committed)
+
+	c.Assert(p.vote("tx2", 0, Prepared), Equals, true)
+	c.Assert(p.vote("tx2", 1, Aborted), Equals, true)
+	c.Assert(p.outcome("tx2", []int{0, 1}, false), Equals, Aborted)
+
+	// Participant 1 never voted: only forcing decides the instance
+	c.Assert(p.vote("tx3", 0, Prepared), Equals, true)
+	c.Assert(p.outcome("tx3", []int{0, 1}, false), Equals, NoState)
+	c.Assert(p.outcome("tx3", []int{0, 1}, true), Equals, Aborted)
+	c.Assert(p.outcome("tx3", []int{0, 1}, false), Equals, Aborted)
+}
+
+func (s *PaxosCommitSuite) TestBallotsOfDifferentProposersNeverCollide(c *C) {
+	a, b := testPaxos(0, 3, testAcceptor(0)), testPaxos(2, 3, testAcceptor(1))
+	seen := make(map[int]bool)
+	for i := 0; i < 10; i++ {
+		for _, ballot := range []int{a.nextBallot(0), b.nextBallot(0)} {
+			c.Assert(seen[ballot], Equals, false)
+			seen[ballot] = true
+		}
+	}
+	c.Assert(a.nextBallot(100) > 100, Equals, true)
+}
+
+func (s *PaxosCommitSuite) TestAcceptorStateSurvivesARestart(c *C) {
+	a := testAcceptor(0)
+	var promise AcceptorPromise
+	c.Assert(a.Prepare(&AcceptorPrepareArgs{"tx1", 0, 5}, &promise), IsNil)
+	c.Assert(promise.Ok, Equals, true)
+	var reply AcceptorAcceptResult
+	c.Assert(a.Accept(&AcceptorAcceptArgs{"tx1", 0, 5, Aborted}, &reply), IsNil)
+	c.Assert(reply.Accepted, Equals, true)
+
+	a = testAcceptor(0)
+	c.Assert(a.recover(), IsNil)
+	c.Assert(a.Learn(&AcceptorLearnArgs{"tx1", 0}, &promise), IsNil)
+	c.Assert(promise, Equals, AcceptorPromise{true, 5, Aborted})
+	// The promise is kept too, so a lower ballot is refused
+	c.Assert(a.Prepare(&AcceptorPrepareArgs{"tx1", 0, 3}, &promise), IsNil)
+	c.Assert(promise.Ok, Equals, false)
+}
+
+func (s *PaxosCommitSuite) TestMasterRecoveryDoesNotWaitForTheAcceptors(c *C) {
+	cluster, err := loadTestCluster(c, `{
+		"Master": {"Id": "m", "Address": "localhost:1", "LogPath": "test.paxos/logs/m.txt"},
+		"Replicas": [{"Id": "a", "Address": "localhost:2", "DataDir": "test.paxos/data/a", "LogPath": "test.paxos/logs/a.txt"}]
+	}`)
+	c.Assert(err, IsNil)
+	m := NewMaster(cluster, 0)
+	m.log.writeTxOp("m-tx1", Started, NoOp, "", []int{0})
+
+	// Only one acceptor of three is up, so nothing can be decided
+	ready := make(chan bool)
+	m.paxos = testPaxos(1, 2, testAcceptor(0), testAcceptor(1), testAcceptor(2))
+	for i := 1; i < 3; i++ {
+		m.paxos.acceptors[i] = lateAcceptor{m.paxos.acceptors[i], ready}
+	}
+	c.Assert(m.recover(), IsNil)
+	var status StatusResult
+	c.Assert(m.Status(&StatusArgs{"m-tx1"}, &status), IsNil)
+	c.Assert(status.State, Equals, Prepared)
+
+	close(ready)
+	waitFor(c, func() bool { return m.countTxs(Aborted) == 1 })
+}
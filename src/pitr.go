@@ -0,0 +1,227 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	flag "github.com/ogier/pflag"
+	"hash/crc32"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"time"
+)
+
+// Point-in-time recovery rebuilds the committed data as of a commit sequence number or a time, from
+// copies of the replicas' data directories and their logs, archived segments included. A replica
+// logs the value of every write it commits, so the commits can be redone on top of the copies in
+// log order. Which commits make the cut is up to each transaction's coordinator: one is redone when
+// the coordinator committed it at or before the point, so every shard is cut at the same place.
+//
+// Writes the copies already hold are redone harmlessly, but nothing can be undone, so the copies
+// must have been taken before the point. The result is written as a backup, which restore then
+// seeds a fresh cluster with.
+
+// recoveryPoint is either a commit sequence number of the cluster's master, or a time
+type recoveryPoint struct {
+	seq  uint64
+	time time.Time
+}
+
+func (p recoveryPoint) String() string {
+	if p.seq > 0 {
+		return fmt.Sprint("commit ", p.seq)
+	}
+	return p.time.UTC().Format(time.RFC3339Nano)
+}
+
+// committedTx is a transaction as its coordinator logged the commit
+type committedTx struct {
+	seq  uint64
+	time time.Time
+}
+
+// includes reports whether a transaction is redone. Without its coordinator's entry only the time
+// the replica committed it can place it.
+func (p recoveryPoint) includes(tx committedTx, ok bool, replicaTime time.Time) bool {
+	if p.seq > 0 {
+		return ok && tx.seq > 0 && tx.seq <= p.seq
+	}
+	t := tx.time
+	if !ok {
+		t = replicaTime
+	}
+	return !t.IsZero() && !t.After(p.time)
+}
+
+// replayTx is what a replica's log says about one transaction
+type replayTx struct {
+	prepared int
+	writes   []logEntry
+	done     bool
+}
+
+// recoverToPoint returns the committed data of each shard as of the point, and warnings about
+// commits that couldn't be redone
+func recoverToPoint(cluster *ClusterConfig, point recoveryPoint) (manifest backupManifest, data [][]byte, warnings []string, err error) {
+	if point.seq > 0 && len(cluster.Masters) > 0 {
+		return manifest, nil, nil, errors.New("Commit sequence numbers only order one master's commits, recover this cluster to a time instead.")
+	}
+
+	commits := make(map[string]committedTx)
+	for _, n := range cluster.coordinators() {
+		entries, err := readNodeHistory(n)
+		if err != nil {
+			return manifest, nil, nil, err
+		}
+		for _, e := range entries {
+			if _, ok := commits[e.txId]; !ok && e.state == Committed {
+				commits[e.txId] = committedTx{e.seq, e.time}
+			}
+		}
+	}
+
+	manifest = backupManifest{backupVersion, time.Now().UTC(), cluster.Master.Id, nil, point.String()}
+	for n, shard := range cluster.Shards {
+		values, replica, shardWarnings, err := recoverShard(cluster, shard, commits, point)
+		if err != nil {
+			return manifest, nil, nil, err
+		}
+		warnings = append(warnings, shardWarnings...)
+
+		keys := make([]string, 0, len(values))
+		for key := range values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		var shardData []byte
+		for _, key := range keys {
+			shardData = appendBackupEntry(shardData, key, values[key])
+		}
+		data = append(data, shardData)
+		manifest.Shards = append(manifest.Shards, backupShard{shard.Id, replica, fmt.Sprint("shards/", n, ".data"), len(keys), crc32.ChecksumIEEE(shardData)})
+	}
+	return
+}
+
+// recoverShard redoes the commits in the log of the shard's first replica with a data directory
+func recoverShard(cluster *ClusterConfig, shard ShardConfig, commits map[string]committedTx, point recoveryPoint) (values map[string][]byte, replica string, warnings []string, err error) {
+	var node NodeConfig
+	var store storageEngine
+	for _, i := range shard.replicaIndexes {
+		var damage []storeDamage
+		var reason string
+		store, damage, reason = openReplicaStore(cluster.Replicas[i], "committed")
+		if store != nil {
+			node = cluster.Replicas[i]
+			for _, d := range damage {
+				warnings = append(warnings, fmt.Sprint("replica ", d.Replica, " ", d.Store, " store: ", d.Problem, ", left out"))
+			}
+			break
+		}
+		warnings = append(warnings, reason)
+	}
+	if store == nil {
+		return nil, "", warnings, errors.New(fmt.Sprint("No replica of shard ", shard.Id, " has its data"))
+	}
+
+	values = make(map[string][]byte)
+	err = store.iterate(func(key string, value []byte) error {
+		values[key] = value
+		return nil
+	})
+	closeStore(store)
+	if err != nil {
+		return
+	}
+	entries, err := readNodeHistory(node)
+	if err != nil {
+		return
+	}
+
+	txs := make(map[string]*replayTx)
+	for _, e := range entries {
+		tx, ok := txs[e.txId]
+		if !ok {
+			tx = &replayTx{}
+			txs[e.txId] = tx
+		}
+		switch {
+		case e.state == Prepared && e.key != "":
+			tx.prepared++
+		case e.state == Committed && e.op != NoOp:
+			tx.writes = append(tx.writes, e)
+		case e.state == Committed && !tx.done:
+			tx.done = true
+			c, ok := commits[e.txId]
+			if !point.includes(c, ok, e.time) {
+				if !ok && point.seq > 0 {
+					warnings = append(warnings, fmt.Sprint("Tx ", e.txId, " on replica ", node.Id, " isn't in its coordinator's log, so it wasn't redone"))
+				}
+				continue
+			}
+			// A commit logged before values were can't be redone
+			if len(tx.writes) != tx.prepared {
+				warnings = append(warnings, fmt.Sprint("Tx ", e.txId, " on replica ", node.Id, " has no values logged, so it wasn't redone"))
+				continue
+			}
+			for _, w := range tx.writes {
+				switch w.op {
+				case PutOp:
+					values[w.key] = w.value
+				case DelOp:
+					delete(values, w.key)
+				}
+			}
+		}
+	}
+	return values, node.Id, warnings, nil
+}
+
+func readNodeHistory(node NodeConfig) (entries []logEntry, err error) {
+	l, err := openLog(node.LogPath)
+	if err != nil {
+		return
+	}
+	return l.readHistory(node.ArchiveDir)
+}
+
+// pitrCommand implements "pitr", which writes the committed data of the stopped cluster as of a
+// commit sequence number or a time to a backup file
+func pitrCommand(args []string) {
+	flags := flag.NewFlagSet("pitr", flag.ExitOnError)
+	configPath := flags.StringP("config", "c", "", "cluster config file (JSON) whose copied data and logs to recover from")
+	replicaCount := flags.IntP("replicaCount", "n", 0, "replica count, required without a cluster config")
+	toSeq := flags.Int("to-seq", 0, "recover up to and including this commit sequence number of the master")
+	toTime := flags.String("to-time", "", "recover the commits made up to and including this time (RFC 3339)")
+	flags.Parse(args)
+	if len(flags.Args()) != 1 || (*toSeq > 0) == (*toTime != "") {
+		log.Fatalln("Usage: pitr [-c cluster.json] --to-seq=<seq> | --to-time=<time> <backup file>")
+	}
+
+	point := recoveryPoint{uint64(*toSeq), time.Time{}}
+	if *toTime != "" {
+		var err error
+		point.time, err = time.Parse(time.RFC3339, *toTime)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	manifest, data, warnings, err := recoverToPoint(loadCommandCluster(*configPath, *replicaCount), point)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	for _, w := range warnings {
+		log.Println("Warning:", w)
+	}
+	backupPath := flags.Args()[0]
+	err = os.MkdirAll(path.Dir(backupPath), 0777)
+	if err == nil {
+		err = writeBackup(backupPath, manifest, data)
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Println("Wrote the data as of", point, "to", backupPath)
+}
@@ -0,0 +1,111 @@
+// +build !goci
+package main
+
+import (
+	. "launchpad.net/gocheck"
+	"os"
+	"time"
+)
+
+type PitrSuite struct{}
+
+var _ = Suite(&PitrSuite{})
+
+func (s *PitrSuite) TearDownTest(c *C) {
+	os.Remove(testClusterPath)
+	os.RemoveAll("./test.pitr")
+}
+
+// writePitrHistory copies the data when it only holds apple, then commits three transactions:
+// tx1 puts apple, tx2 puts apple and zebra and deletes avocado, and tx3 puts zebra again
+func writePitrHistory(c *C, cluster *ClusterConfig) {
+	a, b := cluster.Replicas[0], cluster.Replicas[1]
+	putInStore(c, a, "committed", "apple", "v0")
+	putInStore(c, a, "committed", "avocado", "v0")
+	closeStore(newStorageEngine(b.StorageEngine, b.DataDir+"/committed"))
+
+	master := newLogger(cluster.Master.LogPath, WalLogFormat, syncDurability)
+	replicaA := newLogger(a.LogPath, WalLogFormat, syncDurability)
+	replicaA.segmentSize = 1
+	replicaB := newLogger(b.LogPath, WalLogFormat, syncDurability)
+	at := func(seconds int) time.Time {
+		return testStart.Add(time.Duration(seconds) * time.Second)
+	}
+	prepare := func(l *logger, txId string, keys ...string) {
+		for _, key := range keys {
+			l.writeEntry(logEntry{txId, Prepared, PutOp, key, nil, "", "", time.Time{}, 0, nil})
+		}
+	}
+
+	prepare(replicaA, "tx1", "apple")
+	master.writeEntry(logEntry{"tx1", Committed, NoOp, "", nil, "", "", at(1), 1, nil})
+	replicaA.writeEntries(redoEntries("tx1", []storeOp{{PutOp, "apple", []byte("v1")}})...)
+
+	prepare(replicaA, "tx2", "apple", "avocado")
+	prepare(replicaB, "tx2", "zebra")
+	master.writeEntry(logEntry{"tx2", Committed, NoOp, "", nil, "", "", at(2), 2, nil})
+	replicaA.writeEntries(redoEntries("tx2", []storeOp{{PutOp, "apple", []byte("v2")}, {DelOp, "avocado", nil}})...)
+	replicaB.writeEntries(redoEntries("tx2", []storeOp{{PutOp, "zebra", []byte("v2")}})...)
+
+	prepare(replicaB, "tx3", "zebra")
+	master.writeEntry(logEntry{"tx3", Committed, NoOp, "", nil, "", "", at(3), 3, nil})
+	replicaB.writeEntries(redoEntries("tx3", []storeOp{{PutOp, "zebra", []byte("v3")}})...)
+}
+
+func recoveredValues(c *C, cluster *ClusterConfig, point recoveryPoint) map[string]string {
+	manifest, data, warnings, err := recoverToPoint(cluster, point)
+	c.Assert(err, IsNil)
+	c.Assert(warnings, HasLen, 0)
+	c.Assert(manifest.AsOf, Equals, point.String())
+	values := make(map[string]string)
+	for _, shardData := range data {
+		entries, err := decodeBackupEntries(shardData)
+		c.Assert(err, IsNil)
+		for _, e := range entries {
+			values[e.Key] = string(e.Value)
+		}
+	}
+	return values
+}
+
+func (s *PitrSuite) TestRecoverToASequenceNumber(c *C) {
+	cluster := twoReplicaTestCluster(c, "test.pitr", true)
+	writePitrHistory(c, cluster)
+
+	c.Assert(recoveredValues(c, cluster, recoveryPoint{1, time.Time{}}), DeepEquals, map[string]string{"apple": "v1", "avocado": "v0"})
+	c.Assert(recoveredValues(c, cluster, recoveryPoint{2, time.Time{}}), DeepEquals, map[string]string{"apple": "v2", "zebra": "v2"})
+	c.Assert(recoveredValues(c, cluster, recoveryPoint{3, time.Time{}}), DeepEquals, map[string]string{"apple": "v2", "zebra": "v3"})
+}
+
+func (s *PitrSuite) TestRecoverToATimeFromArchivedLogs(c *C) {
+	for _, compress := range []bool{false, true} {
+		os.RemoveAll("./test.pitr")
+		cluster := twoReplicaTestCluster(c, "test.pitr", true)
+		cluster.Replicas[0].CompressArchive = compress
+		writePitrHistory(c, cluster)
+		a := cluster.Replicas[0]
+		l, err := openLog(a.LogPath)
+		c.Assert(err, IsNil)
+		archived, err := l.archive(a.ArchiveDir, a.CompressArchive, func(entries []logEntry) bool {
+			return false
+		})
+		c.Assert(err, IsNil)
+		c.Assert(len(archived) > 0, Equals, true)
+
+		c.Assert(recoveredValues(c, cluster, recoveryPoint{0, testStart.Add(1500 * time.Millisecond)}), DeepEquals, map[string]string{"apple": "v1", "avocado": "v0"})
+	}
+}
+
+func (s *PitrSuite) TestCommitsWithoutValuesAreReported(c *C) {
+	cluster := twoReplicaTestCluster(c, "test.pitr", true)
+	writePitrHistory(c, cluster)
+	// A commit logged before values were only logs that it's committed
+	replicaB := newLogger(cluster.Replicas[1].LogPath, WalLogFormat, syncDurability)
+	replicaB.writeEntry(logEntry{"tx4", Prepared, PutOp, "zebra", nil, "", "", time.Time{}, 0, nil})
+	newLogger(cluster.Master.LogPath, WalLogFormat, syncDurability).writeEntry(logEntry{"tx4", Committed, NoOp, "", nil, "", "", time.Time{}, 4, nil})
+	replicaB.writeState("tx4", Committed)
+
+	_, _, warnings, err := recoverToPoint(cluster, recoveryPoint{4, time.Time{}})
+	c.Assert(err, IsNil)
+	c.Assert(warnings, DeepEquals, []string{"Tx tx4 on replica b has no values logged, so it wasn't redone"})
+}
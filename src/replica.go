@@ -3,26 +3,32 @@ package main
 import (
 	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"net/rpc"
 	"os"
+	"path"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 type Tx struct {
-	id    string
-	key   string
-	op    Operation
-	state TxState
+	id            string
+	ops           []TxOp
+	state         TxState
+	participants  []int
+	coordinatorId string
+	coordinator   string
 }
 
 type TxPutArgs struct {
-	Key   string
-	Value string
-	TxId  string
-	Die   ReplicaDeath
+	Key         string
+	Value       []byte
+	ContentType string
+	TxId        string
+	Die         ReplicaDeath
 }
 
 type TxDelArgs struct {
@@ -31,6 +37,17 @@ type TxDelArgs struct {
 	Die  ReplicaDeath
 }
 
+// TxArgs carries the id and address of the master coordinating the transaction, so recovery can
+// ask that master for the outcome
+type TxArgs struct {
+	TxId          string
+	Ops           []TxOp
+	Participants  []int
+	CoordinatorId string
+	Coordinator   string
+	Die           ReplicaDeath
+}
+
 type CommitArgs struct {
 	TxId string
 	Die  ReplicaDeath
@@ -45,114 +62,376 @@ type ReplicaKeyArgs struct {
 }
 
 type ReplicaGetResult struct {
+	Value       []byte
+	ContentType string
+}
+
+type ReplicaPingResult struct {
 	Value string
 }
 
+type ReplicaDurabilityArgs struct{}
+
+type ReplicaDurabilityResult struct {
+	Level          string
+	SyncIntervalMs int
+}
+
+type ReplicaSnapshotArgs struct {
+	Id string
+}
+
+type ReadSnapshotArgs struct {
+	Id     string
+	Offset int
+	Limit  int
+}
+
+type ReadSnapshotResult struct {
+	Entries []SnapshotEntry
+	Done    bool
+}
+
+// SnapshotEntry is a committed key and its value as the storage engine holds it
+type SnapshotEntry struct {
+	Key   string
+	Value []byte
+}
+
 type ReplicaActionResult struct {
 	Success bool
 }
 
+type ReplicaRecoveryArgs struct{}
+
+// ReplicaRecoveryResult is how far a restarting replica got: whether it has read its log yet, and
+// the transactions from it that are still in doubt
+type ReplicaRecoveryResult struct {
+	Recovering bool
+	LogRead    bool
+	InDoubt    []string
+	Resolved   int
+}
+
 type Replica struct {
 	num            int
-	committedStore *keyValueStore
-	tempStore      *keyValueStore
+	cluster        *ClusterConfig
+	committedStore storageEngine
+	tempStore      storageEngine
 	txs            map[string]*Tx
 	lockedKeys     map[string]bool
+	snapshots      map[string]*storeSnapshot
 	log            *logger
 	didSuicide     bool
+	acceptor       *Acceptor
+	paxos          *paxosCommit
+	recovery       *replicaRecovery
+	metrics        *replicaMetrics
+	tracer         *tracer
+	mu             sync.Mutex
+}
+
+// replicaRecovery tracks a restart until every transaction the log left in doubt is resolved.
+// Until then only requests that don't touch the in-doubt keys are served.
+type replicaRecovery struct {
+	logRead bool
+	inDoubt map[string]*Tx
+	total   int
+}
+
+// recoveringPrefix starts the errors of requests a recovering replica can't serve yet, which
+// succeed if retried later
+const recoveringPrefix = "Recovering, retry later: "
+
+func isRetryable(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), recoveringPrefix)
+}
+
+func recoveringError(reason ...interface{}) error {
+	return errors.New(recoveringPrefix + fmt.Sprint(reason...))
+}
+
+// recoveryBlocks returns a retryable error if recovery hasn't yet worked out whether key is in
+// doubt, or it is. Callers hold r.mu.
+func (r *Replica) recoveryBlocks(key string) error {
+	if r.recovery == nil {
+		return nil
+	}
+	if !r.recovery.logRead {
+		return recoveringError("the log hasn't been read yet")
+	}
+	for txId, tx := range r.recovery.inDoubt {
+		for _, op := range tx.ops {
+			if op.Key == key {
+				return recoveringError("key ", key, " is in doubt in tx ", txId)
+			}
+		}
+	}
+	return nil
+}
+
+// settled notes that a transaction is no longer in doubt, and ends recovery with the last one.
+// Callers hold r.mu.
+func (r *Replica) settled(txId string) {
+	if r.recovery == nil || r.recovery.inDoubt[txId] == nil {
+		return
+	}
+	delete(r.recovery.inDoubt, txId)
+	if len(r.recovery.inDoubt) == 0 {
+		logInfo("Recovery finished, all in-doubt transactions are resolved", "phase", "recovery", "resolved", r.recovery.total)
+		r.recovery = nil
+	}
 }
 
-func NewReplica(num int) *Replica {
-	l := newLogger(fmt.Sprintf("logs/replica%v.txt", num))
-	return &Replica{
+func NewReplica(cluster *ClusterConfig, num int) *Replica {
+	node := cluster.Replicas[num]
+	l := newLogger(node.LogPath, node.LogFormat, node.logDurability())
+	r := &Replica{
 		num,
-		newKeyValueStore(fmt.Sprintf("data/replica%v/committed", num)),
-		newKeyValueStore(fmt.Sprintf("data/replica%v/temp", num)),
+		cluster,
+		newStorageEngine(node.StorageEngine, path.Join(node.DataDir, "committed")),
+		newStorageEngine(node.StorageEngine, path.Join(node.DataDir, "temp")),
 		make(map[string]*Tx),
 		make(map[string]bool),
+		make(map[string]*storeSnapshot),
 		l,
-		false}
+		false,
+		nil,
+		nil,
+		nil,
+		nil,
+		newTracer(node.Id),
+		sync.Mutex{}}
+	r.metrics = newReplicaMetrics(r)
+	return r
 }
 
-func (r *Replica) getTempStoreKey(txId string, key string) string {
-	return txId + "__" + key
+// enablePaxosCommit makes this replica host an acceptor and resolve its in-doubt transactions through
+// the acceptor group instead of asking the master.
+func (r *Replica) enablePaxosCommit() {
+	node := r.cluster.Replicas[r.num]
+	r.acceptor = NewAcceptor(r.num, node.AcceptorLogPath, node.LogFormat, node.logDurability())
+	r.paxos = newPaxosCommit(r.num, r.cluster, r.acceptor)
 }
 
-func (r *Replica) parseTempStoreKey(key string) (txId string, txKey string) {
-	split := strings.Split(key, "__")
-	return split[0], split[1]
+// tempStoreKey prefixes the key with the txId and the txId's length, so that neither needs escaping
+func tempStoreKey(txId string, key string) string {
+	return fmt.Sprint(len(txId), ":", txId, key)
+}
+
+func parseTempStoreKey(tempKey string) (txId string, txKey string, err error) {
+	split := strings.SplitN(tempKey, ":", 2)
+	if len(split) == 2 {
+		n, err := strconv.Atoi(split[0])
+		if err == nil && n >= 0 && n <= len(split[1]) {
+			return split[1][:n], split[1][n:], nil
+		}
+	}
+	return "", "", errors.New(fmt.Sprint("Malformed temp store key: ", tempKey))
+}
+
+// parseLegacyTempStoreKey parses the temp keys from before they were prefixed with the txId's
+// length, which were the txId and the key joined by "__". TxIds were random alphanumerics then, so
+// the first "__" ends the txId.
+func parseLegacyTempStoreKey(tempKey string) (txId string, txKey string, ok bool) {
+	split := strings.SplitN(tempKey, "__", 2)
+	if len(split) != 2 {
+		return "", "", false
+	}
+	return split[0], split[1], true
 }
 
 func (r *Replica) TryPut(args *TxPutArgs, reply *ReplicaActionResult) (err error) {
-	writeToTempStore := func() error { return r.tempStore.put(r.getTempStoreKey(args.TxId, args.Key), args.Value) }
-	return r.tryMutate(args.Key, args.TxId, args.Die, PutOp, writeToTempStore, reply)
+	ops := []TxOp{{PutOp, args.Key, args.Value, args.ContentType, ""}}
+	tx := &Tx{args.TxId, ops, Started, r.cluster.shardFor(args.Key).replicaIndexes, r.cluster.Master.Id, r.cluster.Master.Address}
+	return r.tryMutate(tx, args.Die, reply)
 }
 
 func (r *Replica) TryDel(args *TxDelArgs, reply *ReplicaActionResult) (err error) {
-	return r.tryMutate(args.Key, args.TxId, args.Die, DelOp, nil, reply)
+	ops := []TxOp{{DelOp, args.Key, nil, "", ""}}
+	tx := &Tx{args.TxId, ops, Started, r.cluster.shardFor(args.Key).replicaIndexes, r.cluster.Master.Id, r.cluster.Master.Address}
+	return r.tryMutate(tx, args.Die, reply)
 }
 
-func (r *Replica) tryMutate(key string, txId string, die ReplicaDeath, op Operation, f func() error, reply *ReplicaActionResult) (err error) {
-	r.dieIf(die, ReplicaDieBeforeProcessingMutateRequest)
+// TryTx prepares all of a transaction's ops that belong to this replica, and votes once for them
+func (r *Replica) TryTx(args *TxArgs, reply *ReplicaActionResult) (err error) {
+	tx := &Tx{args.TxId, args.Ops, Started, args.Participants, args.CoordinatorId, args.Coordinator}
+	return r.tryMutate(tx, args.Die, reply)
+}
+
+func (r *Replica) tryMutate(tx *Tx, die ReplicaDeath, reply *ReplicaActionResult) (err error) {
+	start := time.Now()
+	defer r.metrics.prepare.since(start)
+	defer func() {
+		r.tracer.record(tx.id, "", "prepare", start, "ops", len(tx.ops), "vote", reply.Success, "error", errorString(err))
+	}()
 	reply.Success = false
 
-	r.txs[txId] = &Tx{txId, key, op, Started}
+	vote, err := r.prepare(tx, die)
+	reply.Success = vote == Prepared
+	if r.paxos != nil && vote != NoState {
+		// The acceptors are asked without holding r.mu, so other requests don't wait on them. Our
+		// vote only counts once they have it. If they don't, the transaction will abort, and we stay
+		// prepared until we hear so.
+		accepted := r.paxos.vote(tx.id, r.num, vote)
+		if vote == Prepared {
+			reply.Success = accepted
+			go r.resolveInDoubt(tx.id)
+		}
+	}
+	return
+}
+
+// prepare locks a transaction's keys, stores its values and logs it as prepared. It returns the
+// replica's vote, or NoState when the replica can't take part yet.
+func (r *Replica) prepare(tx *Tx, die ReplicaDeath) (vote TxState, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
-	if _, ok := r.lockedKeys[key]; ok {
-		// Key is currently being modified, Abort
-		log.Println("Received", op.String(), "for locked key:", key, "in tx:", txId, " Aborting")
-		r.txs[txId].state = Aborted
-		r.log.writeState(txId, Aborted)
-		return nil
+	txId, ops := tx.id, tx.ops
+	// Until the log is read, a death point can't tell whether it already fired
+	if r.recovery != nil && !r.recovery.logRead {
+		return NoState, recoveringError("the log hasn't been read yet")
+	}
+	r.dieIf(die, ReplicaDieBeforeProcessingMutateRequest)
+	r.txs[txId] = tx
+
+	for _, op := range ops {
+		if _, ok := r.lockedKeys[op.Key]; ok {
+			// Key is currently being modified, Abort
+			logInfo("Key is locked, aborting", "txId", txId, "key", op.Key, "op", op.Op, "phase", "prepare")
+			tx.state = Aborted
+			r.log.writeState(txId, Aborted)
+			r.metrics.lockConflicts.inc()
+			r.metrics.transactions.inc("outcome", "aborted", "reason", "lock_conflict")
+			// The key frees up once recovery resolves it, so the client may as well try again
+			return Aborted, r.recoveryBlocks(op.Key)
+		}
 	}
 
-	r.lockedKeys[key] = true
+	for _, op := range ops {
+		r.lockedKeys[op.Key] = true
+	}
 
-	if f != nil {
-		err = f()
+	for _, op := range ops {
+		if op.Op != PutOp {
+			continue
+		}
+		err = r.tempStore.put(tempStoreKey(txId, op.Key), encodeValue(op.Value, op.ContentType))
 		if err != nil {
-			log.Println("Unable to", op.String(), "uncommited val for transaction:", txId, "key:", key, ", Aborting")
-			r.txs[txId].state = Aborted
-			r.log.writeState(txId, Aborted)
-			delete(r.lockedKeys, key)
-			return
+			logError("Unable to store uncommitted value, aborting", "txId", txId, "key", op.Key, "phase", "prepare", "error", err)
+			r.abortTx(tx)
+			r.metrics.transactions.inc("outcome", "aborted", "reason", "temp_store_error")
+			return Aborted, err
 		}
 	}
 
-	r.txs[txId].state = Prepared
-	r.log.writeOp(txId, Prepared, op, key)
-	reply.Success = true
+	tx.state = Prepared
+	logStart := time.Now()
+	r.log.writeEntries(preparedEntries(tx)...)
+	r.tracer.record(txId, "", "log prepared", logStart)
 
 	r.dieIf(die, ReplicaDieAfterLoggingPrepared)
+	return Prepared, nil
+}
+
+// resolveInDoubt settles a transaction that is still prepared after a while, by learning (or forcing)
+// the outcome from the acceptors, so a dead master doesn't leave the keys locked.
+func (r *Replica) resolveInDoubt(txId string) {
+	time.Sleep(paxosResolveTimeout)
+	r.resolvePrepared(txId)
+}
 
+// resolvePrepared asks for the outcome of a prepared transaction and applies it, unless a Commit or
+// Abort got here first
+func (r *Replica) resolvePrepared(txId string) {
+	tx := r.preparedTx(txId)
+	if tx == nil {
+		return
+	}
+
+	logInfo("Resolving in-doubt transaction", "txId", txId, "phase", "recovery")
+	state := r.getStatus(tx)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if tx.state != Prepared {
+		return
+	}
+	switch state {
+	case Committed:
+		err := r.commitTx(tx, ReplicaDontDie)
+		if err != nil {
+			logError("Unable to commit in-doubt transaction", "txId", txId, "phase", "recovery", "error", err)
+			return
+		}
+		r.metrics.transactions.inc("outcome", "committed", "reason", "resolved")
+	case Aborted, NoState:
+		// A coordinator that doesn't know the transaction aborted it and has since archived it, or
+		// never logged it at all: either way we presume abort
+		r.abortTx(tx)
+		r.metrics.transactions.inc("outcome", "aborted", "reason", "resolved")
+	}
+}
+
+func (r *Replica) countPrepared() (n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, tx := range r.txs {
+		if tx.state == Prepared {
+			n++
+		}
+	}
 	return
 }
 
-func (r *Replica) Commit(args *CommitArgs, reply *ReplicaActionResult) (err error) {
-	r.dieIf(args.Die, ReplicaDieBeforeProcessingCommit)
+func (r *Replica) countInDoubt() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.recovery == nil {
+		return 0
+	}
+	return len(r.recovery.inDoubt)
+}
 
+func (r *Replica) preparedTx(txId string) *Tx {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tx, ok := r.txs[txId]
+	if !ok || tx.state != Prepared {
+		return nil
+	}
+	return tx
+}
+
+func (r *Replica) Commit(args *CommitArgs, reply *ReplicaActionResult) (err error) {
 	reply.Success = false
 
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	txId := args.TxId
+	if r.recovery != nil && !r.recovery.logRead {
+		return recoveringError("the log hasn't been read yet")
+	}
+	r.dieIf(args.Die, ReplicaDieBeforeProcessingCommit)
 
 	tx, hasTx := r.txs[txId]
 	if !hasTx {
 		// Error! We've never heard of this transaction
-		log.Println("Received commit for unknown transaction:", txId)
+		logWarn("Received commit for unknown transaction", "txId", txId, "phase", "commit")
 		return errors.New(fmt.Sprint("Received commit for unknown transaction:", txId))
 	}
 
-	_, keyLocked := r.lockedKeys[tx.key]
-	if !keyLocked {
-		// Shouldn't happen, key is unlocked
-		log.Println("Received commit for transaction with unlocked key:", txId)
-	}
-
 	switch tx.state {
 	case Prepared:
-		err = r.commitTx(txId, tx.op, tx.key, args.Die)
+		r.warnIfUnlocked("commit", tx)
+		err = r.commitTx(tx, args.Die)
+		if err == nil {
+			r.metrics.transactions.inc("outcome", "committed", "reason", "coordinator")
+		}
 	default:
-		log.Println("Received commit for transaction in state ", tx.state.String())
+		logInfo("Received commit for finished transaction", "txId", txId, "phase", "commit", "state", tx.state)
 	}
 
 	if err == nil {
@@ -161,37 +440,101 @@ func (r *Replica) Commit(args *CommitArgs, reply *ReplicaActionResult) (err erro
 	return
 }
 
-func (r *Replica) commitTx(txId string, op Operation, key string, die ReplicaDeath) (err error) {
-	delete(r.lockedKeys, key)
-
-	switch op {
-	case PutOp:
-		val, err := r.tempStore.get(r.getTempStoreKey(txId, key))
-		if err != nil {
-			return errors.New(fmt.Sprint("Unable to find val for uncommitted tx:", txId, "key:", key))
+func (r *Replica) warnIfUnlocked(action string, tx *Tx) {
+	for _, op := range tx.ops {
+		if _, keyLocked := r.lockedKeys[op.Key]; !keyLocked {
+			// Shouldn't happen, key is unlocked
+			logWarn("Transaction's key is unlocked", "txId", tx.id, "key", op.Key, "phase", action)
 		}
-		err = r.committedStore.put(key, val)
-		if err != nil {
-			return errors.New(fmt.Sprint("Unable to put committed val for tx:", txId, "key:", key))
+	}
+}
+
+// preparedEntries are what a replica logs once it is prepared: an entry per op, carrying the value
+// a put is going to store, so that recovery can redo the commit from the log alone
+func preparedEntries(tx *Tx) []logEntry {
+	entries := make([]logEntry, len(tx.ops))
+	for i, op := range tx.ops {
+		var value []byte
+		if op.Op == PutOp {
+			value = encodeValue(op.Value, op.ContentType)
 		}
-	case DelOp:
-		err = r.committedStore.del(key)
-		if err != nil {
-			return errors.New(fmt.Sprint("Unable to commit del val for tx:", txId, "key:", key))
+		entries[i] = logEntry{tx.id, Prepared, op.Op, op.Key, tx.participants, tx.coordinator, tx.coordinatorId, time.Time{}, 0, value}
+	}
+	return entries
+}
+
+// recoveredOp is the op of a prepared entry. Entries from before values were logged only have the
+// value in the temp store, which RecoveryOp stands for.
+func recoveredOp(e logEntry) TxOp {
+	if e.op == PutOp && len(e.value) == 0 {
+		return TxOp{RecoveryOp, e.key, nil, "", ""}
+	}
+	value, contentType := decodeValue(e.value)
+	return TxOp{e.op, e.key, value, contentType, ""}
+}
+
+// redoEntries are what a replica logs for a commit: an entry per write with the value it stored,
+// then one without an op that marks the commit as done. Point-in-time recovery redoes the writes
+// in front of a commit's marker.
+func redoEntries(txId string, writes []storeOp) []logEntry {
+	entries := make([]logEntry, 0, len(writes)+1)
+	for _, w := range writes {
+		entries = append(entries, logEntry{txId, Committed, w.op, w.key, nil, "", "", time.Time{}, 0, w.value})
+	}
+	return append(entries, logEntry{txId, Committed, NoOp, "", nil, "", "", time.Time{}, 0, nil})
+}
+
+// commitTx applies a prepared transaction. The tx stays in txs as Committed, so a repeated
+// Commit from the master still succeeds. Applying it again is harmless, which lets recovery redo a
+// commit that may already have reached the committed store.
+func (r *Replica) commitTx(tx *Tx, die ReplicaDeath) (err error) {
+	start := time.Now()
+	defer r.metrics.commit.since(start)
+	defer func() {
+		r.tracer.record(tx.id, "", "commit", start, "ops", len(tx.ops), "error", errorString(err))
+	}()
+	txId := tx.id
+	writes := make([]storeOp, 0, len(tx.ops))
+	for _, op := range tx.ops {
+		key := op.Key
+		delete(r.lockedKeys, key)
+
+		switch op.Op {
+		case PutOp:
+			writes = append(writes, storeOp{PutOp, key, encodeValue(op.Value, op.ContentType)})
+		case RecoveryOp:
+			val, err := r.tempStore.get(tempStoreKey(txId, key))
+			if err != nil {
+				return errors.New(fmt.Sprint("Unable to find val for uncommitted tx:", txId, "key:", key))
+			}
+			writes = append(writes, storeOp{PutOp, key, val})
+		case DelOp:
+			writes = append(writes, storeOp{DelOp, key, nil})
 		}
 	}
 
-	r.log.writeState(txId, Committed)
-	delete(r.txs, txId)
+	r.preserveForSnapshots(writes)
+	err = r.committedStore.batch(writes)
+	if err != nil {
+		return errors.New(fmt.Sprint("Unable to apply committed writes for tx:", txId, " ", err))
+	}
+
+	logStart := time.Now()
+	r.log.writeEntries(redoEntries(txId, writes)...)
+	r.tracer.record(txId, "", "log committed", logStart)
+	tx.state = Committed
+	r.settled(txId)
 
 	// Delete the temp data only after committed, in case we crash after deleting, but before committing
-	if op == PutOp {
-		err = r.tempStore.del(r.getTempStoreKey(txId, key))
-		r.dieIf(die, ReplicaDieAfterDeletingFromTempStore)
-		if err != nil {
-			fmt.Println("Unable to del committed val for tx:", txId, "key:", key)
+	for _, op := range tx.ops {
+		if op.Op == PutOp || op.Op == RecoveryOp {
+			err = r.tempStore.del(tempStoreKey(txId, op.Key))
+			if err != nil {
+				logWarn("Unable to delete committed value from temp store", "txId", txId, "key", op.Key, "phase", "commit", "error", err)
+			}
 		}
 	}
+	r.dieIf(die, ReplicaDieAfterDeletingFromTempStore)
 
 	r.dieIf(die, ReplicaDieAfterLoggingCommitted)
 	return nil
@@ -200,7 +543,13 @@ func (r *Replica) commitTx(txId string, op Operation, key string, die ReplicaDea
 func (r *Replica) Abort(args *AbortArgs, reply *ReplicaActionResult) (err error) {
 	reply.Success = false
 
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	txId := args.TxId
+	if r.recovery != nil && !r.recovery.logRead {
+		return recoveringError("the log hasn't been read yet")
+	}
 
 	tx, hasTx := r.txs[txId]
 	if !hasTx {
@@ -208,93 +557,177 @@ func (r *Replica) Abort(args *AbortArgs, reply *ReplicaActionResult) (err error)
 		return errors.New(fmt.Sprint("Received abort for unknown transaction:", txId))
 	}
 
-	_, keyLocked := r.lockedKeys[tx.key]
-	if !keyLocked {
-		// Shouldn't happen, key is unlocked
-		log.Println("Received abort for transaction with unlocked key:", txId)
-	}
-
 	switch tx.state {
 	case Prepared:
-		r.abortTx(txId, tx.op, tx.key)
+		r.warnIfUnlocked("abort", tx)
+		r.abortTx(tx)
+		r.metrics.transactions.inc("outcome", "aborted", "reason", "coordinator")
 	default:
-		log.Println("Received abort for transaction in state ", tx.state.String())
+		logInfo("Received abort for finished transaction", "txId", txId, "phase", "abort", "state", tx.state)
 	}
 
 	reply.Success = true
 	return nil
 }
 
-func (r *Replica) abortTx(txId string, op Operation, key string) {
-	delete(r.lockedKeys, key)
+func (r *Replica) abortTx(tx *Tx) {
+	defer r.tracer.record(tx.id, "", "abort", time.Now())
+	for _, op := range tx.ops {
+		delete(r.lockedKeys, op.Key)
 
-	switch op {
-	case PutOp:
-		// We no longer need the temp stored value
-		err := r.tempStore.del(r.getTempStoreKey(txId, key))
-		if err != nil {
-			fmt.Println("Unable to del val for uncommitted tx:", txId, "key:", key)
+		switch op.Op {
+		case PutOp, RecoveryOp:
+			// We no longer need the temp stored value
+			err := r.tempStore.del(tempStoreKey(tx.id, op.Key))
+			if err != nil {
+				logWarn("Unable to delete uncommitted value from temp store", "txId", tx.id, "key", op.Key, "phase", "abort", "error", err)
+			}
+			//case DelOp:
+			// nothing to undo here
 		}
-		//case DelOp:
-		// nothing to undo here
 	}
 
-	r.log.writeState(txId, Aborted)
-	delete(r.txs, txId)
+	r.log.writeState(tx.id, Aborted)
+	tx.state = Aborted
+	r.settled(tx.id)
 }
 
 func (r *Replica) Get(args *ReplicaKeyArgs, reply *ReplicaGetResult) (err error) {
-	val, err := r.committedStore.get(args.Key)
+	r.mu.Lock()
+	err = r.recoveryBlocks(args.Key)
+	r.mu.Unlock()
+	if err != nil {
+		return
+	}
+
+	stored, err := r.committedStore.get(args.Key)
 	if err != nil {
 		return
 	}
-	reply.Value = val
+	reply.Value, reply.ContentType = decodeValue(stored)
 	return
 }
 
-func (r *Replica) Ping(args *ReplicaKeyArgs, reply *ReplicaGetResult) (err error) {
+func (r *Replica) Ping(args *ReplicaKeyArgs, reply *ReplicaPingResult) (err error) {
 	reply.Value = args.Key
 	return nil
 }
 
+// Recovery reports how far the replica is with recovering from a restart
+func (r *Replica) Recovery(args *ReplicaRecoveryArgs, reply *ReplicaRecoveryResult) (err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.recovery == nil {
+		reply.LogRead = true
+		return nil
+	}
+	reply.Recovering = true
+	reply.LogRead = r.recovery.logRead
+	for txId := range r.recovery.inDoubt {
+		reply.InDoubt = append(reply.InDoubt, txId)
+	}
+	sort.Strings(reply.InDoubt)
+	reply.Resolved = r.recovery.total - len(r.recovery.inDoubt)
+	return nil
+}
+
+// Durability reports the durability level of the replica's logs
+func (r *Replica) Durability(args *ReplicaDurabilityArgs, reply *ReplicaDurabilityResult) (err error) {
+	reply.Level = r.log.durability.level
+	reply.SyncIntervalMs = int(r.log.durability.syncInterval / time.Millisecond)
+	return nil
+}
+
+// BeginSnapshot starts a snapshot of the committed store, which keeps reading as of now until
+// EndSnapshot, or until nobody has read it for snapshotIdleTimeout
+func (r *Replica) BeginSnapshot(args *ReplicaSnapshotArgs, reply *ReplicaActionResult) (err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	keys, err := r.committedStore.list()
+	if err != nil {
+		return
+	}
+	id := args.Id
+	r.snapshots[id] = newStoreSnapshot(keys, time.AfterFunc(snapshotIdleTimeout, func() {
+		r.endSnapshot(id)
+	}))
+	reply.Success = true
+	return nil
+}
+
+// ReadSnapshot returns up to Limit of the snapshot's entries, in key order, from the Offset'th on
+func (r *Replica) ReadSnapshot(args *ReadSnapshotArgs, reply *ReadSnapshotResult) (err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.snapshots[args.Id]
+	if !ok {
+		return errors.New(fmt.Sprint("Unknown snapshot: ", args.Id))
+	}
+	s.timer.Reset(snapshotIdleTimeout)
+	reply.Entries, reply.Done, err = s.read(r.committedStore, args.Offset, args.Limit)
+	return
+}
+
+func (r *Replica) EndSnapshot(args *ReplicaSnapshotArgs, reply *ReplicaActionResult) (err error) {
+	r.endSnapshot(args.Id)
+	reply.Success = true
+	return nil
+}
+
 func (r *Replica) recover() (err error) {
 	entries, err := r.log.read()
 	if err != nil {
 		return
 	}
 
-	r.didSuicide = false
+	// A tx's entries are gathered first, since a prepared one is only reinstated once all its ops
+	// are known. Redo entries of a commit don't change its state.
+	var order []string
+	txs := make(map[string]*Tx)
+	didSuicide := false
 	for _, entry := range entries {
 		switch entry.txId {
 		case killedSelfMarker:
-			r.didSuicide = true
+			didSuicide = true
 			continue
 		case firstRestartAfterSuicideMarker:
-			r.didSuicide = false
+			didSuicide = false
 			continue
 		}
 
-		if entry.state == Prepared {
-			entry.state = r.getStatus(entry.txId)
-			switch entry.state {
-			case Aborted:
-				log.Println("Aborting transaction during recovery: ", entry.txId, entry.key)
-				r.abortTx(entry.txId, RecoveryOp, entry.key)
-			case Committed:
-				log.Println("Committing transaction during recovery: ", entry.txId, entry.key)
-				r.commitTx(entry.txId, RecoveryOp, entry.key, ReplicaDontDie)
-			}
+		tx, ok := txs[entry.txId]
+		if !ok {
+			tx = &Tx{entry.txId, nil, NoState, entry.participants, entry.coordinatorId, entry.coordinator}
+			txs[entry.txId] = tx
+			order = append(order, entry.txId)
 		}
+		switch {
+		case entry.state == Prepared:
+			tx.ops = append(tx.ops, recoveredOp(entry))
+			tx.state = Prepared
+			tx.participants, tx.coordinatorId, tx.coordinator = entry.participants, entry.coordinatorId, entry.coordinator
+		case entry.state == Committed && entry.op != NoOp:
+		case entry.state == Committed || entry.state == Aborted:
+			tx.state = entry.state
+		}
+	}
 
-		switch entry.state {
-		case Started:
-		case Prepared:
-			// abort
-		case Committed:
-			r.txs[entry.txId] = &Tx{entry.txId, entry.key, entry.op, Committed}
-		case Aborted:
-			r.txs[entry.txId] = &Tx{entry.txId, entry.key, entry.op, Aborted}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.didSuicide = didSuicide
+	inDoubt := make(map[string]*Tx)
+	for _, txId := range order {
+		tx := txs[txId]
+		if tx.state == NoState {
+			continue
 		}
+		if tx.state == Prepared {
+			for _, op := range tx.ops {
+				r.lockedKeys[op.Key] = true
+			}
+			inDoubt[txId] = tx
+		}
+		r.txs[txId] = tx
 	}
 
 	err = r.cleanUpTempStore()
@@ -305,6 +738,18 @@ func (r *Replica) recover() (err error) {
 	if r.didSuicide {
 		r.log.writeSpecial(firstRestartAfterSuicideMarker)
 	}
+
+	// Prepared transactions stay prepared, with their keys locked, until the coordinator's Commit or
+	// Abort arrives. The coordinator may be down too, so it is asked in the background rather than
+	// holding up startup, and the replica serves the other keys meanwhile.
+	r.recovery = nil
+	if len(inDoubt) > 0 {
+		r.recovery = &replicaRecovery{true, inDoubt, len(inDoubt)}
+	}
+	for txId := range inDoubt {
+		logInfo("Transaction still prepared after recovery", "txId", txId, "phase", "recovery")
+		go r.resolvePrepared(txId)
+	}
 	return
 }
 
@@ -315,10 +760,21 @@ func (r *Replica) cleanUpTempStore() (err error) {
 	}
 
 	for _, key := range keys {
-		txId, _ := r.parseTempStoreKey(key)
+		txId, _, parseErr := parseTempStoreKey(key)
+		if parseErr != nil {
+			// A transaction prepared before an upgrade still needs its value, under today's key
+			legacyTxId, txKey, isLegacy := parseLegacyTempStoreKey(key)
+			if tx, ok := r.txs[legacyTxId]; isLegacy && ok && tx.state == Prepared {
+				err = r.renameTempValue(key, tempStoreKey(legacyTxId, txKey))
+				if err != nil {
+					return
+				}
+				continue
+			}
+		}
 		tx, ok := r.txs[txId]
-		if !ok || tx.state != Prepared {
-			println("Cleaning up temp key ", key)
+		if parseErr != nil || !ok || tx.state != Prepared {
+			logInfo("Cleaning up temp key", "tempKey", key, "phase", "recovery")
 			err = r.tempStore.del(key)
 			if err != nil {
 				return
@@ -328,12 +784,37 @@ func (r *Replica) cleanUpTempStore() (err error) {
 	return nil
 }
 
-// getStatus is only used during recovery to check the status from the Master
-func (r *Replica) getStatus(txId string) TxState {
-	client := NewMasterClient(MasterPort)
+// renameTempValue moves a temp value to another key. It is written before the old key is deleted,
+// so a crash in between leaves a copy to do it again from.
+func (r *Replica) renameTempValue(from string, to string) (err error) {
+	value, err := r.tempStore.get(from)
+	if err != nil {
+		return
+	}
+	err = r.tempStore.put(to, value)
+	if err != nil {
+		return
+	}
+	return r.tempStore.del(from)
+}
+
+// getStatus checks the status of an in-doubt transaction with the master that coordinated it, or with
+// the acceptors when running Paxos Commit. It keeps asking until the master answers.
+func (r *Replica) getStatus(tx *Tx) TxState {
+	if r.paxos != nil {
+		return r.paxos.outcome(tx.id, tx.participants, true)
+	}
+
+	// Logs from before coordinators were recorded only ever had the one master
+	coordinator := tx.coordinator
+	if coordinator == "" {
+		coordinator = r.cluster.Master.Address
+	}
+	client := NewMasterClient(coordinator)
 	for {
-		state, err := client.Status(txId)
-		if err != nil {
+		state, err := client.Status(tx.id)
+		// A master that is itself prepared as a subordinate is still waiting on its superior
+		if err != nil || *state == Started || *state == Prepared {
 			time.Sleep(100 * time.Millisecond)
 			continue
 		}
@@ -343,22 +824,44 @@ func (r *Replica) getStatus(txId string) TxState {
 	return NoState
 }
 
-func runReplica(num int) {
-	replica := NewReplica(num)
-	err := replica.recover()
+func runReplica(cluster *ClusterConfig, id string, paxos bool) {
+	num, err := cluster.replicaIndex(id)
 	if err != nil {
-		log.Fatal("Error during recovery: ", err)
+		logFatal("Unknown replica", "error", err)
 	}
 
+	replica := NewReplica(cluster, num)
+	if paxos {
+		replica.enablePaxosCommit()
+		err := replica.acceptor.recover()
+		if err != nil {
+			logFatal("Error during acceptor recovery", "error", err)
+		}
+	}
+
+	// Serve right away, refusing what recovery hasn't settled yet with retryable errors
+	replica.recovery = &replicaRecovery{}
 	server := rpc.NewServer()
 	server.Register(replica)
-	log.Println("Replica", num, "listening on port", ReplicaPortStart+num)
-	http.ListenAndServe(GetReplicaHost(num), server)
+	if replica.acceptor != nil {
+		server.Register(replica.acceptor)
+	}
+	address := cluster.Replicas[num].Address
+	mux := serveMux(server, replica.metrics.registry, replica.tracer)
+	go func() {
+		err := replica.recover()
+		if err != nil {
+			logFatal("Error during recovery", "error", err)
+		}
+		go archiveLoop(replica.archiveLog)
+	}()
+	logInfo("Replica listening", "address", address)
+	http.ListenAndServe(address, mux)
 }
 
 func (r *Replica) dieIf(actual ReplicaDeath, expected ReplicaDeath) {
 	if !r.didSuicide && actual == expected {
-		log.Println("Killing self as requested at", expected)
+		logWarn("Killing self as requested", "deathPoint", expected)
 		r.log.writeSpecial(killedSelfMarker)
 		os.Exit(1)
 	}
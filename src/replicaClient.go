@@ -2,7 +2,7 @@
 package main
 
 import (
-	"log"
+	"io"
 	"net"
 	"net/rpc"
 )
@@ -33,22 +33,23 @@ func (c *ReplicaClient) tryConnect() (err error) {
 
 func (c *ReplicaClient) call(serviceMethod string, args interface{}, reply interface{}) (err error) {
 	err = c.rpcClient.Call(serviceMethod, args, reply)
+	// A server that died mid-call leaves an EOF rather than ErrShutdown, and the connection is dead too
 	_, isNetOpError := err.(*net.OpError)
-	if err == rpc.ErrShutdown || isNetOpError {
+	if err == rpc.ErrShutdown || err == io.EOF || err == io.ErrUnexpectedEOF || isNetOpError {
 		c.rpcClient = nil
 	}
 	return
 }
 
-func (c *ReplicaClient) TryPut(key string, value string, txid string, die ReplicaDeath) (Success *bool, err error) {
+func (c *ReplicaClient) TryPut(key string, value []byte, contenttype string, txid string, die ReplicaDeath) (Success *bool, err error) {
 	if err = c.tryConnect(); err != nil {
 		return
 	}
 
 	var reply ReplicaActionResult
-	err = c.call("Replica.TryPut", &TxPutArgs{ key, value, txid, die }, &reply)
+	err = c.call("Replica.TryPut", &TxPutArgs{ key, value, contenttype, txid, die }, &reply)
 	if err != nil {
-		log.Println("ReplicaClient.TryPut:", err)
+		logDebug("RPC failed", "call", "Replica.TryPut", "host", c.host, "error", err)
 		return
 	}
 	
@@ -65,7 +66,24 @@ func (c *ReplicaClient) TryDel(key string, txid string, die ReplicaDeath) (Succe
 	var reply ReplicaActionResult
 	err = c.call("Replica.TryDel", &TxDelArgs{ key, txid, die }, &reply)
 	if err != nil {
-		log.Println("ReplicaClient.TryDel:", err)
+		logDebug("RPC failed", "call", "Replica.TryDel", "host", c.host, "error", err)
+		return
+	}
+	
+	Success = &reply.Success
+	
+	return
+}
+
+func (c *ReplicaClient) TryTx(txid string, ops []TxOp, participants []int, coordinatorid string, coordinator string, die ReplicaDeath) (Success *bool, err error) {
+	if err = c.tryConnect(); err != nil {
+		return
+	}
+
+	var reply ReplicaActionResult
+	err = c.call("Replica.TryTx", &TxArgs{ txid, ops, participants, coordinatorid, coordinator, die }, &reply)
+	if err != nil {
+		logDebug("RPC failed", "call", "Replica.TryTx", "host", c.host, "error", err)
 		return
 	}
 	
@@ -82,7 +100,7 @@ func (c *ReplicaClient) Commit(txid string, die ReplicaDeath) (Success *bool, er
 	var reply ReplicaActionResult
 	err = c.call("Replica.Commit", &CommitArgs{ txid, die }, &reply)
 	if err != nil {
-		log.Println("ReplicaClient.Commit:", err)
+		logDebug("RPC failed", "call", "Replica.Commit", "host", c.host, "error", err)
 		return
 	}
 	
@@ -99,7 +117,7 @@ func (c *ReplicaClient) Abort(txid string) (Success *bool, err error) {
 	var reply ReplicaActionResult
 	err = c.call("Replica.Abort", &AbortArgs{ txid }, &reply)
 	if err != nil {
-		log.Println("ReplicaClient.Abort:", err)
+		logDebug("RPC failed", "call", "Replica.Abort", "host", c.host, "error", err)
 		return
 	}
 	
@@ -108,7 +126,7 @@ func (c *ReplicaClient) Abort(txid string) (Success *bool, err error) {
 	return
 }
 
-func (c *ReplicaClient) Get(key string) (Value *string, err error) {
+func (c *ReplicaClient) Get(key string) (Result *ReplicaGetResult, err error) {
 	if err = c.tryConnect(); err != nil {
 		return
 	}
@@ -116,11 +134,11 @@ func (c *ReplicaClient) Get(key string) (Value *string, err error) {
 	var reply ReplicaGetResult
 	err = c.call("Replica.Get", &ReplicaKeyArgs{ key }, &reply)
 	if err != nil {
-		log.Println("ReplicaClient.Get:", err)
+		logDebug("RPC failed", "call", "Replica.Get", "host", c.host, "error", err)
 		return
 	}
 	
-	Value = &reply.Value
+	Result = &reply
 	
 	return
 }
@@ -130,10 +148,10 @@ func (c *ReplicaClient) Ping(key string) (Value *string, err error) {
 		return
 	}
 
-	var reply ReplicaGetResult
+	var reply ReplicaPingResult
 	err = c.call("Replica.Ping", &ReplicaKeyArgs{ key }, &reply)
 	if err != nil {
-		log.Println("ReplicaClient.Ping:", err)
+		logDebug("RPC failed", "call", "Replica.Ping", "host", c.host, "error", err)
 		return
 	}
 	
@@ -141,3 +159,88 @@ func (c *ReplicaClient) Ping(key string) (Value *string, err error) {
 	
 	return
 }
+
+func (c *ReplicaClient) Recovery() (Result *ReplicaRecoveryResult, err error) {
+	if err = c.tryConnect(); err != nil {
+		return
+	}
+
+	var reply ReplicaRecoveryResult
+	err = c.call("Replica.Recovery", &ReplicaRecoveryArgs{  }, &reply)
+	if err != nil {
+		logDebug("RPC failed", "call", "Replica.Recovery", "host", c.host, "error", err)
+		return
+	}
+	
+	Result = &reply
+	
+	return
+}
+
+func (c *ReplicaClient) Durability() (Result *ReplicaDurabilityResult, err error) {
+	if err = c.tryConnect(); err != nil {
+		return
+	}
+
+	var reply ReplicaDurabilityResult
+	err = c.call("Replica.Durability", &ReplicaDurabilityArgs{  }, &reply)
+	if err != nil {
+		logDebug("RPC failed", "call", "Replica.Durability", "host", c.host, "error", err)
+		return
+	}
+	
+	Result = &reply
+	
+	return
+}
+
+func (c *ReplicaClient) BeginSnapshot(id string) (Success *bool, err error) {
+	if err = c.tryConnect(); err != nil {
+		return
+	}
+
+	var reply ReplicaActionResult
+	err = c.call("Replica.BeginSnapshot", &ReplicaSnapshotArgs{ id }, &reply)
+	if err != nil {
+		logDebug("RPC failed", "call", "Replica.BeginSnapshot", "host", c.host, "error", err)
+		return
+	}
+	
+	Success = &reply.Success
+	
+	return
+}
+
+func (c *ReplicaClient) ReadSnapshot(id string, offset int, limit int) (Result *ReadSnapshotResult, err error) {
+	if err = c.tryConnect(); err != nil {
+		return
+	}
+
+	var reply ReadSnapshotResult
+	err = c.call("Replica.ReadSnapshot", &ReadSnapshotArgs{ id, offset, limit }, &reply)
+	if err != nil {
+		logDebug("RPC failed", "call", "Replica.ReadSnapshot", "host", c.host, "error", err)
+		return
+	}
+	
+	Result = &reply
+	
+	return
+}
+
+func (c *ReplicaClient) EndSnapshot(id string) (Success *bool, err error) {
+	if err = c.tryConnect(); err != nil {
+		return
+	}
+
+	var reply ReplicaActionResult
+	err = c.call("Replica.EndSnapshot", &ReplicaSnapshotArgs{ id }, &reply)
+	if err != nil {
+		logDebug("RPC failed", "call", "Replica.EndSnapshot", "host", c.host, "error", err)
+		return
+	}
+	
+	Success = &reply.Success
+	
+	return
+}
@@ -0,0 +1,256 @@
+// +build !goci
+package main
+
+import (
+	"bytes"
+	"fmt"
+	. "launchpad.net/gocheck"
+	"net"
+	"net/http"
+	"net/rpc"
+	"os"
+	"time"
+)
+
+type ReplicaSuite struct{}
+
+var _ = Suite(&ReplicaSuite{})
+
+func (s *ReplicaSuite) TearDownTest(c *C) {
+	os.Remove(testClusterPath)
+	os.RemoveAll("./test.replica")
+}
+
+// startTestMaster serves a master that knows the given transactions in the given states, and returns a
+// cluster with one replica that it coordinates. A replica resolving a transaction the master knows as
+// Started keeps asking, which leaves it prepared; one the master doesn't know is presumed aborted.
+func startTestMaster(c *C, outcomes map[string]TxState) *ClusterConfig {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	cluster, err := loadTestCluster(c, fmt.Sprintf(`{
+		"Master": {"Id": "m", "Address": "%v", "LogPath": "test.replica/logs/m.txt"},
+		"Replicas": [{"Id": "a", "Address": "localhost:2", "DataDir": "test.replica/data/a", "LogPath": "test.replica/logs/a.txt"}]
+	}`, listener.Addr()))
+	c.Assert(err, IsNil)
+
+	master := NewMaster(cluster, 0)
+	for txId, state := range outcomes {
+		master.txs[txId] = state
+	}
+	server := rpc.NewServer()
+	server.Register(master)
+	go http.Serve(listener, server)
+	return cluster
+}
+
+func prepareOps(c *C, r *Replica, txId string, ops ...TxOp) {
+	var reply ReplicaActionResult
+	c.Assert(r.TryTx(&TxArgs{txId, ops, []int{r.num}, "m", r.cluster.Master.Address, ReplicaDontDie}, &reply), IsNil)
+	c.Assert(reply.Success, Equals, true)
+}
+
+func (s *ReplicaSuite) TestPreparedTxsAreReinstatedWithTheirLocks(c *C) {
+	cluster := startTestMaster(c, map[string]TxState{"m.tx1": Started})
+	r := NewReplica(cluster, 0)
+	prepareOps(c, r, "m.tx1", TxOp{PutOp, "foo", []byte("bar"), "", ""}, TxOp{DelOp, "baz", nil, "", ""})
+	commitOps(c, r, "m.tx2", TxOp{PutOp, "qux", []byte("quux"), "", ""})
+
+	r = NewReplica(cluster, 0)
+	c.Assert(r.recover(), IsNil)
+	c.Assert(r.lockedKeys, DeepEquals, map[string]bool{"foo": true, "baz": true})
+	c.Assert(r.txs["m.tx1"].state, Equals, Prepared)
+	c.Assert(r.txs["m.tx1"].participants, DeepEquals, []int{0})
+	c.Assert(r.txs["m.tx2"].state, Equals, Committed)
+
+	var reply ReplicaActionResult
+	err := r.TryTx(&TxArgs{"m.tx3", []TxOp{{PutOp, "foo", []byte("other"), "", ""}}, []int{0}, "m", cluster.Master.Address, ReplicaDontDie}, &reply)
+	c.Assert(isRetryable(err), Equals, true)
+	c.Assert(reply.Success, Equals, false)
+
+	c.Assert(r.Abort(&AbortArgs{"m.tx1"}, &reply), IsNil)
+	c.Assert(reply.Success, Equals, true)
+	c.Assert(r.lockedKeys, HasLen, 0)
+}
+
+func (s *ReplicaSuite) TestRecoveryRedoesCommitsWithoutTheTempStore(c *C) {
+	cluster := startTestMaster(c, map[string]TxState{"m.tx2": Started})
+	r := NewReplica(cluster, 0)
+	commitOps(c, r, "m.tx1", TxOp{PutOp, "gone", []byte("soon"), "", ""})
+	prepareOps(c, r, "m.tx2", TxOp{PutOp, "foo", []byte("bar"), "text/plain", ""}, TxOp{DelOp, "gone", nil, "", ""})
+
+	c.Assert(os.RemoveAll("./test.replica/data/a/temp"), IsNil)
+	r = NewReplica(cluster, 0)
+	c.Assert(r.recover(), IsNil)
+	var reply ReplicaActionResult
+	c.Assert(r.Commit(&CommitArgs{"m.tx2", ReplicaDontDie}, &reply), IsNil)
+
+	var result ReplicaGetResult
+	c.Assert(r.Get(&ReplicaKeyArgs{"foo"}, &result), IsNil)
+	c.Assert(string(result.Value), Equals, "bar")
+	c.Assert(result.ContentType, Equals, "text/plain")
+	c.Assert(r.Get(&ReplicaKeyArgs{"gone"}, &result), NotNil)
+}
+
+func (s *ReplicaSuite) TestTxsPreparedBeforeAnUpgradeKeepTheirTempValues(c *C) {
+	cluster := startTestMaster(c, map[string]TxState{"Q3kzXyL0": Started})
+	r := NewReplica(cluster, 0)
+	// Before values were logged and temp keys were prefixed with the txId's length
+	r.log.writeEntries(logEntry{"Q3kzXyL0", Prepared, PutOp, "foo", []int{0}, cluster.Master.Address, "m", time.Time{}, 0, nil})
+	c.Assert(r.tempStore.put("Q3kzXyL0__foo", []byte("bar")), IsNil)
+	c.Assert(r.tempStore.put("Gone1234__baz", []byte("qux")), IsNil)
+
+	r = NewReplica(cluster, 0)
+	c.Assert(r.recover(), IsNil)
+	keys, err := r.tempStore.list()
+	c.Assert(err, IsNil)
+	c.Assert(keys, DeepEquals, []string{tempStoreKey("Q3kzXyL0", "foo")})
+	var reply ReplicaActionResult
+	c.Assert(r.Commit(&CommitArgs{"Q3kzXyL0", ReplicaDontDie}, &reply), IsNil)
+	var result ReplicaGetResult
+	c.Assert(r.Get(&ReplicaKeyArgs{"foo"}, &result), IsNil)
+	c.Assert(string(result.Value), Equals, "bar")
+}
+
+func (s *ReplicaSuite) TestRedoingACommitIsHarmless(c *C) {
+	cluster := startTestMaster(c, map[string]TxState{"m.tx1": Started})
+	r := NewReplica(cluster, 0)
+	prepareOps(c, r, "m.tx1", TxOp{PutOp, "foo", []byte("bar"), "", ""})
+	// Dying between applying the commit and logging it leaves the tx prepared
+	c.Assert(r.committedStore.put("foo", encodeValue([]byte("bar"), "")), IsNil)
+
+	r = NewReplica(cluster, 0)
+	c.Assert(r.recover(), IsNil)
+	var reply ReplicaActionResult
+	c.Assert(r.Commit(&CommitArgs{"m.tx1", ReplicaDontDie}, &reply), IsNil)
+	var result ReplicaGetResult
+	c.Assert(r.Get(&ReplicaKeyArgs{"foo"}, &result), IsNil)
+	c.Assert(string(result.Value), Equals, "bar")
+
+	r = NewReplica(cluster, 0)
+	c.Assert(r.recover(), IsNil)
+	c.Assert(r.txs["m.tx1"].state, Equals, Committed)
+	keys, err := r.tempStore.list()
+	c.Assert(err, IsNil)
+	c.Assert(keys, HasLen, 0)
+}
+
+func (s *ReplicaSuite) TestInDoubtTxsAreResolvedWithTheMasterInTheBackground(c *C) {
+	cluster := startTestMaster(c, map[string]TxState{"m.tx1": Committed, "m.tx2": Aborted})
+	r := NewReplica(cluster, 0)
+	prepareOps(c, r, "m.tx1", TxOp{PutOp, "foo", []byte("bar"), "", ""})
+	prepareOps(c, r, "m.tx2", TxOp{PutOp, "baz", []byte("qux"), "", ""})
+	// The master has archived m.tx3's abort, so it presumes abort
+	prepareOps(c, r, "m.tx3", TxOp{PutOp, "quux", []byte("corge"), "", ""})
+
+	r = NewReplica(cluster, 0)
+	c.Assert(r.recover(), IsNil)
+	for i := 0; r.preparedTx("m.tx1") != nil || r.preparedTx("m.tx2") != nil || r.preparedTx("m.tx3") != nil; i++ {
+		c.Assert(i < 100, Equals, true)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var result ReplicaGetResult
+	c.Assert(r.Get(&ReplicaKeyArgs{"foo"}, &result), IsNil)
+	c.Assert(string(result.Value), Equals, "bar")
+	c.Assert(r.Get(&ReplicaKeyArgs{"baz"}, &result), NotNil)
+	c.Assert(r.Get(&ReplicaKeyArgs{"quux"}, &result), NotNil)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c.Assert(r.txs["m.tx3"].state, Equals, Aborted)
+	c.Assert(r.lockedKeys, HasLen, 0)
+}
+
+func (s *ReplicaSuite) TestInDoubtTxsAreResolvedWithTheMasterThatRanThem(c *C) {
+	servers, addresses := serveTestNodes(c, 2)
+	cluster, err := loadTestCluster(c, fmt.Sprintf(`{
+		"Master": {"Id": "m1", "Address": "%v", "LogPath": "test.replica/logs/m1.txt"},
+		"Masters": [{"Id": "m2", "Address": "%v", "LogPath": "test.replica/logs/m2.txt"}],
+		"Replicas": [{"Id": "a", "Address": "localhost:2", "DataDir": "test.replica/data/a", "LogPath": "test.replica/logs/a.txt"}]
+	}`, addresses...))
+	c.Assert(err, IsNil)
+	// Only m2 knows the transaction, the configured Master would presume it aborted
+	m2 := NewMaster(cluster, 1)
+	m2.txs["m2-tx1"] = Committed
+	servers[1].Register(m2)
+	servers[0].Register(NewMaster(cluster, 0))
+
+	r := NewReplica(cluster, 0)
+	var reply ReplicaActionResult
+	c.Assert(r.TryTx(&TxArgs{"m2-tx1", []TxOp{{PutOp, "foo", []byte("bar"), "", ""}}, []int{0}, "m2", addresses[1].(string), ReplicaDontDie}, &reply), IsNil)
+	c.Assert(reply.Success, Equals, true)
+
+	r = NewReplica(cluster, 0)
+	c.Assert(r.recover(), IsNil)
+	waitFor(c, func() bool { return r.preparedTx("m2-tx1") == nil })
+	c.Assert(replicaValue(r, "foo"), Equals, "bar")
+}
+
+func (s *ReplicaSuite) TestRecoveringReplicaOnlyServesKeysNotInDoubt(c *C) {
+	cluster := startTestMaster(c, map[string]TxState{"m.tx2": Started})
+	r := NewReplica(cluster, 0)
+	commitOps(c, r, "m.tx1", TxOp{PutOp, "foo", []byte("old"), "", ""}, TxOp{PutOp, "baz", []byte("qux"), "", ""})
+	prepareOps(c, r, "m.tx2", TxOp{PutOp, "foo", []byte("new"), "", ""})
+
+	r = NewReplica(cluster, 0)
+	r.recovery = &replicaRecovery{}
+	var result ReplicaGetResult
+	err := r.Get(&ReplicaKeyArgs{"baz"}, &result)
+	c.Assert(isRetryable(err), Equals, true)
+	var reply ReplicaActionResult
+	err = r.Commit(&CommitArgs{"m.tx2", ReplicaDontDie}, &reply)
+	c.Assert(err, ErrorMatches, "Recovering, retry later: the log hasn't been read yet")
+	var status ReplicaRecoveryResult
+	c.Assert(r.Recovery(&ReplicaRecoveryArgs{}, &status), IsNil)
+	c.Assert(status, DeepEquals, ReplicaRecoveryResult{true, false, nil, 0})
+
+	c.Assert(r.recover(), IsNil)
+	c.Assert(r.Get(&ReplicaKeyArgs{"baz"}, &result), IsNil)
+	c.Assert(string(result.Value), Equals, "qux")
+	err = r.Get(&ReplicaKeyArgs{"foo"}, &result)
+	c.Assert(err, ErrorMatches, "Recovering, retry later: key foo is in doubt in tx m.tx2")
+	err = r.TryTx(&TxArgs{"m.tx3", []TxOp{{DelOp, "foo", nil, "", ""}}, []int{0}, "m", cluster.Master.Address, ReplicaDontDie}, &reply)
+	c.Assert(isRetryable(err), Equals, true)
+	c.Assert(reply.Success, Equals, false)
+	c.Assert(r.Recovery(&ReplicaRecoveryArgs{}, &status), IsNil)
+	c.Assert(status, DeepEquals, ReplicaRecoveryResult{true, true, []string{"m.tx2"}, 0})
+
+	c.Assert(r.Commit(&CommitArgs{"m.tx2", ReplicaDontDie}, &reply), IsNil)
+	c.Assert(r.Get(&ReplicaKeyArgs{"foo"}, &result), IsNil)
+	c.Assert(string(result.Value), Equals, "new")
+	status = ReplicaRecoveryResult{}
+	c.Assert(r.Recovery(&ReplicaRecoveryArgs{}, &status), IsNil)
+	c.Assert(status, DeepEquals, ReplicaRecoveryResult{false, true, nil, 0})
+}
+
+func (s *ReplicaSuite) TestMetrics(c *C) {
+	cluster := startTestMaster(c, nil)
+	r := NewReplica(cluster, 0)
+	commitOps(c, r, "m.tx1", TxOp{PutOp, "foo", []byte("bar"), "", ""})
+	prepareOps(c, r, "m.tx2", TxOp{PutOp, "foo", []byte("baz"), "", ""})
+	var reply ReplicaActionResult
+	c.Assert(r.TryTx(&TxArgs{"m.tx3", []TxOp{{DelOp, "foo", nil, "", ""}}, []int{0}, "m", cluster.Master.Address, ReplicaDontDie}, &reply), IsNil)
+
+	var out bytes.Buffer
+	r.metrics.registry.writeTo(&out)
+	text := out.String()
+	c.Assert(text, Matches, `(?s).*\ntwopc_replica_transactions_total{outcome="aborted",reason="lock_conflict"} 1\n.*`)
+	c.Assert(text, Matches, `(?s).*\ntwopc_replica_transactions_total{outcome="committed",reason="coordinator"} 1\n.*`)
+	c.Assert(text, Matches, `(?s).*\ntwopc_replica_lock_conflicts_total 1\n.*`)
+	c.Assert(text, Matches, `(?s).*\ntwopc_replica_prepare_seconds_count 3\n.*`)
+	c.Assert(text, Matches, `(?s).*\ntwopc_replica_prepared_transactions 1\n.*`)
+	c.Assert(text, Matches, `(?s).*\ntwopc_log_fsync_seconds_count [1-9][0-9]*\n.*`)
+}
+
+func (s *ReplicaSuite) TestTransactionsAreTraced(c *C) {
+	cluster := startTestMaster(c, nil)
+	r := NewReplica(cluster, 0)
+	commitOps(c, r, "m.tx1", TxOp{PutOp, "foo", []byte("bar"), "", ""})
+	prepareOps(c, r, "m.tx2", TxOp{PutOp, "baz", []byte("qux"), "", ""})
+	var reply ReplicaActionResult
+	c.Assert(r.Abort(&AbortArgs{"m.tx2"}, &reply), IsNil)
+
+	c.Assert(spanNames(r.tracer.events("m.tx1")), DeepEquals, []string{"prepare", "log prepared", "commit", "log committed"})
+	events := r.tracer.events("m.tx2")
+	c.Assert(spanNames(events), DeepEquals, []string{"prepare", "log prepared", "abort"})
+	c.Assert(events[2].Args, DeepEquals, map[string]interface{}{"txId": "m.tx2", "ops": 1, "vote": true})
+}
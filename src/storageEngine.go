@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	FileStorage    = "file"
+	MemoryStorage  = "memory"
+	BitcaskStorage = "bitcask"
+)
+
+// storageEngine is what a replica keeps its committed and temp values in. get fails for a missing
+// key, while del of a missing key is not an error. list and iterate visit keys in no particular
+// order, and iterate stops at the first error f returns.
+type storageEngine interface {
+	get(key string) ([]byte, error)
+	put(key string, value []byte) error
+	del(key string) error
+	list() ([]string, error)
+	iterate(f func(key string, value []byte) error) error
+	batch(ops []storeOp) error
+}
+
+// storeOp is one write in a batch, either a PutOp or a DelOp
+type storeOp struct {
+	op    Operation
+	key   string
+	value []byte
+}
+
+func checkStorageEngine(engine string) error {
+	switch engine {
+	case FileStorage, MemoryStorage, BitcaskStorage:
+		return nil
+	}
+	return errors.New(fmt.Sprint("Unknown storage engine: ", engine, ", expected ", FileStorage, ", ", MemoryStorage, " or ", BitcaskStorage))
+}
+
+// newStorageEngine opens the engine named in a node's config. Nothing in a memory engine survives a
+// restart, so it is only meant for tests and throwaway clusters.
+func newStorageEngine(engine string, dbPath string) storageEngine {
+	switch engine {
+	case FileStorage:
+		return newKeyValueStore(dbPath)
+	case MemoryStorage:
+		return newMemoryStore()
+	case BitcaskStorage:
+		return newBitcaskStore(dbPath)
+	}
+	logFatal("Unable to open store", "path", dbPath, "error", checkStorageEngine(engine))
+	return nil
+}
+
+// openStorageEngineReadOnly opens an engine's files for checking a stopped node, without changing
+// them. What newStorageEngine would tidy up after a crash is returned as damage instead.
+func openStorageEngineReadOnly(engine string, dbPath string) (store storageEngine, damage []string, err error) {
+	switch engine {
+	case FileStorage:
+		s, damage, err := openKeyValueStoreReadOnly(dbPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		return s, damage, nil
+	case BitcaskStorage:
+		s, damage, err := openBitcaskStoreReadOnly(dbPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		return s, damage, nil
+	case MemoryStorage:
+		return nil, nil, errors.New("A memory engine keeps nothing on disk")
+	}
+	return nil, nil, checkStorageEngine(engine)
+}
+
+// applyBatch applies a batch one op at a time, for engines that have no cheaper way to do it
+func applyBatch(s storageEngine, ops []storeOp) (err error) {
+	for _, op := range ops {
+		switch op.op {
+		case PutOp:
+			err = s.put(op.key, op.value)
+		case DelOp:
+			err = s.del(op.key)
+		default:
+			err = errors.New(fmt.Sprint("Unsupported op in batch: ", op.op.String()))
+		}
+		if err != nil {
+			return
+		}
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+// +build !goci
+package main
+
+import (
+	"errors"
+	"fmt"
+	. "launchpad.net/gocheck"
+	"os"
+	"sort"
+)
+
+var testEnginePath = "./test.engine"
+
+// StorageEngineSuite is the conformance suite every storage engine has to pass
+type StorageEngineSuite struct {
+	engine string
+	store  storageEngine
+}
+
+var _ = Suite(&StorageEngineSuite{engine: FileStorage})
+var _ = Suite(&StorageEngineSuite{engine: MemoryStorage})
+var _ = Suite(&StorageEngineSuite{engine: BitcaskStorage})
+
+func (s *StorageEngineSuite) SetUpTest(c *C) {
+	os.RemoveAll(testEnginePath)
+	s.store = newStorageEngine(s.engine, testEnginePath)
+}
+
+func (s *StorageEngineSuite) TearDownTest(c *C) {
+	if bitcask, ok := s.store.(*bitcaskStore); ok {
+		bitcask.close()
+	}
+	os.RemoveAll(testEnginePath)
+}
+
+func (s *StorageEngineSuite) TestGetMissing(c *C) {
+	_, err := s.store.get("missing")
+	c.Assert(err, NotNil)
+}
+
+func (s *StorageEngineSuite) TestDelMissing(c *C) {
+	c.Assert(s.store.del("missing"), IsNil)
+}
+
+func (s *StorageEngineSuite) TestPutGetDel(c *C) {
+	c.Assert(s.store.put("foo", []byte("bar")), IsNil)
+	val, err := s.store.get("foo")
+	c.Assert(err, IsNil)
+	c.Assert(string(val), Equals, "bar")
+
+	c.Assert(s.store.put("foo", []byte("baz")), IsNil)
+	val, err = s.store.get("foo")
+	c.Assert(err, IsNil)
+	c.Assert(string(val), Equals, "baz")
+
+	c.Assert(s.store.del("foo"), IsNil)
+	_, err = s.store.get("foo")
+	c.Assert(err, NotNil)
+}
+
+func (s *StorageEngineSuite) TestEmptyAndBinaryValues(c *C) {
+	binary := []byte{0, 0xff, '\n', 0}
+	c.Assert(s.store.put("empty", nil), IsNil)
+	c.Assert(s.store.put("binary", binary), IsNil)
+
+	val, err := s.store.get("empty")
+	c.Assert(err, IsNil)
+	c.Assert(val, HasLen, 0)
+
+	val, err = s.store.get("binary")
+	c.Assert(err, IsNil)
+	c.Assert(val, DeepEquals, binary)
+}
+
+func (s *StorageEngineSuite) TestStoredValueIsACopy(c *C) {
+	value := []byte("abc")
+	c.Assert(s.store.put("foo", value), IsNil)
+	value[0] = 'x'
+
+	val, err := s.store.get("foo")
+	c.Assert(err, IsNil)
+	c.Assert(string(val), Equals, "abc")
+	val[0] = 'y'
+
+	val, err = s.store.get("foo")
+	c.Assert(err, IsNil)
+	c.Assert(string(val), Equals, "abc")
+}
+
+func (s *StorageEngineSuite) TestArbitraryKeys(c *C) {
+	keys := []string{"", ".", "..", "a/b", "NUL", "x\x00y", "Foo", "foo", "1:tx1foo"}
+	for i, key := range keys {
+		c.Assert(s.store.put(key, []byte(fmt.Sprint("val", i))), IsNil)
+	}
+	for i, key := range keys {
+		val, err := s.store.get(key)
+		c.Assert(err, IsNil)
+		c.Assert(string(val), Equals, fmt.Sprint("val", i))
+	}
+}
+
+func (s *StorageEngineSuite) TestListAndIterate(c *C) {
+	const count = 10
+	expected := make([]string, count)
+	for i := 0; i < count; i++ {
+		expected[i] = fmt.Sprint("key", i)
+		c.Assert(s.store.put(expected[i], []byte(fmt.Sprint("val", i))), IsNil)
+	}
+	c.Assert(s.store.del("key3"), IsNil)
+	expected = append(expected[:3], expected[4:]...)
+
+	keys, err := s.store.list()
+	c.Assert(err, IsNil)
+	sort.Strings(keys)
+	c.Assert(keys, DeepEquals, expected)
+
+	values := make(map[string]string)
+	err = s.store.iterate(func(key string, value []byte) error {
+		values[key] = string(value)
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(values, HasLen, len(expected))
+	for i := 0; i < count; i++ {
+		if i != 3 {
+			c.Assert(values[fmt.Sprint("key", i)], Equals, fmt.Sprint("val", i))
+		}
+	}
+}
+
+func (s *StorageEngineSuite) TestIterateStopsOnError(c *C) {
+	c.Assert(s.store.put("a", []byte("1")), IsNil)
+	c.Assert(s.store.put("b", []byte("2")), IsNil)
+
+	visited := 0
+	stop := errors.New("stop")
+	err := s.store.iterate(func(key string, value []byte) error {
+		visited++
+		return stop
+	})
+	c.Assert(err, Equals, stop)
+	c.Assert(visited, Equals, 1)
+}
+
+func (s *StorageEngineSuite) TestBatch(c *C) {
+	c.Assert(s.store.put("old", []byte("1")), IsNil)
+
+	err := s.store.batch([]storeOp{{PutOp, "a", []byte("A")}, {PutOp, "b", []byte("B")}, {DelOp, "old", nil}, {DelOp, "missing", nil}})
+	c.Assert(err, IsNil)
+
+	val, err := s.store.get("a")
+	c.Assert(err, IsNil)
+	c.Assert(string(val), Equals, "A")
+	val, err = s.store.get("b")
+	c.Assert(err, IsNil)
+	c.Assert(string(val), Equals, "B")
+	_, err = s.store.get("old")
+	c.Assert(err, NotNil)
+}
+
+func (s *StorageEngineSuite) TestBatchRejectsOtherOps(c *C) {
+	err := s.store.batch([]storeOp{{RecoveryOp, "a", nil}})
+	c.Assert(err, NotNil)
+}
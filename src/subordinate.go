@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// participant is one member of a master's two-phase commit: a replica of its own cluster, or the
+// master of a subordinate cluster
+type participant interface {
+	TryTx(txId string, ops []TxOp, participants []int, coordinatorId string, coordinator string, die ReplicaDeath) (*bool, error)
+	Commit(txId string, die ReplicaDeath) (*bool, error)
+	Abort(txId string) (*bool, error)
+}
+
+// subordinateClient drives another cluster's master as a participant, which in turn runs the
+// protocol with its own replicas
+type subordinateClient struct {
+	master *MasterClient
+}
+
+func (s *subordinateClient) TryTx(txId string, ops []TxOp, participants []int, coordinatorId string, coordinator string, die ReplicaDeath) (*bool, error) {
+	return s.master.Prepare(txId, ops, coordinator)
+}
+
+func (s *subordinateClient) Commit(txId string, die ReplicaDeath) (*bool, error) {
+	return s.master.Commit(txId)
+}
+
+func (s *subordinateClient) Abort(txId string) (*bool, error) {
+	return s.master.Abort(txId)
+}
+
+// superiorPollInterval is how often a subordinate asks its superiors about the transactions it is
+// prepared for
+const superiorPollInterval = 10 * time.Second
+
+// finishSubordinateTx applies the superior's decision to a transaction this master prepared as a
+// subordinate. Hearing the same decision twice is fine, since the superior retries commits. An abort
+// can also arrive while we are still preparing, if the superior gave up waiting for our vote; it is
+// logged, and Prepare aborts the participants once they have answered.
+func (m *Master) finishSubordinateTx(txId string, decision TxState) error {
+	m.mu.Lock()
+	state, ok := m.txs[txId]
+	participants := m.participants[txId]
+	decided := ok && (state == Prepared || (state == Started && decision == Aborted))
+	if decided {
+		entry := logEntry{txId, decision, NoOp, "", participants, "", "", time.Time{}, 0, nil}
+		if decision == Committed {
+			m.seq++
+			entry.seq = m.seq
+		}
+		m.log.writeEntry(entry)
+		m.txs[txId] = decision
+	}
+	m.mu.Unlock()
+
+	if !ok {
+		return errors.New(fmt.Sprint("Received ", decision.String(), " for unknown transaction: ", txId))
+	}
+	if !decided {
+		if state == decision {
+			return nil
+		}
+		return errors.New(fmt.Sprint("Received ", decision.String(), " for transaction in state ", state.String(), ": ", txId))
+	}
+
+	m.metrics.transactions.inc("outcome", strings.ToLower(decision.String()), "reason", "superior")
+	switch {
+	case state == Started:
+		logInfo("Aborting once prepared, as decided by the superior", "txId", txId, "phase", "abort")
+	case decision == Committed:
+		logInfo("Committing as decided by the superior", "txId", txId, "phase", "commit")
+		m.sendAndWaitForCommit("Commit", txId, participants, nil)
+	default:
+		logInfo("Aborting as decided by the superior", "txId", txId, "phase", "abort")
+		m.sendAbort("Abort", txId, participants)
+	}
+	return nil
+}
+
+// resolveWithSuperior asks the superior for the outcome of a transaction we are prepared for, until
+// it has one
+func (m *Master) resolveWithSuperior(txId string, superior string) {
+	client := NewMasterClient(superior)
+	for !m.askSuperior(client, txId) {
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// askSuperior settles a prepared transaction if the superior has decided it, and reports whether it
+// has. A superior that never heard of the transaction aborted it, since it logs every transaction
+// before asking anyone to prepare.
+func (m *Master) askSuperior(superior *MasterClient, txId string) bool {
+	state, err := superior.Status(txId)
+	if err != nil {
+		return false
+	}
+	switch *state {
+	case Committed, Aborted:
+		m.finishSubordinateTx(txId, *state)
+		return true
+	case NoState:
+		m.finishSubordinateTx(txId, Aborted)
+		return true
+	}
+	return false
+}
+
+// superiorLoop asks the superiors about prepared transactions now and then. Their Commit or Abort
+// normally settles them, but it can be lost, and a superior only resends it when it restarts.
+func (m *Master) superiorLoop() {
+	for {
+		time.Sleep(superiorPollInterval)
+		m.pollSuperiors()
+	}
+}
+
+// pollSuperiors asks the superior of each prepared transaction once
+func (m *Master) pollSuperiors() {
+	m.mu.Lock()
+	prepared := make(map[string]string)
+	for txId, state := range m.txs {
+		if state == Prepared {
+			prepared[txId] = m.superiors[txId]
+		}
+	}
+	m.mu.Unlock()
+
+	clients := make(map[string]*MasterClient)
+	for txId, superior := range prepared {
+		client, ok := clients[superior]
+		if !ok {
+			client = NewMasterClient(superior)
+			clients[superior] = client
+		}
+		m.askSuperior(client, txId)
+	}
+}
@@ -0,0 +1,173 @@
+// +build !goci
+package main
+
+import (
+	"fmt"
+	. "launchpad.net/gocheck"
+	"net/rpc"
+	"os"
+)
+
+type SubordinateSuite struct{}
+
+var _ = Suite(&SubordinateSuite{})
+
+func (s *SubordinateSuite) TearDownTest(c *C) {
+	os.Remove(testClusterPath)
+	os.RemoveAll("./test.subordinate")
+}
+
+// subordinateTestClusters returns a superior cluster with replica a, and the cluster "sub" with
+// replica b, whose master the superior coordinates. The servers are the superior's, a's, sub's and
+// b's, in that order.
+func subordinateTestClusters(c *C) (superior *ClusterConfig, sub *ClusterConfig, servers []*rpc.Server) {
+	servers, addresses := serveTestNodes(c, 4)
+	superior, err := loadTestCluster(c, fmt.Sprintf(`{
+		"Master": {"Id": "super", "Address": "%v", "LogPath": "test.subordinate/logs/super.txt"},
+		"Replicas": [{"Id": "a", "Address": "%v", "DataDir": "test.subordinate/data/a", "LogPath": "test.subordinate/logs/a.txt"}],
+		"Subordinates": [{"Id": "sub", "Address": "%v"}]
+	}`, addresses[:3]...))
+	c.Assert(err, IsNil)
+	sub, err = loadTestCluster(c, fmt.Sprintf(`{
+		"Master": {"Id": "sub", "Address": "%v", "LogPath": "test.subordinate/logs/sub.txt"},
+		"Replicas": [{"Id": "b", "Address": "%v", "DataDir": "test.subordinate/data/b", "LogPath": "test.subordinate/logs/b.txt"}]
+	}`, addresses[2:]...))
+	c.Assert(err, IsNil)
+	return
+}
+
+func (s *SubordinateSuite) TestSuperiorCommitsThroughASubordinate(c *C) {
+	superiorCluster, subCluster, servers := subordinateTestClusters(c)
+	a := startTestReplica(c, superiorCluster, 0, servers[1])
+	b := startTestReplica(c, subCluster, 0, servers[3])
+	sub := NewMaster(subCluster, 0)
+	c.Assert(sub.recover(), IsNil)
+	servers[2].Register(sub)
+	superior := NewMaster(superiorCluster, 0)
+	c.Assert(superior.recover(), IsNil)
+	servers[0].Register(superior)
+
+	var i int
+	err := superior.Transact(&TransactArgs{[]TxOp{{PutOp, "here", []byte("1"), "", ""}, {PutOp, "there", []byte("2"), "", "sub"}}}, &i)
+	c.Assert(err, IsNil)
+	c.Assert(replicaValue(a, "here"), Equals, "1")
+	c.Assert(replicaValue(a, "there"), Equals, "<none>")
+	c.Assert(replicaValue(b, "there"), Equals, "2")
+	for txId := range superior.txs {
+		var status StatusResult
+		c.Assert(sub.Status(&StatusArgs{txId}, &status), IsNil)
+		c.Assert(status.State, Equals, Committed)
+	}
+
+	// A key locked in the subordinate cluster makes it vote to abort, which aborts the whole transaction
+	prepareOps(c, b, "other.tx1", TxOp{PutOp, "there", []byte("3"), "", ""})
+	err = superior.Transact(&TransactArgs{[]TxOp{{PutOp, "here", []byte("4"), "", ""}, {PutOp, "there", []byte("5"), "", "sub"}}}, &i)
+	c.Assert(err, Equals, TxAbortedError)
+	c.Assert(replicaValue(a, "here"), Equals, "1")
+}
+
+func (s *SubordinateSuite) TestRestartedSubordinateSettlesWithTheSuperior(c *C) {
+	superiorCluster, subCluster, servers := subordinateTestClusters(c)
+	startTestReplica(c, superiorCluster, 0, servers[1])
+	b := startTestReplica(c, subCluster, 0, servers[3])
+	superior := NewMaster(superiorCluster, 0)
+	superior.txs["super-tx1"] = Committed
+	servers[0].Register(superior)
+
+	sub := NewMaster(subCluster, 0)
+	c.Assert(sub.recover(), IsNil)
+	var vote VoteResult
+	c.Assert(sub.Prepare(&PrepareArgs{"super-tx1", []TxOp{{PutOp, "there", []byte("2"), "", ""}}, superiorCluster.Master.Address}, &vote), IsNil)
+	c.Assert(vote.Success, Equals, true)
+	// The superior has forgotten super-tx2, so it aborted it
+	c.Assert(sub.Prepare(&PrepareArgs{"super-tx2", []TxOp{{PutOp, "gone", []byte("3"), "", ""}}, superiorCluster.Master.Address}, &vote), IsNil)
+	c.Assert(vote.Success, Equals, true)
+
+	// The superior's decisions never arrived before the restart
+	sub = NewMaster(subCluster, 0)
+	c.Assert(sub.recover(), IsNil)
+	waitFor(c, func() bool { return sub.countTxs(Prepared) == 0 })
+	var status StatusResult
+	c.Assert(sub.Status(&StatusArgs{"super-tx1"}, &status), IsNil)
+	c.Assert(status.State, Equals, Committed)
+	c.Assert(sub.Status(&StatusArgs{"super-tx2"}, &status), IsNil)
+	c.Assert(status.State, Equals, Aborted)
+	waitFor(c, func() bool { return b.preparedTx("super-tx1") == nil && b.preparedTx("super-tx2") == nil })
+	c.Assert(replicaValue(b, "there"), Equals, "2")
+	c.Assert(replicaValue(b, "gone"), Equals, "<none>")
+}
+
+// slowReplica holds up its votes until released
+type slowReplica struct {
+	*Replica
+	release chan bool
+}
+
+func (r *slowReplica) TryTx(args *TxArgs, reply *ReplicaActionResult) error {
+	<-r.release
+	return r.Replica.TryTx(args, reply)
+}
+
+func subordinateTxState(c *C, sub *Master, txId string) TxState {
+	var status StatusResult
+	c.Assert(sub.Status(&StatusArgs{txId}, &status), IsNil)
+	return status.State
+}
+
+func (s *SubordinateSuite) TestAbortWhilePreparingIsKept(c *C) {
+	superiorCluster, subCluster, servers := subordinateTestClusters(c)
+	b := NewReplica(subCluster, 0)
+	c.Assert(b.recover(), IsNil)
+	release := make(chan bool)
+	servers[3].RegisterName("Replica", &slowReplica{b, release})
+	sub := NewMaster(subCluster, 0)
+	c.Assert(sub.recover(), IsNil)
+
+	voted := make(chan bool)
+	go func() {
+		var vote VoteResult
+		c.Check(sub.Prepare(&PrepareArgs{"super-tx1", []TxOp{{PutOp, "there", []byte("2"), "", ""}}, superiorCluster.Master.Address}, &vote), IsNil)
+		voted <- vote.Success
+	}()
+	waitFor(c, func() bool { return subordinateTxState(c, sub, "super-tx1") == Started })
+
+	// The superior gave up waiting for the vote
+	var reply VoteResult
+	c.Assert(sub.Abort(&DecisionArgs{"super-tx1"}, &reply), IsNil)
+	c.Assert(reply.Success, Equals, true)
+	close(release)
+	c.Assert(<-voted, Equals, false)
+	c.Assert(subordinateTxState(c, sub, "super-tx1"), Equals, Aborted)
+	c.Assert(b.preparedTx("super-tx1"), IsNil)
+	c.Assert(replicaValue(b, "there"), Equals, "<none>")
+
+	sub = NewMaster(subCluster, 0)
+	c.Assert(sub.recover(), IsNil)
+	c.Assert(subordinateTxState(c, sub, "super-tx1"), Equals, Aborted)
+}
+
+func (s *SubordinateSuite) TestPreparedTxsArePolledWithTheSuperior(c *C) {
+	superiorCluster, subCluster, servers := subordinateTestClusters(c)
+	startTestReplica(c, superiorCluster, 0, servers[1])
+	b := startTestReplica(c, subCluster, 0, servers[3])
+	superior := NewMaster(superiorCluster, 0)
+	superior.txs["super-tx1"] = Started
+	superior.txs["super-tx2"] = Started
+	servers[0].Register(superior)
+	sub := NewMaster(subCluster, 0)
+	c.Assert(sub.recover(), IsNil)
+	for _, txId := range []string{"super-tx1", "super-tx2"} {
+		var vote VoteResult
+		c.Assert(sub.Prepare(&PrepareArgs{txId, []TxOp{{PutOp, txId, []byte("v"), "", ""}}, superiorCluster.Master.Address}, &vote), IsNil)
+		c.Assert(vote.Success, Equals, true)
+	}
+
+	// The superior committed super-tx1, but its Commit was lost
+	superior.mu.Lock()
+	superior.txs["super-tx1"] = Committed
+	superior.mu.Unlock()
+	sub.pollSuperiors()
+	c.Assert(subordinateTxState(c, sub, "super-tx1"), Equals, Committed)
+	c.Assert(replicaValue(b, "super-tx1"), Equals, "v")
+	c.Assert(subordinateTxState(c, sub, "super-tx2"), Equals, Prepared)
+}
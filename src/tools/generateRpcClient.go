@@ -15,7 +15,7 @@ const classTemplate = `
 package main
 
 import (
-	"log"
+	"io"
 	"net"
 	"net/rpc"
 )
@@ -46,8 +46,9 @@ func (c *{{.Name}}Client) tryConnect() (err error) {
 
 func (c *{{.Name}}Client) call(serviceMethod string, args interface{}, reply interface{}) (err error) {
 	err = c.rpcClient.Call(serviceMethod, args, reply)
+	// A server that died mid-call leaves an EOF rather than ErrShutdown, and the connection is dead too
 	_, isNetOpError := err.(*net.OpError)
-	if err == rpc.ErrShutdown || isNetOpError {
+	if err == rpc.ErrShutdown || err == io.EOF || err == io.ErrUnexpectedEOF || isNetOpError {
 		c.rpcClient = nil
 	}
 	return
@@ -63,11 +64,13 @@ func (c *{{.TypeName}}Client) {{.FunctionName}}({{.FieldsAsParams}}) ({{if not .
 	var {{.ReplyName}} {{.ReplyType}}
 	err = c.call("{{.TypeName}}.{{.FunctionName}}", &{{.ParamType}}{ {{.FieldsAsArgs}} }, &{{.ReplyName}})
 	if err != nil {
-		log.Println("{{.TypeName}}Client.{{.FunctionName}}:", err)
+		logDebug("RPC failed", "call", "{{.TypeName}}.{{.FunctionName}}", "host", c.host, "error", err)
 		return
 	}
 	{{if .FlattenedReturn}}
 	{{.ReturnName}} = &{{.ReplyName}}.{{.ReturnName}}
+	{{else if not .NoReturnValue}}
+	{{.ReturnName}} = &{{.ReplyName}}
 	{{end}}
 	return
 }
@@ -131,7 +134,7 @@ func GenerateRpcClient(serverFile string) {
 					if ok {
 						st, ok := ts.Type.(*ast.StructType)
 						if ok {
-							t := &Type{ts.Name.Name, make([]Field, len(st.Fields.List)), make([]RpcFuncDecl, 0), "", "", "reply", fmt.Sprintf("*%v", ts.Name.Name), false}
+							t := &Type{ts.Name.Name, make([]Field, len(st.Fields.List)), make([]RpcFuncDecl, 0), "", "", "Result", ts.Name.Name, false}
 							types[ts.Name.Name] = t
 							for i, field := range st.Fields.List {
 								switch fieldType := field.Type.(type) {
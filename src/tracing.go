@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	flag "github.com/ogier/pflag"
+	"hash/crc32"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Every master and replica keeps the spans of its most recent transactions: the master's prepare,
+// decision and commit steps, each participant RPC among them, and each replica's handling of them.
+// A node serves its spans at /trace in the Chrome trace-event format, and "src.exe trace" merges
+// those of a whole cluster into one file for a trace viewer. Each node is a process there and each
+// transaction a thread, numbered from the node id and the txId, so the same transaction lines up
+// across nodes. The master's RPCs to the participants run in parallel, so they get a thread each.
+
+const traceBufferSize = 10000
+
+// span is one timed step of a transaction on one node. Spans of a lane, like the RPCs to one
+// participant, are shown apart from the transaction's other spans.
+type span struct {
+	txId  string
+	lane  string
+	name  string
+	start time.Time
+	dur   time.Duration
+	args  map[string]interface{}
+}
+
+// tracer keeps the last traceBufferSize spans of a node
+type tracer struct {
+	node  string
+	spans []span
+	next  int
+	mu    sync.Mutex
+}
+
+func newTracer(node string) *tracer {
+	return &tracer{node, make([]span, 0, traceBufferSize), 0, sync.Mutex{}}
+}
+
+// record adds a span from start until now, with args given as name and value pairs. Empty string
+// values are left out.
+func (t *tracer) record(txId string, lane string, name string, start time.Time, args ...interface{}) {
+	s := span{txId, lane, name, start, time.Since(start), nil}
+	for i := 0; i+1 < len(args); i += 2 {
+		if args[i+1] == "" {
+			continue
+		}
+		if s.args == nil {
+			s.args = make(map[string]interface{})
+		}
+		s.args[fmt.Sprint(args[i])] = args[i+1]
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.spans) < cap(t.spans) {
+		t.spans = append(t.spans, s)
+	} else {
+		t.spans[t.next] = s
+		t.next = (t.next + 1) % len(t.spans)
+	}
+}
+
+// traceEvent is an event of the Chrome trace-event format: a complete span ("X"), or metadata
+// ("M") naming a process or thread
+type traceEvent struct {
+	Name string                 `json:"name"`
+	Cat  string                 `json:"cat,omitempty"`
+	Ph   string                 `json:"ph"`
+	Ts   int64                  `json:"ts"`
+	Dur  int64                  `json:"dur,omitempty"`
+	Pid  uint32                 `json:"pid"`
+	Tid  uint32                 `json:"tid"`
+	Args map[string]interface{} `json:"args,omitempty"`
+}
+
+type traceFile struct {
+	TraceEvents []traceEvent `json:"traceEvents"`
+}
+
+// errorString is err's message, or "" for no error
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func traceId(s string) uint32 {
+	return crc32.ChecksumIEEE([]byte(s))
+}
+
+// events returns the node's spans as trace events in time order, only those of txId unless it's
+// empty
+func (t *tracer) events(txId string) []traceEvent {
+	t.mu.Lock()
+	spans := make([]span, 0, len(t.spans))
+	for _, s := range t.spans {
+		if txId == "" || s.txId == txId {
+			spans = append(spans, s)
+		}
+	}
+	t.mu.Unlock()
+	sort.Slice(spans, func(i, j int) bool { return spans[i].start.Before(spans[j].start) })
+
+	pid := traceId(t.node)
+	events := []traceEvent{{"process_name", "", "M", 0, 0, pid, 0, map[string]interface{}{"name": t.node}}}
+	named := make(map[string]bool)
+	for _, s := range spans {
+		thread := s.txId
+		if s.lane != "" {
+			thread += " " + s.lane
+		}
+		tid := traceId(thread)
+		if !named[thread] {
+			named[thread] = true
+			events = append(events, traceEvent{"thread_name", "", "M", 0, 0, pid, tid, map[string]interface{}{"name": thread}})
+		}
+		args := map[string]interface{}{"txId": s.txId}
+		for name, value := range s.args {
+			args[name] = value
+		}
+		// A span shorter than a microsecond still shows up
+		dur := s.dur.Nanoseconds() / 1000
+		if dur == 0 {
+			dur = 1
+		}
+		events = append(events, traceEvent{s.name, "tx", "X", s.start.UnixNano() / 1000, dur, pid, tid, args})
+	}
+	return events
+}
+
+// ServeHTTP serves the spans as a Chrome trace, of one transaction with ?tx=<txId>
+func (t *tracer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	writeTrace(w, t.events(req.URL.Query().Get("tx")))
+}
+
+// fetchTrace gets the trace events of the node serving at address
+func fetchTrace(address string, txId string) (events []traceEvent, err error) {
+	resp, err := http.Get("http://" + address + "/trace?tx=" + url.QueryEscape(txId))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprint(address, " answered ", resp.Status))
+	}
+	var trace traceFile
+	err = json.NewDecoder(resp.Body).Decode(&trace)
+	return trace.TraceEvents, err
+}
+
+func writeTrace(w io.Writer, events []traceEvent) error {
+	if events == nil {
+		events = []traceEvent{}
+	}
+	return json.NewEncoder(w).Encode(traceFile{events})
+}
+
+// traceCommand implements "trace", which merges the traces of a running cluster's nodes into one
+// Chrome trace file
+func traceCommand(args []string) {
+	flags := flag.NewFlagSet("trace", flag.ExitOnError)
+	configPath := flags.StringP("config", "c", "", "cluster config file (JSON) whose nodes to trace")
+	replicaCount := flags.IntP("replicaCount", "n", 0, "replica count, required without a cluster config")
+	txId := flags.String("tx", "", "only trace this transaction")
+	flags.Parse(args)
+	if len(flags.Args()) != 1 {
+		log.Fatalln("Usage: trace [-c cluster.json] [--tx=<txId>] <trace file>")
+	}
+
+	cluster := loadCommandCluster(*configPath, *replicaCount)
+	var events []traceEvent
+	for _, n := range append(cluster.coordinators(), cluster.Replicas...) {
+		nodeEvents, err := fetchTrace(n.Address, *txId)
+		if err != nil {
+			log.Println("Warning: no trace from", n.Id, err)
+			continue
+		}
+		events = append(events, nodeEvents...)
+	}
+
+	f, err := os.Create(flags.Args()[0])
+	if err != nil {
+		log.Fatalln(err)
+	}
+	err = writeTrace(f, events)
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Println("Wrote", len(events), "trace events to", flags.Args()[0])
+}
@@ -0,0 +1,64 @@
+// +build !goci
+package main
+
+import (
+	. "launchpad.net/gocheck"
+	"net/http/httptest"
+	"strings"
+	"time"
+)
+
+type TracingSuite struct{}
+
+var _ = Suite(&TracingSuite{})
+
+func spanNames(events []traceEvent) (names []string) {
+	for _, e := range events {
+		if e.Ph == "X" {
+			names = append(names, e.Name)
+		}
+	}
+	return
+}
+
+func (s *TracingSuite) TestSpansBecomeChromeTraceEvents(c *C) {
+	t := newTracer("master")
+	start := time.Now()
+	t.record("tx1", "", "transaction", start, "keys", []string{"foo"}, "error", "")
+	t.record("tx1", "replica0", "prepare", start.Add(time.Millisecond), "vote", true)
+	t.record("tx2", "", "transaction", start.Add(2*time.Millisecond))
+
+	events := t.events("tx1")
+	c.Assert(events, HasLen, 5)
+	c.Assert(events[0], DeepEquals, traceEvent{"process_name", "", "M", 0, 0, traceId("master"), 0, map[string]interface{}{"name": "master"}})
+	c.Assert(events[1].Args["name"], Equals, "tx1")
+	c.Assert(events[2].Tid, Equals, traceId("tx1"))
+	c.Assert(events[2].Ts, Equals, start.UnixNano()/1000)
+	c.Assert(events[2].Args, DeepEquals, map[string]interface{}{"txId": "tx1", "keys": []string{"foo"}})
+	c.Assert(events[3].Args["name"], Equals, "tx1 replica0")
+	c.Assert(events[4].Args, DeepEquals, map[string]interface{}{"txId": "tx1", "vote": true})
+	c.Assert(spanNames(t.events("")), DeepEquals, []string{"transaction", "prepare", "transaction"})
+}
+
+func (s *TracingSuite) TestOnlyTheLatestSpansAreKept(c *C) {
+	t := newTracer("replica0")
+	start := time.Now()
+	for i := 0; i < traceBufferSize+2; i++ {
+		t.record("tx", "", "step", start.Add(time.Duration(i)*time.Microsecond))
+	}
+	events := t.events("")
+	c.Assert(spanNames(events), HasLen, traceBufferSize)
+	c.Assert(events[2].Ts, Equals, start.Add(2*time.Microsecond).UnixNano()/1000)
+}
+
+func (s *TracingSuite) TestTracesAreFetchedOverHttp(c *C) {
+	t := newTracer("replica0")
+	t.record("tx1", "", "commit", time.Now())
+	t.record("tx2", "", "abort", time.Now())
+	server := httptest.NewServer(t)
+	defer server.Close()
+
+	events, err := fetchTrace(strings.TrimPrefix(server.URL, "http://"), "tx2")
+	c.Assert(err, IsNil)
+	c.Assert(spanNames(events), DeepEquals, []string{"abort"})
+}
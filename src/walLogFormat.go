@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"time"
+)
+
+// A WAL starts with walMagic and a header record, followed by one record per write. A record is the
+// length and CRC32 of its payload, each 4 bytes big endian, and then the payload: a record type byte
+// and a list of fields, each a uvarint tag, a uvarint length and the field's bytes. Readers skip
+// record types and tags they don't know, so fields can be added without a new version; walVersion
+// only goes up when an existing field changes meaning.
+//
+// As with the CSV format, a bad last record is one the process died while writing and is dropped,
+// while a bad record anywhere else means the log is corrupt.
+var walMagic = []byte("GOTWOPC\x00WAL\x00")
+
+const walVersion = 1
+
+const walFrameSize = 8
+
+// Record types
+const (
+	walHeaderRecord = 1
+	walEntryRecord  = 2
+	walFieldsRecord = 3
+)
+
+// Fields of walHeaderRecord. walSyncIntervalTag is only there for GroupDurability.
+const (
+	walVersionTag      = 1
+	walCreatedTag      = 2
+	walDurabilityTag   = 3
+	walSyncIntervalTag = 4
+)
+
+// Fields of walEntryRecord. walParticipantTag is repeated once per participant.
+const (
+	walTxIdTag          = 1
+	walStateTag         = 2
+	walOpTag            = 3
+	walKeyTag           = 4
+	walParticipantTag   = 5
+	walCoordinatorTag   = 6
+	walCoordinatorIdTag = 7
+	walTimeTag          = 8
+	walSeqTag           = 9
+	walValueTag         = 10
+)
+
+// Fields of walFieldsRecord, repeated once per field
+const walFieldTag = 1
+
+type walField struct {
+	tag   uint64
+	value []byte
+}
+
+type walFormat struct{}
+
+func (walFormat) name() string {
+	return WalLogFormat
+}
+
+func (walFormat) magic() []byte {
+	return walMagic
+}
+
+func (walFormat) header(d logDurability) []byte {
+	var fields []byte
+	fields = appendWalUint(fields, walVersionTag, walVersion)
+	fields = appendWalUint(fields, walCreatedTag, uint64(time.Now().UnixNano()))
+	fields = appendWalField(fields, walDurabilityTag, []byte(d.level))
+	if d.syncInterval > 0 {
+		fields = appendWalUint(fields, walSyncIntervalTag, uint64(d.syncInterval))
+	}
+	return append(append([]byte{}, walMagic...), walFrame(walHeaderRecord, fields)...)
+}
+
+func (walFormat) headerDurability(data []byte) (d logDurability) {
+	rest := data[len(walMagic):]
+	if len(rest) < walFrameSize {
+		return
+	}
+	length := binary.BigEndian.Uint32(rest[0:4])
+	if length == 0 || uint64(length) > uint64(len(rest)-walFrameSize) {
+		return
+	}
+	fields, err := parseWalFields(rest[walFrameSize+1 : walFrameSize+int(length)])
+	if err != nil {
+		return
+	}
+	for _, f := range fields {
+		switch f.tag {
+		case walDurabilityTag:
+			d.level = string(f.value)
+		case walSyncIntervalTag:
+			v, err := walUint(f.value)
+			if err == nil {
+				d.syncInterval = time.Duration(v)
+			}
+		}
+	}
+	return
+}
+
+func appendWalField(b []byte, tag uint64, value []byte) []byte {
+	var n [binary.MaxVarintLen64]byte
+	b = append(b, n[:binary.PutUvarint(n[:], tag)]...)
+	b = append(b, n[:binary.PutUvarint(n[:], uint64(len(value)))]...)
+	return append(b, value...)
+}
+
+func appendWalUint(b []byte, tag uint64, value uint64) []byte {
+	var n [binary.MaxVarintLen64]byte
+	return appendWalField(b, tag, n[:binary.PutUvarint(n[:], value)])
+}
+
+func walFrame(recordType byte, fields []byte) []byte {
+	payload := append([]byte{recordType}, fields...)
+	frame := make([]byte, walFrameSize, walFrameSize+len(payload))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(payload))
+	return append(frame, payload...)
+}
+
+func parseWalFields(b []byte) (fields []walField, err error) {
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, errors.New("Bad WAL field tag")
+		}
+		b = b[n:]
+		length, n := binary.Uvarint(b)
+		if n <= 0 || length > uint64(len(b)-n) {
+			return nil, errors.New("Bad WAL field length")
+		}
+		b = b[n:]
+		fields = append(fields, walField{tag, b[:length]})
+		b = b[length:]
+	}
+	return
+}
+
+func walUint(value []byte) (uint64, error) {
+	v, n := binary.Uvarint(value)
+	if n <= 0 || n != len(value) {
+		return 0, errors.New("Bad WAL integer field")
+	}
+	return v, nil
+}
+
+func (walFormat) encodeEntry(e logEntry) []byte {
+	var fields []byte
+	fields = appendWalField(fields, walTxIdTag, []byte(e.txId))
+	fields = appendWalUint(fields, walStateTag, uint64(e.state))
+	fields = appendWalUint(fields, walOpTag, uint64(e.op))
+	fields = appendWalField(fields, walKeyTag, []byte(e.key))
+	for _, p := range e.participants {
+		fields = appendWalUint(fields, walParticipantTag, uint64(p))
+	}
+	fields = appendWalField(fields, walCoordinatorTag, []byte(e.coordinator))
+	fields = appendWalField(fields, walCoordinatorIdTag, []byte(e.coordinatorId))
+	if !e.time.IsZero() {
+		fields = appendWalUint(fields, walTimeTag, uint64(e.time.UnixNano()))
+	}
+	if e.seq > 0 {
+		fields = appendWalUint(fields, walSeqTag, e.seq)
+	}
+	if e.value != nil {
+		fields = appendWalField(fields, walValueTag, e.value)
+	}
+	return walFrame(walEntryRecord, fields)
+}
+
+func (walFormat) encodeFields(values []string) []byte {
+	var fields []byte
+	for _, v := range values {
+		fields = appendWalField(fields, walFieldTag, []byte(v))
+	}
+	return walFrame(walFieldsRecord, fields)
+}
+
+func decodeWalEntry(fields []walField) (e logEntry, err error) {
+	for _, f := range fields {
+		var v uint64
+		switch f.tag {
+		case walTxIdTag:
+			e.txId = string(f.value)
+		case walKeyTag:
+			e.key = string(f.value)
+		case walCoordinatorTag:
+			e.coordinator = string(f.value)
+		case walCoordinatorIdTag:
+			e.coordinatorId = string(f.value)
+		case walValueTag:
+			e.value = append([]byte{}, f.value...)
+		case walStateTag, walOpTag, walParticipantTag, walTimeTag, walSeqTag:
+			v, err = walUint(f.value)
+			if err != nil {
+				return
+			}
+			switch f.tag {
+			case walStateTag:
+				e.state = TxState(v)
+			case walOpTag:
+				e.op = Operation(v)
+			case walParticipantTag:
+				e.participants = append(e.participants, int(v))
+			case walTimeTag:
+				e.time = time.Unix(0, int64(v))
+			case walSeqTag:
+				e.seq = v
+			}
+		}
+	}
+	return
+}
+
+func checkWalHeader(fields []walField) error {
+	for _, f := range fields {
+		if f.tag != walVersionTag {
+			continue
+		}
+		version, err := walUint(f.value)
+		if err != nil {
+			return err
+		}
+		if version > walVersion {
+			return errors.New(fmt.Sprint("WAL version ", version, " is newer than the supported version ", walVersion))
+		}
+		return nil
+	}
+	return errors.New("WAL header has no version")
+}
+
+// walRecordAt reports whether data starts with a whole record whose checksum matches
+func walRecordAt(data []byte) bool {
+	if len(data) < walFrameSize {
+		return false
+	}
+	length := binary.BigEndian.Uint32(data[0:4])
+	if length == 0 || uint64(length) > uint64(len(data)-walFrameSize) {
+		return false
+	}
+	return crc32.ChecksumIEEE(data[walFrameSize:walFrameSize+int(length)]) == binary.BigEndian.Uint32(data[4:8])
+}
+
+func (walFormat) decode(logFilePath string, data []byte) (records []logRecord, torn int, err error) {
+	if !bytes.HasPrefix(data, walMagic) {
+		return nil, -1, errors.New(fmt.Sprint("Log ", logFilePath, " is not a WAL"))
+	}
+	pos := len(walMagic)
+	sawHeader := false
+	for pos < len(data) {
+		rest := data[pos:]
+		corrupt := func(reason interface{}) error {
+			return errors.New(fmt.Sprint("Corrupt record in log ", logFilePath, " at offset ", pos, ": ", reason))
+		}
+		if len(rest) < walFrameSize {
+			return records, pos, nil
+		}
+		length := binary.BigEndian.Uint32(rest[0:4])
+		if uint64(length) > uint64(len(rest)-walFrameSize) {
+			if wholeRecordAfter(rest, walRecordAt) {
+				return nil, -1, corrupt("length runs past the end of the log")
+			}
+			return records, pos, nil
+		}
+		end := walFrameSize + int(length)
+		payload := rest[walFrameSize:end]
+		if length == 0 || crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(rest[4:8]) {
+			if end == len(rest) {
+				return records, pos, nil
+			}
+			return nil, -1, corrupt("checksum mismatch")
+		}
+		fields, err := parseWalFields(payload[1:])
+		if err != nil {
+			return nil, -1, corrupt(err)
+		}
+
+		if !sawHeader {
+			if payload[0] != walHeaderRecord {
+				return nil, -1, corrupt("missing header")
+			}
+			err = checkWalHeader(fields)
+			if err != nil {
+				return nil, -1, errors.New(fmt.Sprint("Log ", logFilePath, ": ", err))
+			}
+			sawHeader = true
+			pos += end
+			continue
+		}
+
+		switch payload[0] {
+		case walEntryRecord:
+			entry, err := decodeWalEntry(fields)
+			if err != nil {
+				return nil, -1, corrupt(err)
+			}
+			records = append(records, logRecord{&entry, nil})
+		case walFieldsRecord:
+			values := make([]string, 0, len(fields))
+			for _, f := range fields {
+				if f.tag == walFieldTag {
+					values = append(values, string(f.value))
+				}
+			}
+			records = append(records, logRecord{nil, values})
+		}
+		pos += end
+	}
+	if !sawHeader {
+		return nil, -1, errors.New(fmt.Sprint("Log ", logFilePath, " has no WAL header"))
+	}
+	return records, -1, nil
+}